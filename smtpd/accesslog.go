@@ -0,0 +1,125 @@
+package smtpd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// LogFormat selects the record format of Server.AccessLog.
+type LogFormat int
+
+const (
+	LogKeyValue LogFormat = iota // key=value pairs, one record per line
+	LogJSON                      // one JSON object per line
+)
+
+// accessRecord is one Server.AccessLog record, describing a mail
+// transaction from MAIL FROM to its final reply.
+type accessRecord struct {
+	Time     time.Time     `json:"time"`
+	ID       string        `json:"id"`
+	Client   string        `json:"client"`
+	Helo     string        `json:"helo"`
+	TLS      bool          `json:"tls"`
+	User     string        `json:"user,omitempty"`
+	From     string        `json:"from"`
+	Rcpts    int           `json:"rcpts"`
+	Size     int64         `json:"size"`
+	Lines    int           `json:"lines"`
+	Status   int           `json:"status"`
+	Duration time.Duration `json:"duration_ns"`
+}
+
+func (r *accessRecord) keyValue() []byte {
+	var buf bytes.Buffer
+	kv := func(k, v string) {
+		if buf.Len() > 0 {
+			buf.WriteByte(' ')
+		}
+		if needsQuoting(v) {
+			v = strconv.Quote(v)
+		}
+		fmt.Fprintf(&buf, "%s=%s", k, v)
+	}
+	kv("time", r.Time.UTC().Format(time.RFC3339))
+	kv("id", r.ID)
+	kv("client", r.Client)
+	kv("helo", r.Helo)
+	kv("tls", strconv.FormatBool(r.TLS))
+	if r.User != "" {
+		kv("user", r.User)
+	}
+	kv("from", "<"+r.From+">")
+	kv("rcpts", strconv.Itoa(r.Rcpts))
+	kv("size", strconv.FormatInt(r.Size, 10))
+	kv("lines", strconv.Itoa(r.Lines))
+	kv("status", strconv.Itoa(r.Status))
+	kv("duration", r.Duration.String())
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+// needsQuoting reports whether v must be quoted as a key=value log
+// value: it's empty, or has spaces, quotes, "=", control characters or
+// bytes outside ASCII, which could forge or garble records.
+func needsQuoting(v string) bool {
+	if v == "" {
+		return true
+	}
+	for i := 0; i < len(v); i++ {
+		if b := v[i]; b <= ' ' || b >= 0x7f || b == '"' || b == '=' {
+			return true
+		}
+	}
+	return false
+}
+
+// logTransaction writes an AccessLog record for the current
+// transaction, which ended with the given reply code, or 0 if it was
+// abandoned.
+func (s *session) logTransaction(status int) {
+	w := s.srv.AccessLog
+	if w == nil {
+		return
+	}
+	r := &accessRecord{
+		Time:     s.txStart,
+		ID:       s.queueID,
+		Client:   s.remoteIP(),
+		Helo:     s.helloHost,
+		TLS:      s.tlsActive(),
+		User:     s.authUser,
+		Rcpts:    s.rcpts,
+		Size:     s.msgSize,
+		Lines:    s.msgLines,
+		Status:   status,
+		Duration: time.Since(s.txStart),
+	}
+	if s.from != nil {
+		r.From = s.from.Email()
+	}
+	var line []byte
+	switch s.srv.AccessLogFormat {
+	case LogJSON:
+		line, _ = json.Marshal(r)
+		line = append(line, '\n')
+	default:
+		line = r.keyValue()
+	}
+	s.srv.logMu.Lock()
+	defer s.srv.logMu.Unlock()
+	w.Write(line)
+}
+
+// replyCode returns the reply code of err if it's an SMTPError, or def.
+func replyCode(err error, def int) int {
+	if se, ok := err.(SMTPError); ok && len(se) >= 3 {
+		if code, perr := strconv.Atoi(string(se[:3])); perr == nil {
+			return code
+		}
+	}
+	return def
+}
@@ -0,0 +1,82 @@
+package smtpd
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessLogKeyValue(t *testing.T) {
+	var buf syncBuffer
+	addr := testServer(t, &Server{AccessLog: &buf})
+	c := dialTest(t, addr)
+	c.expect("EHLO client\rforged=1", "250")
+	if r := c.sendMail("a@example.com", "b@example.net", "Subject: hi\r\n\r\nbody"); !strings.HasPrefix(r, "250") {
+		t.Fatal(r)
+	}
+	c.expect("QUIT", "221")
+	c.closed()
+	line := buf.String()
+	for _, want := range []string{
+		" client=127.0.0.1 ",
+		` helo="client\rforged=1" `,
+		" tls=false ",
+		" from=<a@example.com> ",
+		" rcpts=1 ",
+		" size=21 ",
+		" status=250 ",
+	} {
+		if !strings.Contains(line, want) {
+			t.Errorf("record lacks %q:\n%s", want, line)
+		}
+	}
+	if strings.Count(line, "\n") != 1 {
+		t.Errorf("want one record line, got %q", line)
+	}
+}
+
+func TestAccessLogQuoting(t *testing.T) {
+	for v, want := range map[string]string{
+		"plain":       "plain",
+		"":            `""`,
+		"two words":   `"two words"`,
+		"a=b":         `"a=b"`,
+		"cr\rlf\n":    `"cr\rlf\n"`,
+		"nul\x00":     `"nul\x00"`,
+		"del\x7f":     `"del\x7f"`,
+		"caf\xc3\xa9": `"café"`,
+		"bad\xffutf8": `"bad\xffutf8"`,
+	} {
+		r := &accessRecord{Helo: v}
+		if got := string(r.keyValue()); !strings.Contains(got, " helo="+want+" ") {
+			t.Errorf("helo %q logged as %q, want helo=%s", v, got, want)
+		}
+	}
+}
+
+func TestAccessLogJSON(t *testing.T) {
+	var buf syncBuffer
+	addr := testServer(t, &Server{
+		AccessLog:       &buf,
+		AccessLogFormat: LogJSON,
+		LocalDomains:    []string{"example.net"},
+	})
+	c := dialTest(t, addr)
+	c.expect("EHLO client.test", "250")
+	c.expect("MAIL FROM:<a@example.com>", "250")
+	c.expect("RCPT TO:<b@elsewhere.test>", "550")
+	c.expect("RCPT TO:<b@example.net>", "250")
+	c.expect("DATA", "354")
+	c.expect("Subject: hi\r\n\r\nbody\r\n.", "250")
+	c.expect("QUIT", "221")
+	c.closed()
+	var r accessRecord
+	if err := json.Unmarshal([]byte(buf.String()), &r); err != nil {
+		t.Fatalf("%v: %q", err, buf.String())
+	}
+	if r.Helo != "client.test" || r.From != "a@example.com" || r.Rcpts != 1 || r.Status != 250 ||
+		r.Size != 21 || r.ID == "" || r.Duration <= 0 || time.Since(r.Time) > time.Minute {
+		t.Errorf("bad record %+v", r)
+	}
+}
@@ -0,0 +1,280 @@
+package smtpd
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+var (
+	errAuthFailed          = SMTPError("535 5.7.8 Error: authentication failed")
+	errTooManyAuthFailures = SMTPError("421 4.7.0 Too many authentication failures")
+	errTooManySessions     = SMTPError("421 4.7.0 Too many concurrent sessions")
+)
+
+// authMechanisms returns the SASL mechanisms to advertise to the
+// session. PLAIN and LOGIN send the password in the clear, so if the
+// server can do TLS they're held back until the connection is encrypted
+// (RFC 4954 s4). CRAM-MD5 never exposes the password and is always
+// offered when enabled.
+func (s *session) authMechanisms() []string {
+	var mechs []string
+	if s.srv.CRAMMD5Secret != nil {
+		mechs = append(mechs, "CRAM-MD5")
+	}
+	if s.srv.TLSConfig != nil && !s.tlsActive() {
+		return mechs
+	}
+	if s.srv.PlainAuth {
+		mechs = append(mechs, "PLAIN")
+	}
+	if s.srv.LoginAuth {
+		mechs = append(mechs, "LOGIN")
+	}
+	return mechs
+}
+
+// authEnabled reports whether any AUTH mechanism is configured.
+func (srv *Server) authEnabled() bool {
+	return srv.PlainAuth || srv.LoginAuth || srv.CRAMMD5Secret != nil
+}
+
+func (s *session) handleAuth(arg string) {
+	if s.authUser != "" {
+		s.sendlinef("503 5.5.1 Error: already authenticated")
+		return
+	}
+	if s.env != nil {
+		s.sendlinef("503 5.5.1 Error: MAIL transaction in progress")
+		return
+	}
+	mech, initial := arg, ""
+	if idx := strings.Index(arg, " "); idx != -1 {
+		mech, initial = arg[:idx], strings.TrimSpace(arg[idx+1:])
+	}
+	mech = strings.ToUpper(mech)
+	switch {
+	case mech == "CRAM-MD5" && s.srv.CRAMMD5Secret != nil:
+		s.authCRAMMD5(initial)
+		return
+	case mech == "PLAIN" && s.srv.PlainAuth, mech == "LOGIN" && s.srv.LoginAuth:
+	default:
+		s.sendlinef("504 5.5.4 Error: unrecognized authentication type")
+		return
+	}
+	if s.srv.TLSConfig != nil && !s.tlsActive() {
+		s.sendlinef("538 5.7.11 Encryption required for requested authentication mechanism")
+		return
+	}
+	cb := s.srv.OnAuth
+	if cb == nil {
+		log.Printf("smtp: Server.OnAuth is nil; rejecting AUTH")
+		s.sendlinef("454 4.7.0 Error: authentication not configured")
+		return
+	}
+
+	var user, pass string
+	var ok bool
+	switch mech {
+	case "PLAIN":
+		user, pass, ok = s.authPlain(initial)
+	case "LOGIN":
+		user, pass, ok = s.authLogin(initial)
+	}
+	if !ok {
+		return
+	}
+	if err := cb(s, user, pass); err != nil {
+		s.authFailed(user, err)
+		return
+	}
+	if s.authenticated(user) {
+		s.sendlinef("235 2.7.0 Authentication successful")
+	}
+}
+
+// authenticated makes user, whose credentials have been checked, the
+// session's user, unless that would exceed Server.MaxSessionsPerUser,
+// in which case the client is told and disconnected and it reports
+// false.
+func (s *session) authenticated(user string) bool {
+	if max := s.srv.MaxSessionsPerUser; max > 0 {
+		s.srv.mu.Lock()
+		if s.srv.userSess == nil {
+			s.srv.userSess = make(map[string]int)
+		}
+		n := s.srv.userSess[user]
+		if n < max {
+			s.srv.userSess[user] = n + 1
+		}
+		s.srv.mu.Unlock()
+		if n >= max {
+			log.Printf("disconnecting %v: %q already has %d sessions", s.Addr(), user, n)
+			s.sendError(errTooManySessions)
+			s.quit = true
+			return false
+		}
+		s.userCounted = true
+	}
+	s.authUser = user
+	return true
+}
+
+// authFailed rejects an AUTH command whose credentials for user were
+// refused with err, after Server.AuthFailureDelay. If that makes
+// Server.MaxAuthAttempts failures, the client is disconnected instead.
+func (s *session) authFailed(user string, err error) {
+	log.Printf("authentication failed for %q: %v", logText(user), err)
+	s.authFailures++
+	if d := s.srv.AuthFailureDelay; d > 0 {
+		time.Sleep(d)
+	}
+	if max := s.srv.MaxAuthAttempts; max > 0 && s.authFailures >= max {
+		log.Printf("disconnecting %v after %d failed AUTH attempts", s.Addr(), s.authFailures)
+		s.sendError(errTooManyAuthFailures)
+		s.quit = true
+		return
+	}
+	s.sendSMTPErrorOrLinef(err, "%s", s.srv.status(errAuthFailed))
+}
+
+// releaseUser stops counting the session towards its user's
+// MaxSessionsPerUser.
+func (s *session) releaseUser() {
+	if !s.userCounted {
+		return
+	}
+	s.userCounted = false
+	s.srv.mu.Lock()
+	defer s.srv.mu.Unlock()
+	if n := s.srv.userSess[s.authUser] - 1; n > 0 {
+		s.srv.userSess[s.authUser] = n
+	} else {
+		delete(s.srv.userSess, s.authUser)
+	}
+}
+
+// authCRAMMD5 runs the CRAM-MD5 mechanism (RFC 2195).
+func (s *session) authCRAMMD5(initial string) {
+	if initial != "" {
+		s.sendlinef("501 5.5.2 Error: CRAM-MD5 takes no initial response")
+		return
+	}
+	var nonce [8]byte
+	rand.Read(nonce[:])
+	challenge := fmt.Sprintf("<%x.%d@%s>", nonce, time.Now().Unix(), s.srv.hostname())
+	resp, ok := s.authResponse("", base64.StdEncoding.EncodeToString([]byte(challenge)))
+	if !ok {
+		return
+	}
+	user, digest, ok := strings.Cut(string(resp), " ")
+	if !ok {
+		s.sendlinef("501 5.5.2 Error: malformed CRAM-MD5 response")
+		return
+	}
+	secret, err := s.srv.CRAMMD5Secret(s, user)
+	if err == nil {
+		mac := hmac.New(md5.New, []byte(secret))
+		mac.Write([]byte(challenge))
+		want := hex.EncodeToString(mac.Sum(nil))
+		if !hmac.Equal([]byte(want), []byte(strings.ToLower(digest))) {
+			err = errAuthFailed
+		}
+	}
+	if err != nil {
+		s.authFailed(user, err)
+		return
+	}
+	if s.authenticated(user) {
+		s.sendlinef("235 2.7.0 Authentication successful")
+	}
+}
+
+// authPlain runs the PLAIN mechanism (RFC 4616). It reports false,
+// having replied to the client, if the exchange failed.
+func (s *session) authPlain(initial string) (user, pass string, ok bool) {
+	resp, ok := s.authResponse(initial, "")
+	if !ok {
+		return
+	}
+	// authzid NUL authcid NUL passwd
+	parts := bytes.Split(resp, []byte{0})
+	if len(parts) != 3 {
+		s.sendlinef("501 5.5.2 Error: malformed PLAIN response")
+		return "", "", false
+	}
+	return string(parts[1]), string(parts[2]), true
+}
+
+// authLogin runs the non-standard but widely used LOGIN mechanism.
+func (s *session) authLogin(initial string) (user, pass string, ok bool) {
+	u, ok := s.authResponse(initial, "VXNlcm5hbWU6") // "Username:"
+	if !ok {
+		return
+	}
+	p, ok := s.authResponse("", "UGFzc3dvcmQ6") // "Password:"
+	if !ok {
+		return
+	}
+	return string(u), string(p), true
+}
+
+// authResponse returns the decoded client response to a challenge:
+// initial, if non-empty, else the line the client sends after we send
+// the 334 challenge. "=" is an empty response, and "*" cancels the
+// exchange (RFC 4954 s4). It reports false, having replied to the
+// client, if there was no valid response.
+func (s *session) authResponse(initial, challenge string) ([]byte, bool) {
+	resp := initial
+	if resp == "" {
+		s.sendlinef("334 %s", challenge)
+		line, err := s.readAuthLine()
+		if err != nil {
+			s.errorf("read error: %v", err)
+			if isTimeout(err) {
+				s.sendError(errCommandTimeout)
+			}
+			s.quit = true
+			return nil, false
+		}
+		if line == "*" {
+			s.sendlinef("501 5.7.0 Authentication cancelled")
+			return nil, false
+		}
+		resp = line
+	}
+	if resp == "=" {
+		return []byte{}, true
+	}
+	dec, err := base64.StdEncoding.DecodeString(resp)
+	if err != nil {
+		s.sendlinef("501 5.5.2 Error: invalid base64 in response")
+		return nil, false
+	}
+	return dec, true
+}
+
+// readAuthLine reads an AUTH continuation line, keeping it out of the
+// transcript.
+func (s *session) readAuthLine() (string, error) {
+	d := s.srv.AuthTimeout
+	if d == 0 {
+		d = s.srv.CommandTimeout
+	}
+	s.setReadTimeout(d)
+	sl, err := s.readLine()
+	if len(sl) > 0 {
+		s.transcript("C: ", []byte("<redacted>"))
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(sl), "\r\n"), nil
+}
@@ -0,0 +1,156 @@
+package smtpd
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuthRedacted(t *testing.T) {
+	logs := captureLog(t)
+	var transcript syncBuffer
+	addr := testServer(t, &Server{
+		PlainAuth:       true,
+		LoginAuth:       true,
+		DebugTranscript: &transcript,
+		OnAuth: func(c Connection, user, pass string) error {
+			if pass != "s3cret" {
+				return errors.New("bad password")
+			}
+			return nil
+		},
+	})
+	plain := base64.StdEncoding.EncodeToString([]byte("\x00alice\x00s3cret"))
+	user := base64.StdEncoding.EncodeToString([]byte("bob"))
+	pass := base64.StdEncoding.EncodeToString([]byte("wrong-s3cret"))
+	c := dialTest(t, addr)
+	c.expect("EHLO client.test", "250")
+	c.expect("AUTH LOGIN", "334 ")
+	c.expect(user, "334 ")
+	c.expect(pass, "535")
+	c.expect("AUTH PLAIN "+plain, "235")
+	c.expect("AUTH PLAIN "+plain, "503") // logged as a rejected command
+	c.expect("QUIT", "221")
+	c.closed()
+	for _, secret := range []string{plain, user, pass, "s3cret"} {
+		if strings.Contains(logs.String(), secret) {
+			t.Errorf("log contains %q:\n%s", secret, logs)
+		}
+		if strings.Contains(transcript.String(), secret) {
+			t.Errorf("transcript contains %q:\n%s", secret, &transcript)
+		}
+	}
+	if !strings.Contains(transcript.String(), "C: AUTH PLAIN <redacted>\n") {
+		t.Errorf("transcript lacks the redacted AUTH line:\n%s", &transcript)
+	}
+}
+
+func TestRedacted(t *testing.T) {
+	for line, want := range map[string]string{
+		"AUTH PLAIN AGFsaWNl\r\n":  "AUTH PLAIN <redacted>\r\n",
+		"auth login  Ym9i\r\n":     "auth login <redacted>\r\n",
+		"AUTH LOGIN\r\n":           "AUTH LOGIN\r\n",
+		"AUTH PLAIN \r\n":          "AUTH PLAIN \r\n",
+		"MAIL FROM:<a@b.test>\r\n": "MAIL FROM:<a@b.test>\r\n",
+	} {
+		if got := cmdLine(line).redacted(); got != want {
+			t.Errorf("redacted(%q) = %q, want %q", line, got, want)
+		}
+	}
+}
+
+func TestAuthCancel(t *testing.T) {
+	addr := testServer(t, &Server{
+		LoginAuth:       true,
+		PlainAuth:       true,
+		MaxAuthAttempts: 1,
+		CRAMMD5Secret:   func(c Connection, user string) (string, error) { return "secret", nil },
+		OnAuth:          func(c Connection, user, pass string) error { return nil },
+	})
+	c := dialTest(t, addr)
+	c.expect("EHLO client.test", "250")
+	c.expect("AUTH LOGIN", "334 ")
+	c.expect("*", "501 5.7.0 Authentication cancelled")
+	c.expect("AUTH LOGIN", "334 ")
+	c.expect(base64.StdEncoding.EncodeToString([]byte("bob")), "334 ")
+	c.expect("*", "501 5.7.0 Authentication cancelled")
+	c.expect("AUTH CRAM-MD5", "334 ")
+	c.expect("*", "501 5.7.0 Authentication cancelled")
+	c.expect("AUTH PLAIN", "334 ")
+	c.expect("*", "501 5.7.0 Authentication cancelled")
+	// With MaxAuthAttempts 1, a cancellation counted as a failure
+	// would have ended the session.
+	c.expect("AUTH PLAIN "+base64.StdEncoding.EncodeToString([]byte("\x00bob\x00pw")), "235")
+}
+
+func TestMaxSessionsPerUser(t *testing.T) {
+	srv := &Server{
+		PlainAuth:          true,
+		MaxSessionsPerUser: 2,
+		OnAuth:             func(c Connection, user, pass string) error { return nil },
+	}
+	addr := testServer(t, srv)
+	login := func(user, want string) *testClient {
+		c := dialTest(t, addr)
+		c.expect("EHLO client.test", "250")
+		c.expect("AUTH PLAIN "+base64.StdEncoding.EncodeToString([]byte("\x00"+user+"\x00pw")), want)
+		return c
+	}
+	first := login("alice", "235")
+	login("alice", "235")
+	login("alice", "421 4.7.0 Too many concurrent sessions").closed()
+	login("bob", "235") // counted separately
+
+	first.expect("QUIT", "221")
+	first.closed()
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		srv.mu.Lock()
+		n := srv.userSess["alice"]
+		srv.mu.Unlock()
+		if n < 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("alice still has %d sessions after one quit", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	login("alice", "235")
+}
+
+func TestMaxAuthAttempts(t *testing.T) {
+	const delay = 50 * time.Millisecond
+	addr := testServer(t, &Server{
+		PlainAuth:        true,
+		MaxAuthAttempts:  3,
+		AuthFailureDelay: delay,
+		OnAuth: func(c Connection, user, pass string) error {
+			if pass != "right" {
+				return errors.New("bad password")
+			}
+			return nil
+		},
+	})
+	plain := func(pass string) string {
+		return "AUTH PLAIN " + base64.StdEncoding.EncodeToString([]byte("\x00alice\x00"+pass))
+	}
+	c := dialTest(t, addr)
+	c.expect("EHLO client.test", "250")
+	for i := 0; i < 2; i++ {
+		start := time.Now()
+		c.expect(plain("wrong"), "535")
+		if d := time.Since(start); d < delay {
+			t.Errorf("failure %d answered after %v, want at least %v", i+1, d, delay)
+		}
+	}
+	c.expect(plain("wrong"), "421 4.7.0 Too many authentication failures")
+	c.closed()
+
+	// Failures are counted per session.
+	c = dialTest(t, addr)
+	c.expect("EHLO client.test", "250")
+	c.expect(plain("wrong"), "535")
+	c.expect(plain("right"), "235")
+}
@@ -0,0 +1,131 @@
+package smtpd
+
+import (
+	"log"
+	"strings"
+)
+
+// AuthResult is the result of one message authentication method, for
+// an Authentication-Results header field (RFC 8601).
+type AuthResult struct {
+	Method string // e.g. "spf", "dkim", "dmarc"
+	Result string // e.g. "pass", "fail", "none"
+	Reason string // optional free-form explanation
+
+	// Props are the properties the result was evaluated against,
+	// such as {"smtp.mailfrom", "a@example.com"} or
+	// {"header.d", "example.com"}.
+	Props []AuthProp
+}
+
+// AuthProp is a property of an AuthResult. Name is "ptype.property".
+type AuthProp struct {
+	Name, Value string
+}
+
+// AuthenticationResults formats the value of an Authentication-Results
+// header field for the given authserv-id and results, quoting values
+// as needed. With no results it reports "none". Control characters in
+// values are replaced with spaces, and a result whose Method or Result
+// isn't a keyword, or a property whose Name isn't ptype.property, is
+// logged and left out, so the field can't be broken or extended.
+func AuthenticationResults(authservID string, results []AuthResult) string {
+	var b strings.Builder
+	b.WriteString(authservID)
+	if len(results) == 0 {
+		b.WriteString("; none")
+		return b.String()
+	}
+	n := 0
+	for _, r := range results {
+		if !authresKeyword(r.Method, false) || !authresKeyword(r.Result, false) {
+			log.Printf("AuthenticationResults: leaving out result %q=%q", r.Method, r.Result)
+			continue
+		}
+		n++
+		b.WriteString(";\r\n\t")
+		b.WriteString(r.Method)
+		b.WriteByte('=')
+		b.WriteString(r.Result)
+		if r.Reason != "" {
+			b.WriteString(" reason=")
+			b.WriteString(authresValue(r.Reason, false))
+		}
+		for _, p := range r.Props {
+			if !authresKeyword(p.Name, true) {
+				log.Printf("AuthenticationResults: leaving out property %q", p.Name)
+				continue
+			}
+			b.WriteByte(' ')
+			b.WriteString(p.Name)
+			b.WriteByte('=')
+			b.WriteString(authresValue(p.Value, true))
+		}
+	}
+	if n == 0 {
+		b.WriteString("; none")
+	}
+	return b.String()
+}
+
+// AddAuthResults adds an Authentication-Results header field for the
+// current message, with the server's hostname as the authserv-id.
+func (s *session) AddAuthResults(results ...AuthResult) {
+	s.AddHeader("Authentication-Results", AuthenticationResults(s.srv.hostname(), results))
+}
+
+// authresValue returns v as an RFC 2045 token, or as a quoted-string
+// if it isn't one. Property values may also be bare addresses and
+// domains, so allowAt permits "@".
+func authresValue(v string, allowAt bool) string {
+	token := v != ""
+	for i := 0; i < len(v) && token; i++ {
+		c := v[i]
+		switch {
+		case c <= ' ' || c >= 0x7f:
+			token = false
+		case c == '@':
+			token = allowAt
+		case strings.IndexByte(`()<>,;:\"/[]?=`, c) != -1:
+			token = false
+		}
+	}
+	if token {
+		return v
+	}
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(v); i++ {
+		switch c := v[i]; {
+		case c < ' ' || c == 0x7f:
+			b.WriteByte(' ')
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// authresKeyword reports whether s is an RFC 8601 method or result
+// keyword: letters, digits and inner hyphens. With ptype it must be a
+// property name instead, two such keywords joined by a dot.
+func authresKeyword(s string, ptype bool) bool {
+	if ptype {
+		i := strings.IndexByte(s, '.')
+		return i != -1 && authresKeyword(s[:i], false) && authresKeyword(s[i+1:], false)
+	}
+	if s == "" || s[0] == '-' || s[len(s)-1] == '-' {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
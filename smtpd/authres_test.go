@@ -0,0 +1,73 @@
+package smtpd
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAuthenticationResults(t *testing.T) {
+	got := AuthenticationResults("mx.test", []AuthResult{
+		{Method: "spf", Result: "pass", Props: []AuthProp{{"smtp.mailfrom", "a@example.com"}}},
+		{Method: "dkim", Result: "fail", Reason: "signature did not verify",
+			Props: []AuthProp{{"header.d", "example.com"}, {"header.s", "sel;1"}}},
+		{Method: "dmarc", Result: "none", Reason: `say "hi"`},
+	})
+	want := "mx.test;\r\n" +
+		"\tspf=pass smtp.mailfrom=a@example.com;\r\n" +
+		"\tdkim=fail reason=\"signature did not verify\" header.d=example.com header.s=\"sel;1\";\r\n" +
+		"\tdmarc=none reason=\"say \\\"hi\\\"\""
+	if got != want {
+		t.Errorf("got  %q\nwant %q", got, want)
+	}
+	if got := AuthenticationResults("mx.test", nil); got != "mx.test; none" {
+		t.Errorf("no results: got %q", got)
+	}
+	for v, want := range map[string]string{
+		"pass":          "pass",
+		"":              `""`,
+		"a@example.com": `"a@example.com"`,
+		"a b":           `"a b"`,
+		`back\slash`:    `"back\\slash"`,
+	} {
+		if got := authresValue(v, false); got != want {
+			t.Errorf("authresValue(%q) = %s, want %s", v, got, want)
+		}
+	}
+}
+
+func TestAuthenticationResultsInjection(t *testing.T) {
+	got := AuthenticationResults("mx.test", []AuthResult{
+		{Method: "spf", Result: "pass", Reason: "x\r\nBcc: evil@x",
+			Props: []AuthProp{{"smtp.mailfrom", "a\x00@b.test\x7f"}, {"x\r\nBcc: evil@x\r\n.p", "v"}}},
+		{Method: "dkim\r\nBcc: evil@x", Result: "pass"},
+		{Method: "dkim", Result: "pass; x=y"},
+	})
+	want := "mx.test;\r\n\tspf=pass reason=\"x  Bcc: evil@x\" smtp.mailfrom=\"a @b.test \""
+	if got != want {
+		t.Errorf("got  %q\nwant %q", got, want)
+	}
+	got = AuthenticationResults("mx.test", []AuthResult{{Method: "spf", Result: ""}})
+	if got != "mx.test; none" {
+		t.Errorf("only unusable results: got %q, want none", got)
+	}
+}
+
+func TestAddAuthResults(t *testing.T) {
+	onNewMail, last := collector()
+	addr := testServer(t, &Server{
+		OnNewMail: func(c Connection, from MailAddress) (Envelope, error) {
+			c.AddAuthResults(AuthResult{Method: "spf", Result: "pass",
+				Props: []AuthProp{{"smtp.mailfrom", from.Email()}}})
+			return onNewMail(c, from)
+		},
+	})
+	c := dialTest(t, addr)
+	c.expect("EHLO client.test", "250")
+	if r := c.sendMail("a@b.test", "c@d.test", "Subject: hi\r\n\r\nbody"); !strings.HasPrefix(r, "250") {
+		t.Fatal(r)
+	}
+	want := "Authentication-Results: mx.test;\r\n\tspf=pass smtp.mailfrom=a@b.test\r\nSubject: hi\r\n"
+	if got := last().Data.String(); !strings.HasPrefix(got, want) {
+		t.Errorf("message starts %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,68 @@
+package smtpd
+
+import (
+	"log"
+	"time"
+)
+
+var errTooManyErrors = SMTPError("421 4.7.0 Too many errors, closing connection")
+
+// Backoff configures Server.RejectionBackoff: how a session is slowed
+// down, then dropped, as its commands keep being rejected, as in a
+// dictionary attack on recipient addresses.
+type Backoff struct {
+	// After is the number of rejections allowed before replies are
+	// delayed.
+	After int
+
+	// Delay is added before each reply for every rejection beyond
+	// After, up to MaxDelay if that's non-zero.
+	Delay    time.Duration
+	MaxDelay time.Duration
+
+	// Disconnect, if non-zero, is the number of rejections after
+	// which the client gets a 421 reply and the connection is closed.
+	Disconnect int
+}
+
+// delay returns how long to wait before replying to a session that
+// has had n rejections.
+func (b *Backoff) delay(n int) time.Duration {
+	if n <= b.After {
+		return 0
+	}
+	d := time.Duration(n-b.After) * b.Delay
+	if b.MaxDelay != 0 && d > b.MaxDelay {
+		d = b.MaxDelay
+	}
+	return d
+}
+
+// tarpit delays handling the next command if the session has had too
+// many rejections.
+func (s *session) tarpit() {
+	if b := s.srv.RejectionBackoff; b != nil && !s.isTrusted() {
+		if d := b.delay(s.rejections); d > 0 {
+			time.Sleep(d)
+		}
+	}
+}
+
+// countRejection counts the command just handled if its reply was a
+// 4xx or 5xx. It reports whether the session has had too many and
+// has been told it's being disconnected.
+func (s *session) countRejection() bool {
+	b := s.srv.RejectionBackoff
+	rejected := s.rejected
+	s.rejected = false
+	if b == nil || !rejected || s.isTrusted() {
+		return false
+	}
+	s.rejections++
+	if b.Disconnect > 0 && s.rejections >= b.Disconnect {
+		log.Printf("disconnecting %v after %d rejected commands", s.Addr(), s.rejections)
+		s.sendError(errTooManyErrors)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,39 @@
+package smtpd
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	b := &Backoff{After: 2, Delay: time.Second, MaxDelay: 3 * time.Second}
+	for n, want := range []time.Duration{0, 0, 0, time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second} {
+		if got := b.delay(n); got != want {
+			t.Errorf("delay(%d) = %v, want %v", n, got, want)
+		}
+	}
+}
+
+func TestRejectionBackoff(t *testing.T) {
+	const step = 50 * time.Millisecond
+	addr := testServer(t, &Server{
+		RejectionBackoff: &Backoff{After: 2, Delay: step, Disconnect: 5},
+		OnRcpt: func(c Connection, from, rcpt MailAddress) error {
+			return ErrUserUnknown
+		},
+	})
+	c := dialTest(t, addr)
+	c.expect("EHLO client.test", "250")
+	c.expect("MAIL FROM:<a@b.test>", "250")
+	for i := 1; i <= 4; i++ {
+		start := time.Now()
+		c.expect("RCPT TO:<guess@b.test>", "550")
+		// The ith RCPT waits for the i-1 rejections before it.
+		if want := time.Duration(i-1-2) * step; want > 0 && time.Since(start) < want {
+			t.Errorf("RCPT %d answered after %v, want at least %v", i, time.Since(start), want)
+		}
+	}
+	c.expect("RCPT TO:<guess@b.test>", "550 5.1.1 User unknown")
+	c.expect("", "421 4.7.0 Too many errors, closing connection")
+	c.closed()
+}
@@ -0,0 +1,156 @@
+package smtpd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"testing"
+)
+
+// nopEnvelope accepts and discards every message.
+type nopEnvelope struct{}
+
+func (nopEnvelope) AddRecipient(rcpt MailAddress) error { return nil }
+func (nopEnvelope) BeginData() error                    { return nil }
+func (nopEnvelope) Write(line []byte) error             { return nil }
+func (nopEnvelope) Close() error                        { return nil }
+
+// benchServer starts a server whose Envelopes discard messages, with
+// logging off, and returns its address.
+func benchServer(b *testing.B) string {
+	log.SetOutput(io.Discard)
+	b.Cleanup(func() { log.SetOutput(os.Stderr) })
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	srv := &Server{
+		Hostname:  "mx.test",
+		OnNewMail: func(c Connection, from MailAddress) (Envelope, error) { return nopEnvelope{}, nil },
+	}
+	go srv.Serve(ln)
+	b.Cleanup(func() { srv.Close() })
+	return ln.Addr().String()
+}
+
+const benchMessage = "From: a@example.com\r\nTo: b@example.net\r\nSubject: bench\r\n\r\n" +
+	"A short message body.\r\n.\r\n"
+
+// benchTransaction sends one message on a greeted connection, with
+// the envelope commands pipelined, and checks the replies.
+func benchTransaction(b *testing.B, c net.Conn, br *bufio.Reader) {
+	io.WriteString(c, "MAIL FROM:<a@example.com>\r\nRCPT TO:<b@example.net>\r\nDATA\r\n")
+	for _, want := range []string{"250", "250", "354"} {
+		if l, err := br.ReadString('\n'); err != nil || !strings.HasPrefix(l, want) {
+			b.Fatalf("got %q, %v; want %s", l, err, want)
+		}
+	}
+	io.WriteString(c, benchMessage)
+	if l, err := br.ReadString('\n'); err != nil || !strings.HasPrefix(l, "250") {
+		b.Fatalf("end of data: %q, %v", l, err)
+	}
+}
+
+// readReply reads a possibly multiline reply.
+func readReply(br *bufio.Reader) (string, error) {
+	for {
+		l, err := br.ReadString('\n')
+		if err != nil || len(l) < 4 || l[3] != '-' {
+			return l, err
+		}
+	}
+}
+
+// BenchmarkConnections measures whole sessions per second: greeting,
+// EHLO, one message and QUIT on a new connection.
+func BenchmarkConnections(b *testing.B) {
+	addr := benchServer(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			b.Fatal(err)
+		}
+		br := bufio.NewReader(c)
+		readReply(br)
+		io.WriteString(c, "EHLO client.test\r\n")
+		readReply(br)
+		benchTransaction(b, c, br)
+		io.WriteString(c, "QUIT\r\n")
+		readReply(br)
+		c.Close()
+	}
+}
+
+// BenchmarkMessages measures messages per second on one connection.
+func BenchmarkMessages(b *testing.B) {
+	addr := benchServer(b)
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer c.Close()
+	br := bufio.NewReader(c)
+	readReply(br)
+	io.WriteString(c, "EHLO client.test\r\n")
+	readReply(br)
+	b.SetBytes(int64(len(benchMessage)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		benchTransaction(b, c, br)
+	}
+	b.StopTimer()
+	io.WriteString(c, "QUIT\r\n")
+	readReply(br)
+}
+
+// BenchmarkParseCommand measures parsing a RCPT TO line with
+// parameters, the commonest command in a transaction.
+func BenchmarkParseCommand(b *testing.B) {
+	const line = "RCPT TO:<someone@example.net> NOTIFY=FAILURE ORCPT=rfc822;someone@example.net\r\n"
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := ParseCommand(line); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkAccept measures connections per second, each just a banner
+// and QUIT, with one accept loop and with several sharing the port
+// through Server.Listeners.
+func BenchmarkAccept(b *testing.B) {
+	for _, n := range []int{1, 4} {
+		b.Run(fmt.Sprintf("listeners=%d", n), func(b *testing.B) {
+			lc, addr := reusePortConfig(b)
+			srv := &Server{Addr: addr, Hostname: "mx.test", ListenConfig: lc, Listeners: n}
+			go srv.ListenAndServe()
+			defer srv.Close()
+			waitListening(b, srv)
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					c, err := net.Dial("tcp", addr)
+					if err != nil {
+						b.Error(err)
+						return
+					}
+					br := bufio.NewReader(c)
+					br.ReadString('\n')
+					c.Write([]byte("QUIT\r\n"))
+					if l, err := br.ReadString('\n'); err != nil || !strings.HasPrefix(l, "221") {
+						b.Errorf("QUIT: %q, %v", l, err)
+					}
+					c.Close()
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package smtpd
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+var errConnBurst = SMTPError("421 4.7.0 Too many connections, try again later")
+
+// BurstLimit configures Server.ConnectionBurstLimit: how many
+// connections one client IP may open within a sliding window before
+// further ones are held back or refused, as in a connection flood.
+type BurstLimit struct {
+	Count  int           // connections allowed per Window
+	Window time.Duration // 1 minute if zero
+
+	// Delay, if non-zero, makes connections over the limit wait that
+	// long before the banner. Otherwise they get a 421 and are closed.
+	Delay time.Duration
+}
+
+func (b *BurstLimit) window() time.Duration {
+	if b.Window != 0 {
+		return b.Window
+	}
+	return time.Minute
+}
+
+// burstTracker remembers the recent connection times of each client
+// IP, at most BurstLimit.Count of them. IPs not seen for a window are
+// swept every sweepEvery connections.
+type burstTracker struct {
+	mu      sync.Mutex
+	m       map[string][]time.Time
+	records int
+}
+
+// add records a connection from ip at now and reports whether it's over
+// b's limit.
+func (t *burstTracker) add(b *BurstLimit, ip string, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.m == nil {
+		t.m = make(map[string][]time.Time)
+	}
+	window := b.window()
+	times := t.m[ip]
+	for len(times) > 0 && now.Sub(times[0]) >= window {
+		times = times[1:]
+	}
+	over := len(times) >= b.Count
+	if over {
+		times = times[1:]
+	}
+	t.m[ip] = append(times, now)
+	t.records++
+	if t.records%sweepEvery == 0 {
+		for k, times := range t.m {
+			if now.Sub(times[len(times)-1]) >= window {
+				delete(t.m, k)
+			}
+		}
+	}
+	return over
+}
+
+// checkBurst applies Server.ConnectionBurstLimit to a new connection.
+// It reports false if the connection has been refused.
+func (s *session) checkBurst() bool {
+	b := s.srv.ConnectionBurstLimit
+	if b == nil || b.Count <= 0 || s.isTrusted() {
+		return true
+	}
+	if !s.srv.bursts.add(b, s.remoteIP(), time.Now()) {
+		return true
+	}
+	if b.Delay > 0 {
+		time.Sleep(b.Delay)
+		return true
+	}
+	log.Printf("refusing connection from %v: more than %d in %v", s.Addr(), b.Count, b.window())
+	s.sendError(errConnBurst)
+	return false
+}
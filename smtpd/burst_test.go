@@ -0,0 +1,68 @@
+package smtpd
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBurstTracker(t *testing.T) {
+	b := &BurstLimit{Count: 2, Window: time.Minute}
+	var tr burstTracker
+	now := time.Now()
+	for i, tt := range []struct {
+		ip    string
+		after time.Duration
+		over  bool
+	}{
+		{"192.0.2.1", 0, false},
+		{"192.0.2.1", time.Second, false},
+		{"192.0.2.1", 2 * time.Second, true},
+		{"192.0.2.2", 2 * time.Second, false}, // another IP
+		// The window slides, and refused connections count.
+		{"192.0.2.1", 60500 * time.Millisecond, true},
+		{"192.0.2.1", 2*time.Minute + 3*time.Second, false},
+	} {
+		if over := tr.add(b, tt.ip, now.Add(tt.after)); over != tt.over {
+			t.Errorf("connection %d from %s at +%v: over %v, want %v", i, tt.ip, tt.after, over, tt.over)
+		}
+	}
+}
+
+func TestConnectionBurstLimit(t *testing.T) {
+	// banner dials addr and returns the first reply line and how long
+	// it took.
+	banner := func(addr string) (string, time.Duration) {
+		start := time.Now()
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		l, err := bufio.NewReader(c).ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		return l, time.Since(start)
+	}
+	addr := testServer(t, &Server{ConnectionBurstLimit: &BurstLimit{Count: 3}})
+	for i := 0; i < 3; i++ {
+		if l, _ := banner(addr); l[:3] != "220" {
+			t.Fatalf("connection %d: %q", i+1, l)
+		}
+	}
+	if l, _ := banner(addr); l != "421 Too many connections, try again later\r\n" {
+		t.Errorf("connection over the limit: %q", l)
+	}
+
+	const delay = 200 * time.Millisecond
+	addr = testServer(t, &Server{ConnectionBurstLimit: &BurstLimit{Count: 1, Delay: delay}})
+	if _, d := banner(addr); d >= delay {
+		t.Errorf("first connection delayed %v", d)
+	}
+	if l, d := banner(addr); l[:3] != "220" || d < delay {
+		t.Errorf("connection over the limit: %q after %v, want 220 after %v", l, d, delay)
+	}
+}
@@ -0,0 +1,179 @@
+package smtpd
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// handleBdat handles a BDAT command (RFC 3030). The chunk is streamed
+// to the Envelope's Write as opaque octets: there's no dot-stuffing or
+// line handling, so BINARYMIME bodies pass through untouched, and
+// only a small buffer is held however large the message. The chunk is
+// consumed even on error, to keep the stream in sync, unless it's
+// larger than Server.MaxDrainBytes: then the connection is closed.
+func (s *session) handleBdat(arg string) {
+	f := strings.Fields(arg)
+	var size int64 = -1
+	if len(f) == 1 || len(f) == 2 && strings.EqualFold(f[1], "LAST") {
+		size, _ = strconv.ParseInt(f[0], 10, 64)
+	}
+	if size < 0 {
+		// We can't find the end of the chunk, so can't go on.
+		s.sendlinef("501 5.5.4 Syntax: BDAT size [LAST]")
+		s.hangUp()
+		return
+	}
+	last := len(f) == 2
+
+	if s.countConnBytes(size) {
+		if s.env != nil {
+			s.logTransaction(421)
+			s.dropEnv()
+		}
+		return
+	}
+	if s.env == nil {
+		if s.discard(size) {
+			s.sendlinef("503 5.5.1 Error: need MAIL command")
+		}
+		return
+	}
+	if max := s.srv.MaxMessageSize; max > 0 && s.msgSize+size > max {
+		// Checked before reading, so a client can't make us take in
+		// a huge chunk only to throw it away.
+		log.Printf("rejecting BDAT chunk of %d octets: message would exceed %d", size, max)
+		s.abortBdat(size, errMessageTooLarge)
+		return
+	}
+	if !s.bdat {
+		if s.rcpts == 0 {
+			if s.discard(size) {
+				s.sendError(errNoRecipients)
+			}
+			return
+		}
+		if s.srv.deferAll.Load() {
+			if s.discard(size) {
+				s.sendError(errDeferAll)
+			}
+			return
+		}
+		if !s.acquireData() {
+			if s.discard(size) {
+				s.sendError(errTooBusy)
+			}
+			return
+		}
+		if err := s.env.BeginData(); err != nil {
+			if s.discard(size) {
+				s.handleError(err)
+			}
+			return
+		}
+		s.bdat = true
+		s.beginMessageCopy()
+		if err := s.writeHeaders(s.envWrite); err != nil {
+			s.abortBdat(size, err)
+			return
+		}
+	}
+
+	cw := &chunkWriter{write: s.envWrite}
+	if _, err := io.CopyN(cw, dataReader{s}, size); err != nil {
+		s.dataReadError(err)
+		return
+	}
+	s.msgSize += size
+	s.msgLines += cw.lines
+	if cw.err != nil {
+		s.abortBdat(0, cw.err)
+		return
+	}
+	if !last {
+		s.sendlinef("250 2.0.0 Ok: %d octets received", size)
+		return
+	}
+	defer s.releaseData()
+	s.bdat = false
+	if err := s.checkMessageData(); err != nil {
+		s.rejectMessageData(err)
+		return
+	}
+	if err := s.closeEnv(); err != nil {
+		return
+	}
+	s.sendlinef("250 2.0.0 Ok: queued as %s", s.queueID)
+	s.logTransaction(250)
+	s.messages++
+	s.env = nil
+}
+
+// abortBdat fails the current BDAT transaction with err after
+// discarding the n octets remaining in the chunk. If there are too many
+// to discard, the client is told why before being disconnected.
+func (s *session) abortBdat(n int64, err error) {
+	s.dropEnv()
+	s.bdat = false
+	s.releaseData()
+	s.msgBuf = nil
+	if n > s.srv.maxDrainBytes() {
+		s.sendSMTPErrorOrLinef(err, "550 ??? failed")
+		s.discard(n) // closes the connection
+	} else if s.discard(n) {
+		s.sendSMTPErrorOrLinef(err, "550 ??? failed")
+	}
+	s.logTransaction(replyCode(err, 550))
+}
+
+// discard reads and drops n octets from the client. It reports
+// whether the session is still usable: if n is over MaxDrainBytes,
+// nothing is read and the connection is closed.
+func (s *session) discard(n int64) bool {
+	if n > s.srv.maxDrainBytes() {
+		log.Printf("BDAT chunk of %d octets too large to discard; closing", n)
+		s.quit = true
+		s.hangUp()
+		return false
+	}
+	if _, err := io.CopyN(io.Discard, dataReader{s}, n); err != nil {
+		s.dataReadError(err)
+		return false
+	}
+	return true
+}
+
+// dataReader reads message data from the client, applying
+// Server.DataTimeout to each read and copying it to the transcript.
+type dataReader struct {
+	s *session
+}
+
+func (dr dataReader) Read(p []byte) (int, error) {
+	dr.s.setReadTimeout(dr.s.srv.DataTimeout)
+	n, err := dr.s.br.Read(p)
+	dr.s.transcript("C: ", p[:n])
+	return n, err
+}
+
+// chunkWriter writes BDAT chunk data to the Envelope with write,
+// remembering the first error and dropping everything after it so the
+// rest of the chunk is still read. It counts the line endings.
+type chunkWriter struct {
+	write func([]byte) error
+	err   error
+	lines int
+}
+
+func (cw *chunkWriter) Write(p []byte) (int, error) {
+	cw.lines += bytes.Count(p, []byte("\n"))
+	if cw.err == nil {
+		if err := cw.write(p); err != nil {
+			log.Printf("BDAT write error: %v", err)
+			cw.err = err
+		}
+	}
+	return len(p), nil
+}
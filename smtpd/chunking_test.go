@@ -0,0 +1,106 @@
+package smtpd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"strings"
+	"testing"
+)
+
+func TestBinaryMIME(t *testing.T) {
+	onNewMail, last := collector()
+	addr := testServer(t, &Server{OnNewMail: onNewMail, Chunking: true, BinaryMIME: true})
+	c := dialTest(t, addr)
+	if r := c.expect("EHLO client.test", "250"); !strings.Contains(r, "BINARYMIME") {
+		t.Fatalf("BINARYMIME not advertised:\n%s", r)
+	}
+
+	c.expect("MAIL FROM:<a@example.com> BODY=BINARYMIME", "250")
+	c.expect("RCPT TO:<b@example.net>", "250")
+	c.expect("DATA", "503 5.5.1 Error: BODY=BINARYMIME requires BDAT")
+
+	// Binary parts: NULs, bare CR and LF, a lone dot line, a high byte.
+	parts := []string{"Subject: bin\r\n\r\n\x00\x01\r\n.\r\n", "\r\r\n\n\xff\x00"}
+	for i, p := range parts {
+		arg := fmt.Sprint(len(p))
+		if i == len(parts)-1 {
+			arg += " LAST"
+		}
+		c.send("BDAT " + arg + "\r\n" + p)
+		c.expect("", "250")
+	}
+	if got, want := last().Data.String(), strings.Join(parts, ""); got != want {
+		t.Errorf("message is %q, want %q", got, want)
+	}
+}
+
+func TestBinaryMIMENotEnabled(t *testing.T) {
+	addr := testServer(t, &Server{Chunking: true})
+	c := dialTest(t, addr)
+	if r := c.expect("EHLO client.test", "250"); strings.Contains(r, "BINARYMIME") {
+		t.Fatalf("BINARYMIME advertised:\n%s", r)
+	}
+	c.expect("MAIL FROM:<a@example.com> BODY=BINARYMIME", "555")
+}
+
+// hashEnvelope keeps only a digest of the message and the size of the
+// largest Write.
+type hashEnvelope struct {
+	BasicEnvelope
+	h        hash.Hash
+	maxWrite int
+	done     chan []byte
+}
+
+func (e *hashEnvelope) Write(p []byte) error {
+	e.h.Write(p)
+	if len(p) > e.maxWrite {
+		e.maxWrite = len(p)
+	}
+	return nil
+}
+
+func (e *hashEnvelope) Close() error {
+	e.done <- e.h.Sum(nil)
+	return nil
+}
+
+func TestBdatStreaming(t *testing.T) {
+	env := &hashEnvelope{h: sha256.New(), done: make(chan []byte, 1)}
+	addr := testServer(t, &Server{
+		Chunking:       true,
+		BinaryMIME:     true,
+		MaxMessageSize: 16 << 20,
+		OnNewMail:      func(c Connection, from MailAddress) (Envelope, error) { return env, nil },
+	})
+	c := dialTest(t, addr)
+	c.expect("EHLO client.test", "250")
+	c.expect("MAIL FROM:<a@b.test> BODY=BINARYMIME", "250")
+	c.expect("RCPT TO:<c@d.test>", "250")
+	chunk := make([]byte, 3<<20)
+	for i := range chunk {
+		chunk[i] = byte(i * 7)
+	}
+	want := sha256.New()
+	for i, arg := range []string{"", "", " LAST"} {
+		go c.send(fmt.Sprintf("BDAT %d%s\r\n%s", len(chunk), arg, chunk))
+		c.expect("", "250")
+		want.Write(chunk)
+		chunk[i]++ // vary the chunks
+	}
+	if got := <-env.done; !bytes.Equal(got, want.Sum(nil)) {
+		t.Error("message reassembled wrongly")
+	}
+	if env.maxWrite > 64<<10 {
+		t.Errorf("Envelope got a %d-byte Write; chunks should be streamed", env.maxWrite)
+	}
+
+	// A chunk that would go over MaxMessageSize is refused before it's
+	// read, and being too big to drain, ends the session.
+	c.expect("MAIL FROM:<a@b.test> BODY=BINARYMIME", "250")
+	c.expect("RCPT TO:<c@d.test>", "250")
+	c.expect("BDAT 1000000000 LAST", "552 5.3.4")
+	c.closed()
+}
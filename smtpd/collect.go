@@ -0,0 +1,52 @@
+package smtpd
+
+import "bytes"
+
+// CollectingEnvelope is an Envelope that keeps the sender, recipients
+// and message in memory. It's meant for tests and small servers that
+// handle each message once it's complete.
+type CollectingEnvelope struct {
+	From  MailAddress
+	Rcpts []MailAddress
+
+	// Data is the message as written to the Envelope, including
+	// server-generated header lines such as Received.
+	Data bytes.Buffer
+
+	// OnClose, if non-nil, is called with the envelope once the
+	// message is complete. A non-nil error rejects the message.
+	OnClose func(e *CollectingEnvelope) error
+}
+
+func (e *CollectingEnvelope) AddRecipient(rcpt MailAddress) error {
+	e.Rcpts = append(e.Rcpts, rcpt)
+	return nil
+}
+
+func (e *CollectingEnvelope) BeginData() error {
+	if len(e.Rcpts) == 0 {
+		return errNoRecipients
+	}
+	return nil
+}
+
+func (e *CollectingEnvelope) Write(line []byte) error {
+	e.Data.Write(line)
+	return nil
+}
+
+func (e *CollectingEnvelope) Close() error {
+	if e.OnClose != nil {
+		return e.OnClose(e)
+	}
+	return nil
+}
+
+// CollectMail returns a Server.OnNewMail function that collects each
+// message in a CollectingEnvelope and passes it to onClose once it's
+// complete.
+func CollectMail(onClose func(e *CollectingEnvelope) error) func(c Connection, from MailAddress) (Envelope, error) {
+	return func(c Connection, from MailAddress) (Envelope, error) {
+		return &CollectingEnvelope{From: from, OnClose: onClose}, nil
+	}
+}
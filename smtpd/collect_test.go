@@ -0,0 +1,38 @@
+package smtpd
+
+import "testing"
+
+func TestCollectMail(t *testing.T) {
+	got := make(chan *CollectingEnvelope, 2)
+	addr := testServer(t, &Server{
+		OnNewMail: CollectMail(func(e *CollectingEnvelope) error {
+			got <- e
+			if len(e.Rcpts) > 1 {
+				return SMTPError("554 5.7.1 One recipient only")
+			}
+			return nil
+		}),
+	})
+	c := dialTest(t, addr)
+	c.expect("EHLO client.test", "250")
+	c.expect("MAIL FROM:<a@b.test>", "250")
+	c.expect("RCPT TO:<c@d.test>", "250")
+	c.expect("DATA", "354")
+	c.expect("Subject: hi\r\n\r\n..dot\r\nbody\r\n.", "250")
+	e := <-got
+	if e.From.Email() != "a@b.test" || len(e.Rcpts) != 1 || e.Rcpts[0].Email() != "c@d.test" {
+		t.Errorf("envelope from %v to %v, want a@b.test to [c@d.test]", e.From, e.Rcpts)
+	}
+	if want := "Subject: hi\r\n\r\n.dot\r\nbody\r\n"; e.Data.String() != want {
+		t.Errorf("Data = %q, want %q", e.Data.String(), want)
+	}
+
+	c.expect("MAIL FROM:<a@b.test>", "250")
+	c.expect("RCPT TO:<c@d.test>", "250")
+	c.expect("RCPT TO:<e@f.test>", "250")
+	c.expect("DATA", "354")
+	c.expect("Subject: hi\r\n\r\nbody\r\n.", "554 5.7.1 One recipient only")
+	if e := <-got; len(e.Rcpts) != 2 {
+		t.Errorf("second envelope has %d recipients, want 2", len(e.Rcpts))
+	}
+}
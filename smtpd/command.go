@@ -0,0 +1,178 @@
+package smtpd
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+var (
+	errBadAddrSyntax  = SMTPError("501 5.1.7 Bad sender address syntax")
+	errDuplicateParam = SMTPError("501 5.5.4 Duplicate parameter")
+)
+
+// ParsedCommand is an SMTP command line broken into its parts.
+type ParsedCommand struct {
+	Verb string // uppercased, e.g. "MAIL"
+	Arg  string // everything after the verb, e.g. "FROM:<a@b.com> SIZE=10"
+	Raw  string // the line as received, including the CRLF
+
+	// For MAIL and RCPT, Addr is the address between the angle
+	// brackets and Params holds the ESMTP parameters that follow it,
+	// keyed by uppercased name. Parameters without a value map to "".
+	Addr   string
+	Params map[string]string
+}
+
+// RawRecipient is implemented by the MailAddress passed to
+// Envelope.AddRecipient. Raw returns the RCPT TO command line the
+// recipient came from, exactly as sent but without its CRLF.
+type RawRecipient interface {
+	MailAddress
+	Raw() string
+}
+
+// ParseCommand parses an SMTP command line, which must end in CRLF.
+// A malformed MAIL or RCPT argument is reported as an SMTPError that
+// can be sent to the client as is.
+func ParseCommand(line string) (*ParsedCommand, error) {
+	cl := cmdLine(line)
+	if err := cl.checkValid(); err != nil {
+		return nil, err
+	}
+	pc := &ParsedCommand{Verb: cl.Verb(), Arg: cl.Arg(), Raw: line}
+	var ok bool
+	var rest string
+	switch pc.Verb {
+	case "MAIL":
+		pc.Addr, rest, ok = cutPath(pc.Arg, "FROM:")
+	case "RCPT":
+		pc.Addr, rest, ok = cutPath(pc.Arg, "TO:")
+		ok = ok && pc.Addr != ""
+	default:
+		return pc, nil
+	}
+	if !ok {
+		return nil, errBadAddrSyntax
+	}
+	params, err := parseParams(rest)
+	if err != nil {
+		return nil, err
+	}
+	pc.Params = params
+	return pc, nil
+}
+
+// cutPath parses a MAIL or RCPT argument: keyword, such as "FROM:",
+// in any case, then optional spaces and an address in angle brackets.
+// A ">" or "<" inside a quoted local part, where a backslash escapes
+// the next character, doesn't count. It returns the address and what
+// follows the closing ">", which holds any ESMTP parameters.
+func cutPath(arg, keyword string) (addr, rest string, ok bool) {
+	if len(arg) < len(keyword) || !strings.EqualFold(arg[:len(keyword)], keyword) {
+		return "", "", false
+	}
+	s := strings.TrimLeft(arg[len(keyword):], " ")
+	if s == "" || s[0] != '<' {
+		return "", "", false
+	}
+	quoted := false
+	for i := 1; i < len(s); i++ {
+		switch c := s[i]; {
+		case quoted && c == '\\':
+			i++
+		case c == '"':
+			quoted = !quoted
+		case quoted:
+		case c == '<':
+			return "", "", false
+		case c == '>':
+			return s[1:i], s[i+1:], true
+		}
+	}
+	return "", "", false
+}
+
+// validPath reports whether addr, a MAIL FROM or RCPT TO address less
+// any source route, is a mailbox (RFC 5321 s4.1.2): a local part,
+// either a dot-string of atext or a quoted string of qtextSMTP and
+// quoted pairs, then "@" and a domain of letter-digit-hyphen labels
+// or an address literal, as checked by validHelloHost. Non-ASCII
+// bytes are allowed, as for SMTPUTF8 (RFC 6531 s3.3); checkAddrText
+// decides whether they may be used. If bare is set, as for RCPT TO,
+// the local part alone is also accepted, such as "Postmaster"
+// (s4.5.1) or a local user's name.
+func validPath(addr string, bare bool) bool {
+	var at int
+	if strings.HasPrefix(addr, `"`) {
+		at = 1
+		for ; at < len(addr) && addr[at] != '"'; at++ {
+			c := addr[at]
+			if c == '\\' {
+				at++
+				if at == len(addr) {
+					return false
+				}
+				c = addr[at]
+			}
+			if c < ' ' || c == 0x7f {
+				return false
+			}
+		}
+		at++ // past the closing quote
+	} else {
+		at = strings.IndexByte(addr, '@')
+		if at < 0 {
+			at = len(addr)
+		}
+		if !validDotString(addr[:at]) {
+			return false
+		}
+	}
+	switch {
+	case at > len(addr): // unterminated quoted string
+		return false
+	case at == len(addr):
+		return bare
+	case addr[at] != '@':
+		return false
+	}
+	return validHelloHost(addr[at+1:])
+}
+
+// validDotString reports whether s is an unquoted local part: atoms
+// of atext (RFC 5322 s3.2.3) joined by single dots.
+func validDotString(s string) bool {
+	for _, atom := range strings.Split(s, ".") {
+		if atom == "" {
+			return false
+		}
+		for i := 0; i < len(atom); i++ {
+			c := atom[i]
+			if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+				strings.IndexByte("!#$%&'*+-/=?^_`{|}~", c) != -1 || c >= utf8.RuneSelf) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// parseParams parses the ESMTP parameters following the address in a
+// MAIL FROM or RCPT TO argument, such as " SIZE=1024 BODY=8BITMIME".
+// Keys are uppercased; keys without a value map to "". A key given
+// more than once is an error, as it's ambiguous which value wins.
+func parseParams(s string) (map[string]string, error) {
+	params := make(map[string]string)
+	for _, f := range strings.Fields(s) {
+		k, v := f, ""
+		if idx := strings.Index(f, "="); idx != -1 {
+			k, v = f[:idx], f[idx+1:]
+		}
+		k = strings.ToUpper(k)
+		if _, dup := params[k]; dup {
+			return nil, errDuplicateParam
+		}
+		params[k] = v
+	}
+	return params, nil
+}
@@ -0,0 +1,347 @@
+package smtpd
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestStripSourceRoute(t *testing.T) {
+	for in, want := range map[string]string{
+		"@a,@b:user@c": "user@c",
+		"@a:user@c":    "user@c",
+		"user@c":       "user@c",
+		"":             "",
+		"@nocolon":     "@nocolon",
+	} {
+		if got := stripSourceRoute(in); got != want {
+			t.Errorf("stripSourceRoute(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestMailFromSourceRoute(t *testing.T) {
+	var from, raw string
+	addr := testServer(t, &Server{
+		OnNewMail: func(c Connection, f MailAddress) (Envelope, error) {
+			from, raw = f.Email(), c.LastMailFromRaw()
+			return new(BasicEnvelope), nil
+		},
+	})
+	c := dialTest(t, addr)
+	c.expect("EHLO client.test", "250")
+	c.expect("MAIL FROM:<@a,@b:user@c.test>", "250")
+	if from != "user@c.test" {
+		t.Errorf("sender = %q, want user@c.test", from)
+	}
+	if raw != "MAIL FROM:<@a,@b:user@c.test>" {
+		t.Errorf("LastMailFromRaw = %q", raw)
+	}
+}
+
+func TestRcptSourceRoute(t *testing.T) {
+	onNewMail, last := collector()
+	var raw string
+	addr := testServer(t, &Server{
+		OnNewMail: onNewMail,
+		OnRcpt: func(c Connection, from, rcpt MailAddress) error {
+			raw = c.LastRcptToRaw()
+			return nil
+		},
+	})
+	c := dialTest(t, addr)
+	c.expect("EHLO client.test", "250")
+	c.expect("MAIL FROM:<a@b.test>", "250")
+	c.expect("RCPT TO:<@hop1.test,@hop2.test:user@d.test> NOTIFY=NEVER", "250")
+	c.expect("DATA", "354")
+	c.expect("body\r\n.", "250")
+	rcpts := last().Rcpts
+	if len(rcpts) != 1 || rcpts[0].Email() != "user@d.test" {
+		t.Fatalf("recipients %v, want user@d.test", rcpts)
+	}
+	const line = "RCPT TO:<@hop1.test,@hop2.test:user@d.test> NOTIFY=NEVER"
+	if r, ok := rcpts[0].(RawRecipient); !ok || r.Raw() != line {
+		t.Errorf("recipient's raw form lost: %#v", rcpts[0])
+	}
+	if raw != line {
+		t.Errorf("LastRcptToRaw = %q", raw)
+	}
+}
+
+func TestDuplicateParams(t *testing.T) {
+	addr := testServer(t, &Server{})
+	c := dialTest(t, addr)
+	c.expect("EHLO client.test", "250")
+	c.expect("MAIL FROM:<a@b.test> SIZE=1 SIZE=2", "501 5.5.4 Duplicate parameter")
+	c.expect("MAIL FROM:<a@b.test> SIZE=1 size=2", "501 5.5.4 Duplicate parameter")
+	c.expect("MAIL FROM:<a@b.test> SIZE=1", "250")
+	c.expect("RCPT TO:<c@d.test> NOTIFY=NEVER NOTIFY=NEVER", "501 5.5.4 Duplicate parameter")
+	c.expect("RCPT TO:<c@d.test>", "250")
+}
+
+func TestParseCommand(t *testing.T) {
+	for _, tt := range []struct {
+		line   string
+		verb   string
+		arg    string
+		addr   string
+		params map[string]string
+		err    error
+	}{
+		{line: "NOOP\r\n", verb: "NOOP"},
+		{line: "ehlo client.test\r\n", verb: "EHLO", arg: "client.test"},
+		{line: "HELO client.test  \r\n", verb: "HELO", arg: "client.test"},
+		{line: "MAIL FROM:<a@b.test>\r\n", verb: "MAIL", arg: "FROM:<a@b.test>",
+			addr: "a@b.test", params: map[string]string{}},
+		{line: "mail from: <a@b.test> size=10 Body=8BITMIME SMTPUTF8\r\n", verb: "MAIL",
+			arg: "from: <a@b.test> size=10 Body=8BITMIME SMTPUTF8", addr: "a@b.test",
+			params: map[string]string{"SIZE": "10", "BODY": "8BITMIME", "SMTPUTF8": ""}},
+		{line: "MAIL FROM:<>\r\n", verb: "MAIL", arg: "FROM:<>", params: map[string]string{}},
+		{line: "MAIL FROM:<\"a>b\"@c.test>\r\n", verb: "MAIL", arg: "FROM:<\"a>b\"@c.test>",
+			addr: "\"a>b\"@c.test", params: map[string]string{}},
+		{line: "RCPT TO:<Postmaster>  NOTIFY=NEVER\r\n", verb: "RCPT", arg: "TO:<Postmaster>  NOTIFY=NEVER",
+			addr: "Postmaster", params: map[string]string{"NOTIFY": "NEVER"}},
+		{line: "MAIL FROM:a@b.test\r\n", err: errBadAddrSyntax},
+		{line: "MAIL TO:<a@b.test>\r\n", err: errBadAddrSyntax},
+		{line: "MAIL FROM:<a@b.test\r\n", err: errBadAddrSyntax},
+		{line: "MAIL FROM:<a<b@c.test>\r\n", err: errBadAddrSyntax},
+		{line: "RCPT TO:<>\r\n", err: errBadAddrSyntax},
+		{line: "MAIL FROM:<a@b.test> SIZE=1 size=2\r\n", err: errDuplicateParam},
+	} {
+		pc, err := ParseCommand(tt.line)
+		if err != tt.err {
+			t.Errorf("ParseCommand(%q): error %v, want %v", tt.line, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		want := &ParsedCommand{tt.verb, tt.arg, tt.line, tt.addr, tt.params}
+		if !reflect.DeepEqual(pc, want) {
+			t.Errorf("ParseCommand(%q) = %+v, want %+v", tt.line, pc, want)
+		}
+	}
+	for _, line := range []string{"NOOP", "QUIT now\r\n", "DATA x\r\n"} {
+		if _, err := ParseCommand(line); err == nil {
+			t.Errorf("ParseCommand(%q) succeeded, want an error", line)
+		}
+	}
+}
+
+func TestCutPath(t *testing.T) {
+	for _, tt := range []struct {
+		arg, addr, rest string
+		ok              bool
+	}{
+		{"FROM:<a@b.test>", "a@b.test", "", true},
+		{"from:<a@b.test>", "a@b.test", "", true},
+		{"FROM:   <a@b.test>", "a@b.test", "", true},
+		{"FROM:<a@b.test>SIZE=10", "a@b.test", "SIZE=10", true},
+		{"FROM:<a@b.test> SIZE=10 BODY=7BIT", "a@b.test", " SIZE=10 BODY=7BIT", true},
+		{"FROM:<>", "", "", true},
+		{"FROM:<@relay.test:a@b.test>", "@relay.test:a@b.test", "", true},
+		{`FROM:<"a>b"@c.test>`, `"a>b"@c.test`, "", true},
+		{`FROM:<"a<b"@c.test>`, `"a<b"@c.test`, "", true},
+		{`FROM:<"a\"> b"@c.test> X=1`, `"a\"> b"@c.test`, " X=1", true},
+		{`FROM:<"a\\">b@c.test>`, `"a\\"`, "b@c.test>", true},
+		{"FROM:<a@b.test>>", "a@b.test", ">", true},
+		{"FROM <a@b.test>", "", "", false},
+		{"FROM:a@b.test", "", "", false},
+		{"FROM:", "", "", false},
+		{"FRO", "", "", false},
+		{"FROM:<a@b.test", "", "", false},
+		{"FROM:<<a@b.test>>", "", "", false},
+		{`FROM:<"a>b@c.test>`, "", "", false},
+		{"TO:<a@b.test>", "", "", false},
+	} {
+		addr, rest, ok := cutPath(tt.arg, "FROM:")
+		if addr != tt.addr || rest != tt.rest || ok != tt.ok {
+			t.Errorf("cutPath(%q) = %q, %q, %v; want %q, %q, %v", tt.arg, addr, rest, ok, tt.addr, tt.rest, tt.ok)
+		}
+	}
+}
+
+func TestValidPath(t *testing.T) {
+	for _, tt := range []struct {
+		addr       string
+		bare, want bool
+	}{
+		{"a@b.test", false, true},
+		{`"john smith"@b.test`, false, true},
+		{`"a\"b"@b.test`, false, true},
+		{"Postmaster", true, true},
+		{"Postmaster", false, false},
+		{`"quoted user"`, true, true},
+		{"@b.test", false, false},
+		{"a@", false, false},
+		{"a@b@c.test", false, false},
+		{"a b@c.test", false, false},
+		{"a@b c.test", false, false},
+		{`a"b@c.test`, false, false},
+		{`"unterminated@b.test`, false, false},
+		{`"a"b@c.test`, false, false},
+		{"a.b+tag@b.test", false, true},
+		{"a..b@b.test", false, false},
+		{".a@b.test", false, false},
+		{"a(b)@b.test", false, false},
+		{"a@[192.0.2.1]", false, true},
+		{"a@[IPv6:2001:db8::1]", false, true},
+		{"a@[bogus]", false, false},
+		{"a@-b.test", false, false},
+		{"a@b_c.test", false, false},
+		{"a@b..test", false, false},
+		{"jörg@bücher.test", false, true},
+		{`"a\"`, true, false},
+	} {
+		if got := validPath(tt.addr, tt.bare); got != tt.want {
+			t.Errorf("validPath(%q, %v) = %v, want %v", tt.addr, tt.bare, got, tt.want)
+		}
+	}
+	// Control characters and DEL are allowed nowhere: not in a
+	// dot-string, a quoted string, a quoted pair or the domain.
+	for _, c := range []string{"\r", "\n", "\x00", "\x01", "\t", "\x7f"} {
+		for _, addr := range []string{
+			"a" + c + "x@b.test",
+			`"a` + c + `x"@b.test`,
+			`"a\` + c + `x"@b.test`,
+			"a@b" + c + "x.test",
+			"a" + c + "x",
+		} {
+			if validPath(addr, true) {
+				t.Errorf("validPath(%q, true) = true, want false", addr)
+			}
+		}
+	}
+}
+
+func TestMalformedAddresses(t *testing.T) {
+	c := dialTest(t, testServer(t, &Server{}))
+	c.expect("EHLO client.test", "250")
+	for _, addr := range []string{
+		"a b@c.test",
+		"a@b@c.test",
+		"a@",
+		"@c.test",
+		"a@c .test",
+		`a"b@c.test`,
+		`"unterminated@c.test`,
+		"nodomain",
+	} {
+		if got := c.cmd("MAIL FROM:<" + addr + ">"); got != "501 5.1.7 Bad sender address syntax" {
+			t.Errorf("MAIL FROM:<%s>: got %q", addr, got)
+		}
+	}
+	c.expect(`MAIL FROM:<"a b"@c.test>`, "250")
+	c.expect("RCPT TO:<x@y@z.test>", "501 5.1.7")
+	c.expect("RCPT TO:<a b@z.test>", "501 5.1.7")
+	c.expect("RCPT TO:<postmaster>", "250")
+	c.expect("RCPT TO:<c\x01@d.test>", "501 5.1.7")
+	c.expect("RSET", "250")
+	c.expect("MAIL FROM:<a\r\x00x@b.test>", "501 5.1.7")
+}
+
+func TestAddressAndParamCase(t *testing.T) {
+	onNewMail, last := collector()
+	addr := testServer(t, &Server{OnNewMail: onNewMail})
+	c := dialTest(t, addr)
+	c.expect("EHLO client.test", "250")
+	c.expect("mail from:<John.Doe@Example.COM> size=10 Body=8BITMIME", "250")
+	c.expect("rcpt to:<Jane.Roe@Example.NET> orcpt=rfc822;Jane.Roe@Example.NET Notify=success,Failure", "250")
+	c.expect("DATA", "354")
+	c.expect("Subject: hi\r\n\r\nbody\r\n.", "250")
+	e := last()
+	if got := e.From.Email(); got != "John.Doe@Example.COM" {
+		t.Errorf("From = %q, want case preserved", got)
+	}
+	rcpt := e.Rcpts[0].(DSNRecipient)
+	if got := rcpt.Email(); got != "Jane.Roe@Example.NET" {
+		t.Errorf("recipient = %q, want case preserved", got)
+	}
+	if got := rcpt.ORCPT(); got != "rfc822;Jane.Roe@Example.NET" {
+		t.Errorf("ORCPT = %q, want case preserved", got)
+	}
+	if got := rcpt.Notify(); !reflect.DeepEqual(got, []string{"SUCCESS", "FAILURE"}) {
+		t.Errorf("Notify = %q, want [SUCCESS FAILURE]", got)
+	}
+}
+
+func TestMaxNullSenderRecipients(t *testing.T) {
+	addr := testServer(t, &Server{MaxNullSenderRecipients: 1})
+	c := dialTest(t, addr)
+	c.expect("EHLO client.test", "250")
+	c.expect("MAIL FROM:<>", "250")
+	c.expect("RCPT TO:<a@b.test>", "250")
+	c.expect("RCPT TO:<c@d.test>", "550 5.5.3 Too many recipients for bounce")
+	c.expect("DATA", "354")
+	c.expect("Subject: bounce\r\n\r\nbody\r\n.", "250")
+	// The limit is only for the null sender.
+	c.expect("MAIL FROM:<x@y.test>", "250")
+	c.expect("RCPT TO:<a@b.test>", "250")
+	c.expect("RCPT TO:<c@d.test>", "250")
+}
+
+func TestParseAddress(t *testing.T) {
+	onNewMail, last := collector()
+	var called []string
+	addr := testServer(t, &Server{
+		OnNewMail: onNewMail,
+		ParseAddress: func(raw string) (MailAddress, error) {
+			called = append(called, raw)
+			switch {
+			case strings.Contains(raw, "+"):
+				return nil, SMTPError("553 5.1.3 Plus addressing not accepted")
+			case !strings.Contains(raw, "@"):
+				return nil, errors.New("no domain")
+			}
+			return addrString(strings.ToLower(raw)), nil
+		},
+	})
+	c := dialTest(t, addr)
+	c.expect("EHLO client.test", "250")
+	c.expect("MAIL FROM:<a+tag@b.test>", "553 5.1.3 Plus addressing not accepted")
+	c.expect("MAIL FROM:<>", "250") // not parsed
+	c.expect("RSET", "250")
+	c.expect("MAIL FROM:<@relay.test:A@B.test>", "250")
+	c.expect("RCPT TO:<Postmaster>", "501")
+	c.expect("RCPT TO:<c+x@d.test>", "553 5.1.3")
+	c.expect("RCPT TO:<C@D.test>", "250")
+	c.expect("DATA", "354")
+	c.expect("Subject: hi\r\n\r\nbody\r\n.", "250")
+	e := last()
+	if e.From.Email() != "a@b.test" || len(e.Rcpts) != 1 || e.Rcpts[0].Email() != "c@d.test" {
+		t.Errorf("envelope from %v to %v, want the parser's addresses", e.From, e.Rcpts)
+	}
+	want := []string{"a+tag@b.test", "A@B.test", "Postmaster", "c+x@d.test", "C@D.test"}
+	if !reflect.DeepEqual(called, want) {
+		t.Errorf("ParseAddress called with %q, want %q", called, want)
+	}
+}
+
+func TestRawCommandLines(t *testing.T) {
+	onNewMail, last := collector()
+	var conn Connection
+	addr := testServer(t, &Server{
+		OnNewMail: func(c Connection, from MailAddress) (Envelope, error) {
+			conn = c
+			return onNewMail(c, from)
+		},
+	})
+	c := dialTest(t, addr)
+	c.expect("EHLO client.test", "250")
+	c.expect("mail FROM: <A@b.test>  SIZE=10", "250")
+	c.expect("RCPT TO:<c@d.test>   NOTIFY=NEVER", "250")
+	c.expect("rcpt to:<bad address>", "501")
+	if got := conn.LastMailFromRaw(); got != "mail FROM: <A@b.test>  SIZE=10" {
+		t.Errorf("LastMailFromRaw = %q", got)
+	}
+	// Kept even though the command was rejected.
+	if got := conn.LastRcptToRaw(); got != "rcpt to:<bad address>" {
+		t.Errorf("LastRcptToRaw = %q", got)
+	}
+	c.expect("DATA", "354")
+	c.expect("Subject: hi\r\n\r\nbody\r\n.", "250")
+	if got := last().Rcpts[0].(RawRecipient).Raw(); got != "RCPT TO:<c@d.test>   NOTIFY=NEVER" {
+		t.Errorf("recipient Raw = %q", got)
+	}
+}
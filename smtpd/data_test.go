@@ -0,0 +1,431 @@
+package smtpd
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// bodyOf returns a message body of about n bytes, in 1000-byte lines.
+func bodyOf(n int) string {
+	line := strings.Repeat("x", 998) + "\r\n"
+	return "Subject: big\r\n\r\n" + strings.Repeat(line, n/len(line))
+}
+
+func TestDataSizeCapUndeclared(t *testing.T) {
+	addr := testServer(t, &Server{MaxMessageSize: 1 << 20})
+	c := dialTest(t, addr)
+	c.expect("HELO client.test", "250") // no SIZE
+	c.expect("MAIL FROM:<a@example.com>", "250")
+	c.expect("RCPT TO:<b@example.net>", "250")
+	c.expect("DATA", "354")
+	go func() {
+		// The server stops reading once the drain limit is hit, so
+		// this write fails part way.
+		c.c.Write([]byte(bodyOf(50<<20) + ".\r\n"))
+	}()
+	c.expect("", "552 Error: message exceeds fixed maximum message size")
+	c.closed()
+}
+
+func TestDataSizeCapDrained(t *testing.T) {
+	addr := testServer(t, &Server{MaxMessageSize: 1 << 20, MaxDrainBytes: 4 << 20})
+	c := dialTest(t, addr)
+	c.expect("EHLO client.test", "250")
+	c.expect("MAIL FROM:<a@example.com>", "250")
+	c.expect("RCPT TO:<b@example.net>", "250")
+	c.expect("DATA", "354")
+	go c.c.Write([]byte(bodyOf(2<<20) + ".\r\n"))
+	c.expect("", "552 5.3.4 ")
+	// The body was drained to the dot, so the session goes on.
+	c.expect("MAIL FROM:<a@example.com>", "250")
+	c.expect("RCPT TO:<b@example.net>", "250")
+	c.expect("DATA", "354")
+	c.expect(bodyOf(1<<19)+".", "250")
+}
+
+func TestDeferAll(t *testing.T) {
+	srv := &Server{}
+	addr := testServer(t, srv)
+	c := dialTest(t, addr)
+	c.expect("EHLO client.test", "250")
+	c.expect("MAIL FROM:<a@example.com>", "250")
+	c.expect("RCPT TO:<b@example.net>", "250")
+	srv.SetDeferAll(true)
+	c.expect("DATA", "451 4.3.2 System not accepting messages")
+	c.expect("RSET", "250")
+	c.expect("MAIL FROM:<a@example.com>", "250")
+	c.expect("RCPT TO:<b@example.net>", "250")
+	c.expect("DATA", "451 4.3.2 System not accepting messages")
+	srv.SetDeferAll(false)
+	c.expect("RSET", "250")
+	if r := c.sendMail("a@example.com", "b@example.net", "Subject: hi\r\n\r\nbody"); !strings.HasPrefix(r, "250") {
+		t.Fatal(r)
+	}
+}
+
+func TestPipelinedDataAfterFailedRcpts(t *testing.T) {
+	addr := testServer(t, &Server{LocalDomains: []string{"example.com"}})
+	c := dialTest(t, addr)
+	c.expect("EHLO client.test", "250")
+	c.send("MAIL FROM:<a@example.org>\r\n" +
+		"RCPT TO:<b@elsewhere.test>\r\n" +
+		"DATA\r\n" +
+		"Subject: not data\r\n" +
+		"\r\n" +
+		".\r\n" +
+		"NOOP\r\n")
+	for i, want := range []string{
+		"250",                                  // MAIL
+		"550 5.7.1 Relay access denied",        // RCPT
+		"554 5.5.1 Error: no valid recipients", // DATA
+		"502 ",                                 // "Subject: not data"
+		"502 ",                                 // empty line
+		"502 ",                                 // "."
+		"250 2.0.0 OK",                         // NOOP: still in sync
+	} {
+		if r := c.reply(); !strings.HasPrefix(r, want) {
+			t.Fatalf("reply %d = %q, want %q...", i, r, want)
+		}
+	}
+}
+
+func TestMaxBodyLines(t *testing.T) {
+	addr := testServer(t, &Server{MaxBodyLines: 10})
+	c := dialTest(t, addr)
+	c.expect("EHLO client.test", "250")
+	if r := c.sendMail("a@example.com", "b@example.net", "Subject: ok\r\n\r\n"+strings.Repeat("x\r\n", 7)+"x"); !strings.HasPrefix(r, "250") {
+		t.Fatalf("10 lines: %q", r)
+	}
+	if r := c.sendMail("a@example.com", "b@example.net", "Subject: many\r\n\r\n"+strings.Repeat("x\r\n", 1000)+"x"); r != "552 5.3.4 Too many lines" {
+		t.Fatalf("1003 lines: %q", r)
+	}
+	// Drained to the dot: the session is still in sync.
+	c.expect("NOOP", "250")
+}
+
+func TestNormalizeLineEndings(t *testing.T) {
+	// Dot-stuffed lines, including a stuffed lone dot, mustn't end
+	// the message early, whether or not line endings are normalized.
+	msg := "Subject: hi\r\n\r\nline one\r\n..\r\nnot the end\r\n.x\r\nlast"
+	for _, normalize := range []bool{false, true} {
+		onNewMail, last := collector()
+		addr := testServer(t, &Server{OnNewMail: onNewMail, NormalizeLineEndings: normalize})
+		c := dialTest(t, addr)
+		c.expect("EHLO client.test", "250")
+		if r := c.sendMail("a@example.com", "b@example.net", msg); !strings.HasPrefix(r, "250") {
+			t.Fatal(r)
+		}
+		want := "Subject: hi\r\n\r\nline one\r\n.\r\nnot the end\r\nx\r\nlast\r\n"
+		if normalize {
+			want = strings.ReplaceAll(want, "\r\n", "\n")
+		}
+		if got := last().Data.String(); got != want {
+			t.Errorf("NormalizeLineEndings=%v: got %q, want %q", normalize, got, want)
+		}
+	}
+}
+
+func TestRejectEarlyData(t *testing.T) {
+	addr := testServer(t, &Server{RejectEarlyData: true})
+	c := dialTest(t, addr)
+	c.expect("EHLO client.test", "250")
+	if r := c.sendMail("a@b.test", "c@d.test", "Subject: hi\r\n\r\nbody"); !strings.HasPrefix(r, "250") {
+		t.Fatal(r)
+	}
+	c.expect("MAIL FROM:<a@b.test>", "250")
+	c.expect("RCPT TO:<c@d.test>", "250")
+	c.expect("DATA\r\nSubject: hi\r\n\r\nbody\r\n.", "554 5.5.0 Error: message data sent before 354 reply")
+	c.closed()
+}
+
+func TestMaxBytesPerConnection(t *testing.T) {
+	addr := testServer(t, &Server{MaxBytesPerConnection: 50})
+	c := dialTest(t, addr)
+	c.expect("EHLO client.test", "250")
+	for i := 0; i < 2; i++ {
+		if r := c.sendMail("a@b.test", "c@d.test", "Subject: hi\r\n\r\nbody"); !strings.HasPrefix(r, "250") {
+			t.Fatalf("message %d: %q", i+1, r)
+		}
+	}
+	if r := c.sendMail("a@b.test", "c@d.test", "Subject: hi\r\n\r\nbody"); r != "421 4.7.0 Connection byte limit exceeded" {
+		t.Fatalf("message 3: %q, want the connection byte limit", r)
+	}
+	c.closed()
+
+	// The cap is per connection.
+	c = dialTest(t, addr)
+	c.expect("EHLO client.test", "250")
+	if r := c.sendMail("a@b.test", "c@d.test", "Subject: hi\r\n\r\nbody"); !strings.HasPrefix(r, "250") {
+		t.Fatal(r)
+	}
+}
+
+func TestOnMessageData(t *testing.T) {
+	onNewMail, last := collector()
+	addr := testServer(t, &Server{
+		OnNewMail: onNewMail,
+		OnMessageData: func(c Connection, env Envelope, data io.Reader) error {
+			b, err := io.ReadAll(data)
+			if err != nil {
+				return err
+			}
+			if bytes.Contains(b, []byte("forbidden")) {
+				return SMTPError("550 5.7.1 Message rejected by content policy")
+			}
+			return nil
+		},
+	})
+	c := dialTest(t, addr)
+	c.expect("EHLO client.test", "250")
+	if r := c.sendMail("a@b.test", "c@d.test", "Subject: ok\r\n\r\nfine"); !strings.HasPrefix(r, "250") {
+		t.Fatal(r)
+	}
+	if r := c.sendMail("a@b.test", "c@d.test", "Subject: bad\r\n\r\nsomething forbidden"); r != "550 5.7.1 Message rejected by content policy" {
+		t.Fatalf("got %q, want the content policy rejection", r)
+	}
+	if got := last().Data.String(); got != "Subject: ok\r\n\r\nfine\r\n" {
+		t.Errorf("delivered %q; the rejected message must not be closed", got)
+	}
+	c.expect("MAIL FROM:<a@b.test>", "250")
+}
+
+func TestTransformMessage(t *testing.T) {
+	onNewMail, last := collector()
+	addr := testServer(t, &Server{
+		OnNewMail: onNewMail,
+		TransformMessage: func(c Connection, in io.Reader) (io.Reader, error) {
+			b, err := io.ReadAll(in)
+			if err != nil {
+				return nil, err
+			}
+			if bytes.Contains(b, []byte("forbidden")) {
+				return nil, SMTPError("554 5.7.1 Message refused")
+			}
+			return io.MultiReader(strings.NewReader("X-Scanned: yes\r\n"), bytes.NewReader(b)), nil
+		},
+	})
+	c := dialTest(t, addr)
+	c.expect("EHLO client.test", "250")
+	if r := c.sendMail("a@b.test", "c@d.test", "Subject: hi\r\n\r\nbody"); !strings.HasPrefix(r, "250") {
+		t.Fatal(r)
+	}
+	if got, want := last().Data.String(), "X-Scanned: yes\r\nSubject: hi\r\n\r\nbody\r\n"; got != want {
+		t.Errorf("delivered %q, want %q", got, want)
+	}
+	if r := c.sendMail("a@b.test", "c@d.test", "Subject: bad\r\n\r\nforbidden"); r != "554 5.7.1 Message refused" {
+		t.Errorf("got %q, want the transform's rejection", r)
+	}
+}
+
+// sizeEnvelope records Connection.MessageSize when it's closed.
+type sizeEnvelope struct {
+	BasicEnvelope
+	c     Connection
+	sizes chan [2]int64
+}
+
+func (e *sizeEnvelope) Write(line []byte) error { return nil }
+
+func (e *sizeEnvelope) Close() error {
+	size, lines := e.c.MessageSize()
+	e.sizes <- [2]int64{size, int64(lines)}
+	return nil
+}
+
+func TestMessageSize(t *testing.T) {
+	sizes := make(chan [2]int64, 2)
+	addr := testServer(t, &Server{
+		Chunking:    true,
+		AddReceived: true,
+		OnNewMail: func(c Connection, from MailAddress) (Envelope, error) {
+			return &sizeEnvelope{c: c, sizes: sizes}, nil
+		},
+	})
+	c := dialTest(t, addr)
+	c.expect("EHLO client.test", "250")
+	// The stuffed dot and the Received field don't count.
+	want := [2]int64{int64(len("Subject: hi\r\n\r\n.dot\r\nend\r\n")), 4}
+	c.expect("MAIL FROM:<a@b.test> SIZE=1000", "250")
+	c.expect("RCPT TO:<c@d.test>", "250")
+	c.expect("DATA", "354")
+	c.expect("Subject: hi\r\n\r\n..dot\r\nend\r\n.", "250")
+	if got := <-sizes; got != want {
+		t.Errorf("DATA: size, lines = %v, want %v", got, want)
+	}
+
+	chunk := "Subject: hi\r\n\r\n.dot\r\n"
+	c.expect("MAIL FROM:<a@b.test>", "250")
+	c.expect("RCPT TO:<c@d.test>", "250")
+	c.expect("BDAT "+strconv.Itoa(len(chunk))+" LAST\r\n"+strings.TrimSuffix(chunk, "\r\n"), "250")
+	if got := <-sizes; got != [2]int64{int64(len(chunk)), 3} {
+		t.Errorf("BDAT: size, lines = %v, want %d bytes in 3 lines", got, len(chunk))
+	}
+}
+
+func TestMaxMessagesPerConnection(t *testing.T) {
+	addr := testServer(t, &Server{MaxMessagesPerConnection: 3})
+	c := dialTest(t, addr)
+	c.expect("EHLO client.test", "250")
+	for i := 0; i < 3; i++ {
+		// An abandoned transaction isn't a message.
+		c.expect("MAIL FROM:<a@b.test>", "250")
+		c.expect("RSET", "250")
+		if r := c.sendMail("a@b.test", "c@d.test", "Subject: hi\r\n\r\nbody"); !strings.HasPrefix(r, "250") {
+			t.Fatalf("message %d: %q", i+1, r)
+		}
+	}
+	c.expect("MAIL FROM:<a@b.test>", "421 4.7.0 Too many messages, reconnect")
+	c.closed()
+
+	// A new connection starts over.
+	c = dialTest(t, addr)
+	c.expect("EHLO client.test", "250")
+	c.expect("MAIL FROM:<a@b.test>", "250")
+}
+
+func TestAllowBareLF(t *testing.T) {
+	for _, allow := range []bool{false, true} {
+		onNewMail, last := collector()
+		c := dialTest(t, testServer(t, &Server{OnNewMail: onNewMail, AllowBareLF: allow}))
+		c.send("EHLO client.test\n")
+		ehlo := c.reply()
+		if allow != strings.HasPrefix(ehlo, "250") {
+			t.Errorf("AllowBareLF %v: EHLO ending in LF got %q", allow, ehlo)
+		}
+		if !allow {
+			c.expect("EHLO client.test", "250")
+		}
+		c.expect("MAIL FROM:<a@b.test>", "250")
+		c.expect("RCPT TO:<c@d.test>", "250")
+		c.expect("DATA", "354")
+		c.send("Subject: typed\n\nby hand\n.\n")
+		if !allow {
+			// ".\n" is just another line; only CRLF.CRLF ends it.
+			c.send("\r\n.\r\n")
+		}
+		c.expect("", "250")
+		got := last().Data.String()
+		if allow && got != "Subject: typed\r\n\r\nby hand\r\n" ||
+			!allow && !strings.HasPrefix(got, "Subject: typed\n\nby hand\n") {
+			t.Errorf("AllowBareLF %v: delivered %q", allow, got)
+		}
+	}
+}
+
+func TestMaxConcurrentData(t *testing.T) {
+	addr := testServer(t, &Server{MaxConcurrentData: 1})
+	var cs [2]*testClient
+	for i := range cs {
+		cs[i] = dialTest(t, addr)
+		cs[i].expect("EHLO client.test", "250")
+		cs[i].expect("MAIL FROM:<a@b.test>", "250")
+		cs[i].expect("RCPT TO:<c@d.test>", "250")
+	}
+	cs[0].expect("DATA", "354")
+	start := time.Now()
+	cs[1].expect("DATA", "451 4.3.2 Too busy, try later")
+	if d := time.Since(start); d < dataSlotWait {
+		t.Errorf("refused after %v; should wait %v for a slot", d, dataSlotWait)
+	}
+
+	// The refused session keeps its transaction and gets the slot
+	// once the first message is in.
+	cs[0].expect("body\r\n.", "250")
+	cs[1].expect("DATA", "354")
+	cs[1].expect("body\r\n.", "250")
+}
+
+func TestEffectiveSize(t *testing.T) {
+	type sizes struct{ declared, effective int64 }
+	got := make(chan sizes, 1)
+	addr := testServer(t, &Server{
+		MaxMessageSize: 1000,
+		EffectiveSize: func(c Connection, declared int64, body string) int64 {
+			if body == "8BITMIME" {
+				return declared * 4 / 3 // downgraded to base64
+			}
+			return declared
+		},
+		OnNewMail: func(c Connection, from MailAddress) (Envelope, error) {
+			d, e := c.DeclaredSize()
+			got <- sizes{d, e}
+			return new(BasicEnvelope), nil
+		},
+	})
+	c := dialTest(t, addr)
+	c.expect("EHLO client.test", "250")
+	c.expect("MAIL FROM:<a@b.test> SIZE=900", "250")
+	if s := <-got; s != (sizes{900, 900}) {
+		t.Errorf("7BIT: DeclaredSize = %v, want {900 900}", s)
+	}
+	c.expect("RSET", "250")
+	c.expect("MAIL FROM:<a@b.test> SIZE=600 BODY=8BITMIME", "250")
+	if s := <-got; s != (sizes{600, 800}) {
+		t.Errorf("8BITMIME: DeclaredSize = %v, want {600 800}", s)
+	}
+	c.expect("RSET", "250")
+	c.expect("MAIL FROM:<a@b.test> SIZE=900 BODY=8BITMIME", "552 5.3.4")
+}
+
+func TestMaxDrainBytes(t *testing.T) {
+	for _, drain := range []int64{64 << 10, -1} {
+		addr := testServer(t, &Server{MaxMessageSize: 1000, MaxDrainBytes: drain})
+		c := dialTest(t, addr)
+		c.expect("EHLO client.test", "250")
+		c.expect("MAIL FROM:<a@example.com>", "250")
+		c.expect("RCPT TO:<b@example.net>", "250")
+		c.expect("DATA", "354")
+		stopped := make(chan struct{})
+		go func() {
+			// A body with no end: only the server giving up stops it.
+			defer close(stopped)
+			line := []byte(strings.Repeat("x", 998) + "\r\n")
+			for {
+				if _, err := c.c.Write(line); err != nil {
+					return
+				}
+			}
+		}()
+		c.expect("", "552 5.3.4 ")
+		c.closed()
+		c.c.Close()
+		<-stopped
+	}
+}
+
+func TestDataStateMachine(t *testing.T) {
+	onNewMail, last := collector()
+	addr := testServer(t, &Server{OnNewMail: onNewMail})
+	c := dialTest(t, addr)
+	c.expect("EHLO client.test", "250")
+	c.expect("DATA", "503 5.5.1 Error: need MAIL command")
+	c.expect("MAIL FROM:<a@b.test>", "250")
+	c.expect("RCPT TO:<c@d.test>", "250")
+	c.expect("DATA", "354")
+	c.expect("\r\n.", "250") // an empty header and body
+	if got := last().Data.String(); got != "\r\n" {
+		t.Errorf("message %q, want a lone blank line", got)
+	}
+	c.expect("DATA", "503 5.5.1 Error: need MAIL command")
+	c.expect("RCPT TO:<c@d.test>", "503")
+
+	c.expect("MAIL FROM:<a@b.test>", "250")
+	c.expect("RCPT TO:<c@d.test>", "250")
+	c.expect("DATA", "354")
+	c.expect("..\r\n...\r\n.", "250")
+	if got := last().Data.String(); got != ".\r\n..\r\n" {
+		t.Errorf("message %q, want the dots unstuffed", got)
+	}
+
+	c.expect("MAIL FROM:<a@b.test>", "250")
+	c.expect("RCPT TO:<c@d.test>", "250")
+	c.expect("DATA", "354")
+	c.expect(".", "250")
+	if got := last().Data.String(); got != "" {
+		t.Errorf("message %q, want none", got)
+	}
+}
@@ -0,0 +1,144 @@
+package smtpd
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+var (
+	errDeliveryFailed = SMTPError("451 4.3.0 Error: delivery command failed")
+	errCommandAddress = SMTPError("553 5.1.7 Error: address not usable by the delivery command")
+)
+
+// DeliverToCommand returns a Server.OnNewMail function that delivers
+// each message by running the named command, such as procmail, with
+// the message streamed to its standard input as it arrives. The
+// sender and the recipients, one per line, are passed in the SENDER
+// and RECIPIENTS environment variables. Addresses can't contain a NUL
+// or newline there, though a Server.ParseAddress may allow them: such
+// a recipient is rejected, and so is DATA for such a sender. The
+// message is accepted if the command exits with status 0 and deferred
+// otherwise; if the transaction is abandoned, the command is killed.
+// Lines end in CRLF unless Server.NormalizeLineEndings is set.
+func DeliverToCommand(name string, arg ...string) func(c Connection, from MailAddress) (Envelope, error) {
+	return func(c Connection, from MailAddress) (Envelope, error) {
+		return &cmdEnvelope{name: name, args: arg, from: from}, nil
+	}
+}
+
+// cmdEnvelope is the Envelope returned by DeliverToCommand's OnNewMail.
+type cmdEnvelope struct {
+	name  string
+	args  []string
+	from  MailAddress
+	rcpts []string
+
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	output limitedBuffer // the command's stdout and stderr, for logging
+}
+
+func (e *cmdEnvelope) AddRecipient(rcpt MailAddress) error {
+	if !commandSafe(rcpt.Email()) {
+		return errCommandAddress
+	}
+	e.rcpts = append(e.rcpts, rcpt.Email())
+	return nil
+}
+
+func (e *cmdEnvelope) BeginData() error {
+	if len(e.rcpts) == 0 {
+		return errNoRecipients
+	}
+	if !commandSafe(e.from.Email()) {
+		return errCommandAddress
+	}
+	cmd := exec.Command(e.name, e.args...)
+	cmd.Env = append(os.Environ(),
+		"SENDER="+e.from.Email(),
+		"RECIPIENTS="+strings.Join(e.rcpts, "\n"))
+	cmd.Stdout = &e.output
+	cmd.Stderr = &e.output
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		log.Printf("delivery command %s: %v", e.name, err)
+		return errDeliveryFailed
+	}
+	e.cmd, e.stdin = cmd, stdin
+	return nil
+}
+
+func (e *cmdEnvelope) Write(line []byte) error {
+	if e.cmd == nil {
+		return errDeliveryFailed
+	}
+	if _, err := e.stdin.Write(line); err != nil {
+		// Most likely the command exited early; find out why.
+		e.stdin.Close()
+		return e.wait()
+	}
+	return nil
+}
+
+func (e *cmdEnvelope) Close() error {
+	if e.cmd == nil {
+		return nil
+	}
+	e.stdin.Close()
+	return e.wait()
+}
+
+// abort kills the command after its transaction was abandoned, so it
+// doesn't deliver a partial message.
+func (e *cmdEnvelope) abort() {
+	if e.cmd == nil {
+		return
+	}
+	e.cmd.Process.Kill()
+	e.stdin.Close()
+	e.cmd.Wait()
+	e.cmd = nil
+}
+
+// wait waits for the command to exit and reports an SMTPError if it
+// failed.
+func (e *cmdEnvelope) wait() error {
+	err := e.cmd.Wait()
+	e.cmd = nil
+	if err == nil {
+		return nil
+	}
+	log.Printf("delivery command %s: %v: %q", e.name, err, e.output.Bytes())
+	return errDeliveryFailed
+}
+
+// commandSafe reports whether addr can be passed to a delivery
+// command: environment variables can't hold a NUL, and RECIPIENTS is
+// newline-separated.
+func commandSafe(addr string) bool {
+	return !strings.ContainsAny(addr, "\x00\n")
+}
+
+// limitedBuffer is a bytes.Buffer that keeps only the first
+// maxOutput bytes written to it.
+type limitedBuffer struct {
+	bytes.Buffer
+}
+
+const maxOutput = 4 << 10
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if n := maxOutput - b.Len(); n < len(p) {
+		b.Buffer.Write(p[:n])
+	} else {
+		b.Buffer.Write(p)
+	}
+	return len(p), nil
+}
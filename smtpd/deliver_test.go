@@ -0,0 +1,61 @@
+package smtpd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDeliverToCommand(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "msg")
+	addr := testServer(t, &Server{
+		OnNewMail: DeliverToCommand("sh", "-c", `{ echo "$SENDER"; echo "$RECIPIENTS"; cat; } >"$1"`, "sh", out),
+	})
+	c := dialTest(t, addr)
+	c.expect("EHLO client.test", "250")
+	c.expect("MAIL FROM:<a@b.test>", "250")
+	c.expect("RCPT TO:<c@d.test>", "250")
+	c.expect(`RCPT TO:<"e f"@f.test>`, "250")
+	c.expect("DATA", "354")
+	c.expect("Subject: hi\r\n\r\nbody\r\n.", "250")
+	got, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "a@b.test\nc@d.test\n\"e f\"@f.test\nSubject: hi\r\n\r\nbody\r\n"; string(got) != want {
+		t.Errorf("command got %q, want %q", got, want)
+	}
+}
+
+func TestDeliverToCommandAddresses(t *testing.T) {
+	// A Server.ParseAddress may allow addresses that can't be passed
+	// in the environment.
+	addr := testServer(t, &Server{
+		OnNewMail:    DeliverToCommand("sh", "-c", "cat >/dev/null"),
+		ParseAddress: func(raw string) (MailAddress, error) { return addrString(strings.ReplaceAll(raw, "%", "\x00")), nil },
+	})
+	c := dialTest(t, addr)
+	c.expect("EHLO client.test", "250")
+	c.expect("MAIL FROM:<a%@b.test>", "250")
+	c.expect("RCPT TO:<c%@d.test>", string(errCommandAddress))
+	c.expect("RCPT TO:<c@d.test>", "250")
+	c.expect("DATA", string(errCommandAddress))
+	c.expect("RSET", "250")
+	c.expect("MAIL FROM:<a@b.test>", "250")
+	c.expect("RCPT TO:<c@d.test>", "250")
+	c.expect("DATA", "354")
+	c.expect("Subject: hi\r\n\r\nbody\r\n.", "250")
+}
+
+func TestDeliverToCommandFails(t *testing.T) {
+	for _, script := range []string{"cat >/dev/null; exit 75", "exit 1"} {
+		addr := testServer(t, &Server{OnNewMail: DeliverToCommand("sh", "-c", script)})
+		c := dialTest(t, addr)
+		c.expect("EHLO client.test", "250")
+		if r := c.sendMail("a@b.test", "c@d.test", "Subject: hi\r\n\r\nbody"); r != string(errDeliveryFailed) {
+			t.Errorf("%q: got %q, want %q", script, r, errDeliveryFailed)
+		}
+		c.expect("MAIL FROM:<a@b.test>", "250")
+	}
+}
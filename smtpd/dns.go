@@ -0,0 +1,139 @@
+package smtpd
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"time"
+)
+
+var (
+	errFcrDNS     = SMTPError("550 5.7.25 Reverse DNS does not resolve to client IP")
+	errFcrDNSTemp = SMTPError("451 4.7.25 Reverse DNS lookup failed, try again later")
+
+	errDomainNotFound = SMTPError("450 4.1.2 Domain not found")
+)
+
+// Resolver looks up DNS records for the server's checks. *net.Resolver
+// implements it.
+type Resolver interface {
+	LookupAddr(ctx context.Context, addr string) (names []string, err error)
+	LookupHost(ctx context.Context, host string) (addrs []string, err error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+}
+
+func (srv *Server) resolver() Resolver {
+	if srv.Resolver != nil {
+		return srv.Resolver
+	}
+	return net.DefaultResolver
+}
+
+// dnsContext returns a context bounding one DNS lookup by
+// Server.DNSTimeout.
+func (srv *Server) dnsContext() (context.Context, context.CancelFunc) {
+	d := srv.DNSTimeout
+	if d == 0 {
+		d = 10 * time.Second
+	}
+	return context.WithTimeout(context.Background(), d)
+}
+
+// checkFcrDNS checks that the client has forward-confirmed reverse
+// DNS: a PTR name whose addresses include the client's. The result is
+// kept for the rest of the session.
+func (s *session) checkFcrDNS() error {
+	if !s.fcrdnsDone {
+		s.fcrdnsErr = s.srv.fcrdns(s.remoteIP())
+		s.fcrdnsDone = true
+	}
+	return s.fcrdnsErr
+}
+
+// fcrdns reports whether ip has forward-confirmed reverse DNS.
+func (srv *Server) fcrdns(ip string) error {
+	r := srv.resolver()
+	ctx, cancel := srv.dnsContext()
+	names, err := r.LookupAddr(ctx, ip)
+	cancel()
+	if err != nil {
+		return dnsError(err)
+	}
+	want := net.ParseIP(ip)
+	for _, name := range names {
+		ctx, cancel := srv.dnsContext()
+		addrs, err := r.LookupHost(ctx, name)
+		cancel()
+		if err != nil {
+			if isNotFound(err) {
+				continue
+			}
+			return dnsError(err)
+		}
+		for _, a := range addrs {
+			if net.ParseIP(a).Equal(want) {
+				return nil
+			}
+		}
+	}
+	return errFcrDNS
+}
+
+// checkDomain checks that mail for domain can be routed: that it has
+// MX records, or failing that, address records (RFC 5321 s5.1).
+// Address literals and empty domains aren't checked. Results are kept
+// for the rest of the session.
+func (s *session) checkDomain(domain string) error {
+	if domain == "" || strings.HasPrefix(domain, "[") {
+		return nil
+	}
+	domain = strings.ToLower(domain)
+	if err, ok := s.domainErrs[domain]; ok {
+		return err
+	}
+	err := s.srv.routable(domain)
+	if s.domainErrs == nil {
+		s.domainErrs = make(map[string]error)
+	}
+	s.domainErrs[domain] = err
+	return err
+}
+
+func (srv *Server) routable(domain string) error {
+	r := srv.resolver()
+	ctx, cancel := srv.dnsContext()
+	mxs, err := r.LookupMX(ctx, domain)
+	cancel()
+	if err == nil && len(mxs) > 0 {
+		if len(mxs) == 1 && mxs[0].Host == "." {
+			// A null MX: the domain takes no mail (RFC 7505).
+			return errDomainNotFound
+		}
+		return nil
+	}
+	if err != nil && !isNotFound(err) {
+		return errDomainNotFound
+	}
+	ctx, cancel = srv.dnsContext()
+	addrs, err := r.LookupHost(ctx, domain)
+	cancel()
+	if err != nil || len(addrs) == 0 {
+		return errDomainNotFound
+	}
+	return nil
+}
+
+// dnsError maps a failed lookup to the reply for it: permanent if the
+// record doesn't exist, else temporary.
+func dnsError(err error) error {
+	if isNotFound(err) {
+		return errFcrDNS
+	}
+	return errFcrDNSTemp
+}
+
+func isNotFound(err error) bool {
+	var de *net.DNSError
+	return errors.As(err, &de) && de.IsNotFound
+}
@@ -0,0 +1,130 @@
+package smtpd
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeResolver answers from its maps; a name missing from them isn't
+// found. Lookups of the names in slow block until their context ends.
+type fakeResolver struct {
+	ptr  map[string][]string
+	host map[string][]string
+	mx   map[string][]*net.MX
+	slow map[string]bool
+
+	lookups atomic.Int32
+}
+
+func (r *fakeResolver) wait(ctx context.Context, name string, found bool) error {
+	r.lookups.Add(1)
+	if r.slow[name] {
+		<-ctx.Done()
+		return &net.DNSError{Err: ctx.Err().Error(), Name: name, IsTimeout: true}
+	}
+	if !found {
+		return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return nil
+}
+
+func (r *fakeResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	names, ok := r.ptr[addr]
+	return names, r.wait(ctx, addr, ok)
+}
+
+func (r *fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	addrs, ok := r.host[host]
+	return addrs, r.wait(ctx, host, ok)
+}
+
+func (r *fakeResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	mxs, ok := r.mx[name]
+	return mxs, r.wait(ctx, name, ok)
+}
+
+func TestFcrDNS(t *testing.T) {
+	srv := &Server{
+		DNSTimeout: 50 * time.Millisecond,
+		Resolver: &fakeResolver{
+			ptr: map[string][]string{
+				"192.0.2.1": {"good.test."},
+				"192.0.2.2": {"forged.test."},
+				"192.0.2.3": {"gone.test.", "good.test."},
+				"192.0.2.4": {"slow"},
+				"192.0.2.5": {"good.test."},
+			},
+			host: map[string][]string{
+				"good.test.":   {"192.0.2.1", "192.0.2.3"},
+				"forged.test.": {"198.51.100.1"},
+			},
+			slow: map[string]bool{"192.0.2.6": true, "slow": true},
+		},
+	}
+	for ip, want := range map[string]error{
+		"192.0.2.1": nil,
+		"192.0.2.2": errFcrDNS,     // forward lookup doesn't match
+		"192.0.2.3": nil,           // a second name matches
+		"192.0.2.4": errFcrDNSTemp, // forward lookup times out
+		"192.0.2.5": errFcrDNS,     // name resolves to others
+		"192.0.2.7": errFcrDNS,     // no PTR
+		"192.0.2.6": errFcrDNSTemp, // PTR lookup times out
+	} {
+		if got := srv.fcrdns(ip); got != want {
+			t.Errorf("fcrdns(%s) = %v, want %v", ip, got, want)
+		}
+	}
+}
+
+func TestRequireFcrDNS(t *testing.T) {
+	for ptr, want := range map[string]string{
+		"localhost.": "250",
+		"forged.":    "550 5.7.25 Reverse DNS does not resolve to client IP",
+	} {
+		addr := testServer(t, &Server{
+			RequireFcrDNS: true,
+			Resolver: &fakeResolver{
+				ptr:  map[string][]string{"127.0.0.1": {ptr}},
+				host: map[string][]string{"localhost.": {"127.0.0.1"}, "forged.": {"192.0.2.1"}},
+			},
+		})
+		c := dialTest(t, addr)
+		c.expect("EHLO client.test", "250")
+		c.expect("MAIL FROM:<a@b.test>", want)
+	}
+}
+
+func TestVerifyRecipientDomain(t *testing.T) {
+	r := &fakeResolver{
+		mx: map[string][]*net.MX{
+			"mx.test":   {{Host: "mail.mx.test.", Pref: 10}},
+			"null.test": {{Host: ".", Pref: 0}},
+		},
+		host: map[string][]string{"a.test": {"192.0.2.1"}},
+		slow: map[string]bool{"slow.test": true},
+	}
+	addr := testServer(t, &Server{VerifyRecipientDomain: true, Resolver: r, DNSTimeout: 50 * time.Millisecond})
+	c := dialTest(t, addr)
+	c.expect("EHLO client.test", "250")
+	c.expect("MAIL FROM:<a@b.test>", "250")
+	for rcpt, want := range map[string]string{
+		"u@mx.test":      "250",
+		"u@A.test":       "250", // no MX, but an address
+		"u@[192.0.2.1]":  "250", // literals aren't looked up
+		"Postmaster":     "250",
+		"u@null.test":    "450 4.1.2 Domain not found",
+		"u@nowhere.test": "450 4.1.2 Domain not found",
+		"u@slow.test":    "450 4.1.2 Domain not found",
+	} {
+		c.expect("RCPT TO:<"+rcpt+">", want)
+	}
+	n := r.lookups.Load()
+	c.expect("RCPT TO:<v@mx.test>", "250")
+	c.expect("RCPT TO:<v@nowhere.test>", "450")
+	if got := r.lookups.Load(); got != n {
+		t.Errorf("%d more lookups for domains already seen, want 0", got-n)
+	}
+}
@@ -0,0 +1,125 @@
+package smtpd
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dnsblCacheTTL is how long a DNSBL answer is reused for other
+// connections from the same client.
+const dnsblCacheTTL = 5 * time.Minute
+
+// dnsblCache remembers DNSBL answers, keyed by query name. Expired
+// entries are swept every sweepEvery additions.
+type dnsblCache struct {
+	mu      sync.Mutex
+	m       map[string]dnsblEntry
+	records int
+}
+
+type dnsblEntry struct {
+	addrs   []string // the zone's answer; nil if not listed
+	expires time.Time
+}
+
+func (c *dnsblCache) get(name string, now time.Time) ([]string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.m[name]
+	if !ok || now.After(e.expires) {
+		return nil, false
+	}
+	return e.addrs, true
+}
+
+func (c *dnsblCache) put(name string, addrs []string, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.m == nil {
+		c.m = make(map[string]dnsblEntry)
+	}
+	c.m[name] = dnsblEntry{addrs, now.Add(dnsblCacheTTL)}
+	c.records++
+	if c.records%sweepEvery != 0 {
+		return
+	}
+	for k, e := range c.m {
+		if now.After(e.expires) {
+			delete(c.m, k)
+		}
+	}
+}
+
+// checkDNSBLs looks the client up in each of Server.DNSBLs, returning
+// the error to reject it with, if any.
+func (s *session) checkDNSBLs() error {
+	ip := net.ParseIP(s.remoteIP())
+	if ip == nil {
+		return nil
+	}
+	for _, zone := range s.srv.DNSBLs {
+		addrs, err := s.srv.dnsblLookup(dnsblName(ip, zone))
+		if err != nil {
+			log.Printf("DNSBL %s lookup for %v failed: %v", zone, ip, err)
+			continue
+		}
+		if addrs == nil {
+			continue
+		}
+		if cb := s.srv.DNSBLListed; cb != nil {
+			if err := cb(s, zone, addrs); err != nil {
+				return err
+			}
+			continue
+		}
+		return SMTPError(fmt.Sprintf("554 5.7.1 Client host blocked (listed in %s)", zone))
+	}
+	return nil
+}
+
+// dnsblLookup returns the addresses name resolves to, nil if it
+// doesn't exist, using the cache if possible. Answers outside
+// 127.0.0.0/8, and 127.255.255.0/24, which some lists use to report
+// errors such as refused queries, aren't listings (RFC 5782 s2.1).
+func (srv *Server) dnsblLookup(name string) ([]string, error) {
+	now := time.Now()
+	if addrs, ok := srv.dnsbl.get(name, now); ok {
+		return addrs, nil
+	}
+	ctx, cancel := srv.dnsContext()
+	defer cancel()
+	answer, err := srv.resolver().LookupHost(ctx, name)
+	if err != nil && !isNotFound(err) {
+		return nil, err
+	}
+	var addrs []string
+	for _, a := range answer {
+		ip := net.ParseIP(a).To4()
+		if ip != nil && ip[0] == 127 && !(ip[1] == 255 && ip[2] == 255) {
+			addrs = append(addrs, a)
+		}
+	}
+	srv.dnsbl.put(name, addrs, now)
+	return addrs, nil
+}
+
+// dnsblName returns the name to query in zone for ip: its octets, or
+// for IPv6 its nibbles, in reverse order (RFC 5782 s2.1, s2.4).
+func dnsblName(ip net.IP, zone string) string {
+	var b strings.Builder
+	if ip4 := ip.To4(); ip4 != nil {
+		for i := 3; i >= 0; i-- {
+			fmt.Fprintf(&b, "%d.", ip4[i])
+		}
+	} else {
+		for i := len(ip) - 1; i >= 0; i-- {
+			fmt.Fprintf(&b, "%x.%x.", ip[i]&0xf, ip[i]>>4)
+		}
+	}
+	b.WriteString(strings.TrimSuffix(zone, "."))
+	return b.String()
+}
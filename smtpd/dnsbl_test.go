@@ -0,0 +1,70 @@
+package smtpd
+
+import (
+	"bufio"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDNSBLName(t *testing.T) {
+	for ip, want := range map[string]string{
+		"192.0.2.1":   "1.2.0.192.zen.test",
+		"2001:db8::1": "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.zen.test",
+	} {
+		if got := dnsblName(net.ParseIP(ip), "zen.test."); got != want {
+			t.Errorf("dnsblName(%s) = %q, want %q", ip, got, want)
+		}
+	}
+}
+
+func TestDNSBLs(t *testing.T) {
+	r := &fakeResolver{
+		host: map[string][]string{
+			"1.0.0.127.listed.test": {"127.0.0.2", "127.0.0.10"},
+			"1.0.0.127.errors.test": {"127.255.255.254"}, // refused query
+		},
+		slow: map[string]bool{"1.0.0.127.slow.test": true},
+	}
+	serve := func(srv *Server) string {
+		srv.Resolver, srv.DNSTimeout = r, 50*time.Millisecond
+		return testServer(t, srv)
+	}
+	// expectBanner connects to addr and checks the greeting, which
+	// dialTest would insist is a 220.
+	expectBanner := func(addr, want string) {
+		t.Helper()
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		(&testClient{t: t, c: c, br: bufio.NewReader(c)}).expect("", want)
+	}
+	// Failed lookups, error codes and unlisted clients are let through.
+	expectBanner(serve(&Server{DNSBLs: []string{"slow.test", "errors.test", "clean.test"}}), "220 ")
+	expectBanner(serve(&Server{DNSBLs: []string{"clean.test", "listed.test"}}), "554 Client host blocked (listed in listed.test)")
+
+	var gotZone string
+	var gotAddrs []string
+	expectBanner(serve(&Server{
+		DNSBLs: []string{"listed.test"},
+		DNSBLListed: func(c Connection, zone string, addrs []string) error {
+			gotZone, gotAddrs = zone, addrs
+			return nil // allowed after all
+		},
+	}), "220 ")
+	if gotZone != "listed.test" || !reflect.DeepEqual(gotAddrs, []string{"127.0.0.2", "127.0.0.10"}) {
+		t.Errorf("DNSBLListed got %q, %q", gotZone, gotAddrs)
+	}
+
+	// Answers are kept per Server.
+	addr := serve(&Server{DNSBLs: []string{"listed.test"}})
+	expectBanner(addr, "554 ")
+	n := r.lookups.Load()
+	expectBanner(addr, "554 ")
+	if got := r.lookups.Load(); got != n {
+		t.Errorf("%d lookups for a cached answer, want 0", got-n)
+	}
+}
@@ -0,0 +1,65 @@
+package smtpd
+
+import "strings"
+
+var (
+	errBadNotify = SMTPError("501 5.5.4 Error: invalid NOTIFY parameter")
+	errBadORCPT  = SMTPError("501 5.5.4 Error: invalid ORCPT parameter")
+)
+
+// DSNRecipient is implemented by the MailAddress passed to
+// Envelope.AddRecipient. It carries the delivery status notification
+// parameters of the RCPT TO command (RFC 3461 s4).
+type DSNRecipient interface {
+	MailAddress
+
+	// Notify returns the uppercased NOTIFY values, either "NEVER"
+	// alone or some of "SUCCESS", "FAILURE" and "DELAY", or nil if
+	// none were given.
+	Notify() []string
+
+	// ORCPT returns the ORCPT parameter as sent, an address type and
+	// xtext-encoded address such as "rfc822;user@example.com", or "".
+	ORCPT() string
+}
+
+type rcptAddr struct {
+	MailAddress
+	notify []string
+	orcpt  string
+	raw    string // the RCPT TO line, without CRLF
+}
+
+func (a *rcptAddr) Notify() []string { return a.notify }
+func (a *rcptAddr) ORCPT() string    { return a.orcpt }
+func (a *rcptAddr) Raw() string      { return a.raw }
+
+// parseRcptDSN returns rcpt with the DSN parameters from params.
+func parseRcptDSN(rcpt MailAddress, params map[string]string) (*rcptAddr, error) {
+	ra := &rcptAddr{MailAddress: rcpt}
+	if v, ok := params["NOTIFY"]; ok {
+		seen := make(map[string]bool)
+		for _, n := range strings.Split(strings.ToUpper(v), ",") {
+			switch n {
+			case "NEVER", "SUCCESS", "FAILURE", "DELAY":
+			default:
+				return nil, errBadNotify
+			}
+			if seen[n] {
+				return nil, errBadNotify
+			}
+			seen[n] = true
+			ra.notify = append(ra.notify, n)
+		}
+		if seen["NEVER"] && len(ra.notify) > 1 {
+			return nil, errBadNotify
+		}
+	}
+	if v, ok := params["ORCPT"]; ok {
+		if idx := strings.Index(v, ";"); idx < 1 || idx == len(v)-1 {
+			return nil, errBadORCPT
+		}
+		ra.orcpt = v
+	}
+	return ra, nil
+}
@@ -0,0 +1,41 @@
+package smtpd
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRcptDSN(t *testing.T) {
+	onNewMail, last := collector()
+	addr := testServer(t, &Server{OnNewMail: onNewMail})
+	c := dialTest(t, addr)
+	c.expect("EHLO client.test", "250")
+	c.expect("MAIL FROM:<a@b.test>", "250")
+	c.expect("RCPT TO:<c@d.test> NOTIFY=SUCCESS,FAILURE ORCPT=rfc822;user@host", "250")
+	c.expect("RCPT TO:<e@f.test> NOTIFY=NEVER", "250")
+	c.expect("RCPT TO:<g@h.test>", "250")
+	for _, bad := range []string{"NOTIFY=NEVER,SUCCESS", "NOTIFY=SOMETIMES", "NOTIFY=DELAY,DELAY", "NOTIFY="} {
+		c.expect("RCPT TO:<x@y.test> "+bad, "501 5.5.4 Error: invalid NOTIFY parameter")
+	}
+	for _, bad := range []string{"ORCPT=user@host", "ORCPT=;user@host", "ORCPT=rfc822;"} {
+		c.expect("RCPT TO:<x@y.test> "+bad, "501 5.5.4 Error: invalid ORCPT parameter")
+	}
+	c.expect("DATA", "354")
+	c.expect("Subject: hi\r\n\r\nbody\r\n.", "250")
+	if n := len(last().Rcpts); n != 3 {
+		t.Fatalf("%d recipients, want 3: rejected ones must not count", n)
+	}
+	for i, want := range []struct {
+		notify []string
+		orcpt  string
+	}{
+		{[]string{"SUCCESS", "FAILURE"}, "rfc822;user@host"},
+		{[]string{"NEVER"}, ""},
+		{nil, ""},
+	} {
+		r := last().Rcpts[i].(DSNRecipient)
+		if !reflect.DeepEqual(r.Notify(), want.notify) || r.ORCPT() != want.orcpt {
+			t.Errorf("%s: Notify %q, ORCPT %q; want %q, %q", r.Email(), r.Notify(), r.ORCPT(), want.notify, want.orcpt)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package smtpd
+
+import (
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// txRecorder is a TxEnvelope that records how its transaction ended.
+type txRecorder struct {
+	BasicEnvelope
+	closeErr  error
+	commitErr error
+
+	mu         sync.Mutex
+	committed  bool
+	rolledBack bool
+	ended      chan bool
+}
+
+func newTxRecorder() *txRecorder { return &txRecorder{ended: make(chan bool, 1)} }
+
+func (e *txRecorder) Close() error { return e.closeErr }
+
+func (e *txRecorder) Commit() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.commitErr != nil {
+		return e.commitErr
+	}
+	e.committed = true
+	e.ended <- true
+	return nil
+}
+
+func (e *txRecorder) Rollback() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.rolledBack = true
+	e.ended <- true
+}
+
+// wait waits for the transaction to end and reports whether it was
+// committed and whether it was rolled back.
+func (e *txRecorder) wait(t *testing.T) (committed, rolledBack bool) {
+	t.Helper()
+	select {
+	case <-e.ended:
+	case <-time.After(5 * time.Second):
+		t.Fatal("transaction never ended")
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.committed, e.rolledBack
+}
+
+// txServer starts a server whose transactions use the txRecorders
+// sent on the returned channel, one per MAIL FROM.
+func txServer(t *testing.T, srv *Server) (string, chan *txRecorder) {
+	envs := make(chan *txRecorder, 10)
+	srv.OnNewMail = func(c Connection, from MailAddress) (Envelope, error) {
+		e := newTxRecorder()
+		envs <- e
+		return e, nil
+	}
+	return testServer(t, srv), envs
+}
+
+func TestAbortTransaction(t *testing.T) {
+	for _, end := range []string{"QUIT", "RSET", "disconnect"} {
+		t.Run(end, func(t *testing.T) {
+			addr, envs := txServer(t, &Server{})
+			c := dialTest(t, addr)
+			c.expect("EHLO client.test", "250")
+			c.expect("MAIL FROM:<a@example.com>", "250")
+			c.expect("RCPT TO:<b@example.net>", "250")
+			switch end {
+			case "QUIT":
+				c.expect("QUIT", "221")
+			case "RSET":
+				c.expect("RSET", "250")
+			default:
+				c.c.Close()
+			}
+			if committed, rolledBack := (<-envs).wait(t); committed || !rolledBack {
+				t.Errorf("committed=%v rolledBack=%v, want a rollback", committed, rolledBack)
+			}
+		})
+	}
+}
+
+func TestTxEnvelopeEnds(t *testing.T) {
+	for _, tt := range []struct {
+		name                string
+		closeErr, commitErr error
+		rejectData          bool
+		reply               string
+		committed           bool
+	}{
+		{name: "accepted", reply: "250 2.0.0 Ok: queued as ", committed: true},
+		{name: "commit fails", commitErr: SMTPError("452 4.3.1 Insufficient system storage"),
+			reply: "452 4.3.1 Insufficient system storage"},
+		{name: "close fails", closeErr: SMTPError("554 5.6.0 Message refused"),
+			reply: "554 5.6.0 Message refused"},
+		{name: "rejected", rejectData: true, reply: "550 5.7.1 Spam"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			envs := make(chan *txRecorder, 1)
+			srv := &Server{
+				OnNewMail: func(c Connection, from MailAddress) (Envelope, error) {
+					e := newTxRecorder()
+					e.closeErr, e.commitErr = tt.closeErr, tt.commitErr
+					envs <- e
+					return e, nil
+				},
+			}
+			if tt.rejectData {
+				srv.OnMessageData = func(c Connection, env Envelope, data io.Reader) error {
+					return SMTPError("550 5.7.1 Spam")
+				}
+			}
+			c := dialTest(t, testServer(t, srv))
+			c.expect("EHLO client.test", "250")
+			if r := c.sendMail("a@example.com", "b@example.net", "Subject: hi\r\n\r\nbody"); !strings.HasPrefix(r, tt.reply) {
+				t.Errorf("final reply %q, want %q", r, tt.reply)
+			}
+			committed, rolledBack := (<-envs).wait(t)
+			if committed != tt.committed || rolledBack == tt.committed {
+				t.Errorf("committed=%v rolledBack=%v, want exactly one of them, committed %v", committed, rolledBack, tt.committed)
+			}
+		})
+	}
+}
+
+func TestQuitInsideData(t *testing.T) {
+	addr, envs := txServer(t, &Server{})
+	c := dialTest(t, addr)
+	c.expect("EHLO client.test", "250")
+	c.expect("MAIL FROM:<a@example.com>", "250")
+	c.expect("RCPT TO:<b@example.net>", "250")
+	c.expect("DATA", "354")
+	c.send("QUIT\r\n") // message data, not a command
+	c.expect(".", "250")
+	if committed, _ := (<-envs).wait(t); !committed {
+		t.Error("message not committed")
+	}
+	c.expect("QUIT", "221")
+}
@@ -0,0 +1,110 @@
+package smtpd
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+var errGreylisted = SMTPError("451 4.7.1 Greylisted, try again later")
+
+// GreylistStore records when (client IP, sender, recipient) triplets were
+// first seen. Implementations must be safe for concurrent use.
+type GreylistStore interface {
+	// FirstSeen returns the time key was recorded, if it was.
+	FirstSeen(key string) (t time.Time, ok bool)
+	// Record records key as first seen at t.
+	Record(key string, t time.Time)
+}
+
+// Greylister temporarily rejects recipients the first time a
+// (client IP, sender, recipient) triplet is seen, accepting retries of
+// the same triplet once Delay has passed.
+type Greylister struct {
+	Delay  time.Duration // minimum time before a retry is accepted; 5 minutes if zero
+	Expiry time.Duration // how long a triplet is remembered; 36 days if zero
+	Store  GreylistStore // optional; an in-memory store is used if nil
+
+	// Now, if non-nil, is used in place of time.Now.
+	Now func() time.Time
+
+	once sync.Once
+	mem  *memGreylistStore
+}
+
+// Check returns an SMTPError if mail from the given client IP, sender
+// and recipient should be deferred, or nil to accept it.
+func (g *Greylister) Check(ip, from, to string) error {
+	now := time.Now()
+	if g.Now != nil {
+		now = g.Now()
+	}
+	key := strings.ToLower(ip + "\x00" + from + "\x00" + to)
+	store := g.store()
+	first, ok := store.FirstSeen(key)
+	if !ok || now.Sub(first) > g.expiry() {
+		store.Record(key, now)
+		return errGreylisted
+	}
+	if now.Sub(first) < g.delay() {
+		return errGreylisted
+	}
+	return nil
+}
+
+func (g *Greylister) delay() time.Duration {
+	if g.Delay != 0 {
+		return g.Delay
+	}
+	return 5 * time.Minute
+}
+
+func (g *Greylister) expiry() time.Duration {
+	if g.Expiry != 0 {
+		return g.Expiry
+	}
+	return 36 * 24 * time.Hour
+}
+
+func (g *Greylister) store() GreylistStore {
+	if g.Store != nil {
+		return g.Store
+	}
+	g.once.Do(func() {
+		g.mem = &memGreylistStore{m: make(map[string]time.Time), expiry: g.expiry()}
+	})
+	return g.mem
+}
+
+// memGreylistStore is the default GreylistStore. Expired entries are
+// swept every sweepEvery records so never-retried triplets don't pile up.
+type memGreylistStore struct {
+	mu      sync.Mutex
+	m       map[string]time.Time
+	expiry  time.Duration
+	records int
+}
+
+const sweepEvery = 1024
+
+func (ms *memGreylistStore) FirstSeen(key string) (time.Time, bool) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	t, ok := ms.m[key]
+	return t, ok
+}
+
+func (ms *memGreylistStore) Record(key string, t time.Time) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.m[key] = t
+	ms.records++
+	if ms.records%sweepEvery != 0 {
+		return
+	}
+	for k, first := range ms.m {
+		if t.Sub(first) > ms.expiry {
+			delete(ms.m, k)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package smtpd
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGreylisterCheck(t *testing.T) {
+	now := time.Date(2011, 1, 1, 0, 0, 0, 0, time.UTC)
+	g := &Greylister{Delay: 5 * time.Minute, Expiry: time.Hour, Now: func() time.Time { return now }}
+	if err := g.Check("192.0.2.1", "a@example.com", "b@example.net"); err != errGreylisted {
+		t.Fatalf("first contact: got %v, want %v", err, errGreylisted)
+	}
+	now = now.Add(time.Minute)
+	if err := g.Check("192.0.2.1", "a@example.com", "b@example.net"); err != errGreylisted {
+		t.Fatalf("early retry: got %v, want %v", err, errGreylisted)
+	}
+	now = now.Add(5 * time.Minute)
+	if err := g.Check("192.0.2.1", "A@example.com", "b@example.net"); err != nil {
+		t.Fatalf("retry after delay: %v", err)
+	}
+	if err := g.Check("192.0.2.2", "a@example.com", "b@example.net"); err != errGreylisted {
+		t.Fatalf("other client: got %v, want %v", err, errGreylisted)
+	}
+	now = now.Add(2 * time.Hour)
+	if err := g.Check("192.0.2.1", "a@example.com", "b@example.net"); err != errGreylisted {
+		t.Fatalf("after expiry: got %v, want %v", err, errGreylisted)
+	}
+}
+
+type mapGreylistStore map[string]time.Time
+
+func (m mapGreylistStore) FirstSeen(key string) (time.Time, bool) {
+	t, ok := m[key]
+	return t, ok
+}
+
+func (m mapGreylistStore) Record(key string, t time.Time) { m[key] = t }
+
+func TestGreylistRcpt(t *testing.T) {
+	now := time.Now()
+	store := mapGreylistStore{}
+	addr := testServer(t, &Server{Greylist: &Greylister{
+		Store: store,
+		Now:   func() time.Time { return now },
+	}})
+	c := dialTest(t, addr)
+	c.expect("EHLO client.test", "250")
+	c.expect("MAIL FROM:<a@example.com>", "250")
+	c.expect("RCPT TO:<b@example.net>", "451 4.7.1 Greylisted, try again later")
+	if len(store) != 1 {
+		t.Fatalf("store has %d entries, want 1", len(store))
+	}
+	now = now.Add(10 * time.Minute)
+	c.expect("RCPT TO:<b@example.net>", "250")
+}
@@ -0,0 +1,141 @@
+package smtpd
+
+import (
+	"crypto/rand"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// HeaderEnvelope is an Envelope that takes the header fields the
+// server adds to a message (Received, Received-SPF and any added with
+// Connection.AddHeader) separately from the message itself.
+//
+// If the Envelope returned by OnNewMail implements HeaderEnvelope,
+// SetHeader is called for each such field, top-most first, after
+// BeginData and before the first Write, and they aren't written to
+// Write. The Envelope should prepend them to the client's header in
+// that order. Otherwise they're written ahead of the message as
+// ordinary header lines.
+//
+// The exception is the Message-ID added by Server.GenerateMessageID,
+// which is only known to be missing at the end of the client's header.
+// It's passed to SetHeader, or written, then.
+type HeaderEnvelope interface {
+	Envelope
+	SetHeader(name, value string) error
+}
+
+type headerField struct {
+	name, value string
+}
+
+// AddHeader adds a header field to prepend to the message of the
+// current transaction. It's for use from OnNewMail and later
+// callbacks; fields added before MAIL FROM are discarded.
+func (s *session) AddHeader(name, value string) {
+	s.headers = append(s.headers, headerField{name, value})
+}
+
+// writeHeaders passes the server-generated header fields to the
+// Envelope: the added ones in order, then the Received field, which
+// goes directly above the client's header. write is used, a line at
+// a time, if the Envelope isn't a HeaderEnvelope.
+func (s *session) writeHeaders(write func([]byte) error) error {
+	fields := s.headers
+	if s.srv.AddReceived {
+		fields = append(fields[:len(fields):len(fields)], headerField{"Received", s.received()})
+	}
+	for _, f := range fields {
+		if err := s.writeHeader(f, write); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeHeader passes one header field to the Envelope, with
+// SetHeader or, a line at a time, write.
+func (s *session) writeHeader(f headerField, write func([]byte) error) error {
+	if he, ok := s.env.(HeaderEnvelope); ok {
+		return he.SetHeader(f.name, f.value)
+	}
+	// Folded values are written as one line per Write, like the
+	// client's header.
+	for _, line := range strings.SplitAfter(f.name+": "+f.value+"\r\n", "\r\n") {
+		if line == "" {
+			continue
+		}
+		if err := write([]byte(line)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// messageID returns a new Message-ID for a message that lacks one.
+func (s *session) messageID() string {
+	domain := s.srv.MessageIDDomain
+	if domain == "" {
+		domain = s.srv.hostname()
+	}
+	var b [16]byte
+	rand.Read(b[:])
+	return fmt.Sprintf("<%x@%s>", b, domain)
+}
+
+// newQueueID returns the ID of a new transaction, from
+// Server.GenerateID if it gives a usable one.
+func (s *session) newQueueID() string {
+	if gen := s.srv.GenerateID; gen != nil {
+		id := gen(s)
+		if id != "" && validArgText(id, false) && !strings.Contains(id, " ") {
+			return id
+		}
+		log.Printf("GenerateID returned unusable queue ID %q; using default", id)
+	}
+	var b [6]byte
+	rand.Read(b[:])
+	return fmt.Sprintf("%X", b)
+}
+
+// isHeader reports whether line is a header field named name.
+func isHeader(line []byte, name string) bool {
+	return len(line) > len(name) && line[len(name)] == ':' &&
+		strings.EqualFold(string(line[:len(name)]), name)
+}
+
+// headerHello returns the HELO or EHLO name to copy into a generated
+// header field, or "" if it's unfit: without StrictHello it can be
+// any text up to the CRLF, such as a bare CR or a "; " that would
+// change the field's meaning.
+func (s *session) headerHello() string {
+	h := s.helloHost
+	if !validArgText(h, false) || strings.ContainsAny(h, " ;()") {
+		return ""
+	}
+	return h
+}
+
+// received returns the value of a Received trace field for the
+// current message (RFC 5321 s4.4), recording the protocol per
+// RFC 3848.
+func (s *session) received() string {
+	proto := "SMTP"
+	if s.helloType == "EHLO" {
+		proto = "ESMTP"
+		if s.tlsActive() {
+			proto += "S"
+		}
+		if s.authUser != "" {
+			proto += "A"
+		}
+	}
+	from := "[" + s.remoteIP() + "]"
+	if h := s.headerHello(); h != "" {
+		from = h + " (" + from + ")"
+	}
+	return fmt.Sprintf("from %s by %s (gosmtpd) with %s id %s; %s",
+		from, s.srv.hostname(), proto, s.queueID, time.Now().Format(time.RFC1123Z))
+}
@@ -0,0 +1,140 @@
+package smtpd
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestReceivedSPF(t *testing.T) {
+	onNewMail, last := collector()
+	addr := testServer(t, &Server{
+		OnNewMail: onNewMail,
+		SPFResult: func(c Connection, from MailAddress) (string, string, error) {
+			if from.Hostname() == "fail.test" {
+				return "", "", SMTPError("550 5.7.23 SPF validation failed")
+			}
+			return "pass", "domain of " + from.Email() + " designates client", nil
+		},
+	})
+	c := dialTest(t, addr)
+	c.expect("EHLO client.test", "250")
+	if r := c.sendMail("a@pass.test", "b@example.net", "Subject: hi\r\n\r\nbody"); !strings.HasPrefix(r, "250") {
+		t.Fatal(r)
+	}
+	data := last().Data.String()
+	want := "Received-SPF: pass (domain of a@pass.test designates client) receiver=mx.test; client-ip=127.0.0.1; envelope-from=\"a@pass.test\"; helo=client.test;\r\nSubject: hi\r\n"
+	if !strings.HasPrefix(data, want) {
+		t.Errorf("message starts %q, want %q", data, want)
+	}
+	c.expect("MAIL FROM:<a@fail.test>", "550 5.7.23 SPF validation failed")
+}
+
+func TestRawHeaderPreserved(t *testing.T) {
+	onNewMail, last := collector()
+	addr := testServer(t, &Server{OnNewMail: onNewMail})
+	header := "Subject:   odd  spacing \t\r\n" +
+		"DKIM-Signature: v=1; a=rsa-sha256;\r\n" +
+		"\t d=example.com;  s=sel;\r\n" +
+		"   h=from:subject\r\n" +
+		"From:\tA <a@example.com>\r\n" +
+		"..Dotted: header\r\n"
+	c := dialTest(t, addr)
+	c.expect("EHLO client.test", "250")
+	if r := c.sendMail("a@example.com", "b@example.net", header+"\r\nbody"); !strings.HasPrefix(r, "250") {
+		t.Fatal(r)
+	}
+	want := strings.Replace(header, "..Dotted", ".Dotted", 1) + "\r\nbody\r\n"
+	if got := last().Data.String(); got != want {
+		t.Errorf("message changed:\n got %q\nwant %q", got, want)
+	}
+}
+
+func TestReceivedHelloSanitized(t *testing.T) {
+	onNewMail, last := collector()
+	addr := testServer(t, &Server{
+		OnNewMail:   onNewMail,
+		AddReceived: true,
+		SPFResult: func(c Connection, from MailAddress) (string, string, error) {
+			return "pass", "", nil
+		},
+	})
+	for _, tt := range []struct{ hello, from, helo string }{
+		{"client.test", "from client.test ([127.0.0.1]) by mx.test", " helo=client.test;"},
+		{"bad\rhost", "from [127.0.0.1] by mx.test", "envelope-from=\"a@b.test\";\r\n"},
+		{"x; helo=forged", "from [127.0.0.1] by mx.test", "envelope-from=\"a@b.test\";\r\n"},
+	} {
+		c := dialTest(t, addr)
+		c.expect("EHLO "+tt.hello, "250")
+		if r := c.sendMail("a@b.test", "c@d.test", "Subject: hi\r\n\r\nbody"); !strings.HasPrefix(r, "250") {
+			t.Fatal(r)
+		}
+		data := last().Data.String()
+		hdr := data[:strings.Index(data, "Subject:")]
+		if !strings.Contains(hdr, "Received: "+tt.from) || !strings.Contains(hdr, tt.helo) {
+			t.Errorf("EHLO %q: header %q, want %q and %q", tt.hello, hdr, tt.from, tt.helo)
+		}
+		if strings.Contains(strings.Replace(hdr, "\r\n", "", -1), "\r") {
+			t.Errorf("EHLO %q: bare CR in header %q", tt.hello, hdr)
+		}
+	}
+}
+
+func TestGenerateMessageID(t *testing.T) {
+	onNewMail, last := collector()
+	plain := testServer(t, &Server{OnNewMail: onNewMail, GenerateMessageID: true})
+	custom := testServer(t, &Server{OnNewMail: onNewMail, GenerateMessageID: true, MessageIDDomain: "ids.test"})
+	c := dialTest(t, plain)
+	c.expect("EHLO client.test", "250")
+	send := func(msg string) string {
+		t.Helper()
+		if r := c.sendMail("a@b.test", "c@d.test", msg); !strings.HasPrefix(r, "250") {
+			t.Fatal(r)
+		}
+		return last().Data.String()
+	}
+	re := regexp.MustCompile(`^Subject: hi\r\nMessage-ID: <[0-9a-f]{32}@mx\.test>\r\n\r\nbody\r\n$`)
+	if got := send("Subject: hi\r\n\r\nbody"); !re.MatchString(got) {
+		t.Errorf("without Message-ID: got %q", got)
+	}
+	has := "Subject: hi\r\nMessage-Id: <orig@b.test>\r\n\r\nbody"
+	if got := send(has); got != has+"\r\n" {
+		t.Errorf("with Message-ID: got %q, want it untouched", got)
+	}
+	c = dialTest(t, custom)
+	c.expect("EHLO client.test", "250")
+	if got := send("Subject: hi\r\n\r\nbody"); !strings.Contains(got, "@ids.test>\r\n") {
+		t.Errorf("with MessageIDDomain: got %q", got)
+	}
+}
+
+func TestGenerateID(t *testing.T) {
+	onNewMail, last := collector()
+	var log syncBuffer
+	const id = "4Xm9Ln2WbQz"
+	ids := make(chan string, 2)
+	ids <- id
+	ids <- "has space"
+	addr := testServer(t, &Server{
+		OnNewMail:   onNewMail,
+		AddReceived: true,
+		AccessLog:   &log,
+		GenerateID:  func(c Connection) string { return <-ids },
+	})
+	c := dialTest(t, addr)
+	c.expect("EHLO client.test", "250")
+	if r := c.sendMail("a@b.test", "c@d.test", "Subject: hi\r\n\r\nbody"); r != "250 2.0.0 Ok: queued as "+id {
+		t.Errorf("final reply %q lacks the ID", r)
+	}
+	if got := last().Data.String(); !strings.Contains(got, " id "+id+"; ") {
+		t.Errorf("Received field lacks the ID:\n%s", got)
+	}
+	if !strings.Contains(log.String(), " id="+id+" ") {
+		t.Errorf("access log lacks the ID: %s", &log)
+	}
+
+	r := c.sendMail("a@b.test", "c@d.test", "Subject: hi\r\n\r\nbody")
+	if !regexp.MustCompile(`^250 2\.0\.0 Ok: queued as [0-9A-F]{12}$`).MatchString(r) {
+		t.Errorf("with an unusable ID, got %q; want the default", r)
+	}
+}
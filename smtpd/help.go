@@ -0,0 +1,93 @@
+package smtpd
+
+import (
+	"log"
+	"sort"
+	"strings"
+)
+
+// helpText is the syntax HELP gives for each built-in command.
+var helpText = map[string]string{
+	"AUTH":     "AUTH mechanism [initial-response]",
+	"BDAT":     "BDAT size [LAST]",
+	"DATA":     "DATA",
+	"EHLO":     "EHLO domain",
+	"HELO":     "HELO domain",
+	"HELP":     "HELP [command]",
+	"MAIL":     "MAIL FROM:<address> [parameters]",
+	"NOOP":     "NOOP [string]",
+	"QUIT":     "QUIT",
+	"RCPT":     "RCPT TO:<address> [parameters]",
+	"RSET":     "RSET",
+	"STARTTLS": "STARTTLS",
+}
+
+// help returns the help text for verb, reporting false if there's
+// none: it isn't a command, or isn't enabled on this server.
+func (srv *Server) help(verb string) (string, bool) {
+	if srv.verbDisabled(verb) {
+		return "", false
+	}
+	if text, ok := srv.Help[verb]; ok {
+		return text, text != ""
+	}
+	switch verb {
+	case "STARTTLS":
+		if srv.TLSConfig == nil {
+			return "", false
+		}
+	case "AUTH":
+		if !srv.authEnabled() {
+			return "", false
+		}
+	case "BDAT":
+		if !srv.Chunking {
+			return "", false
+		}
+	}
+	text, ok := helpText[verb]
+	return text, ok
+}
+
+// handleHelp handles a HELP command (RFC 5321 s4.1.1.8): with no
+// argument it lists the commands there's help for, and with one it
+// gives that command's syntax.
+func (s *session) handleHelp(arg string) {
+	if arg == "" {
+		var verbs []string
+		for v := range helpText {
+			if _, ok := s.srv.help(v); ok {
+				verbs = append(verbs, v)
+			}
+		}
+		for v := range s.srv.Help {
+			if _, builtin := helpText[v]; !builtin {
+				if _, ok := s.srv.help(v); ok {
+					verbs = append(verbs, v)
+				}
+			}
+		}
+		sort.Strings(verbs)
+		s.sendlinef("214 2.0.0 Commands: %s", strings.Join(verbs, " "))
+		return
+	}
+	verb := upperASCII(arg)
+	text, ok := s.srv.help(verb)
+	if !ok {
+		s.sendlinef("504 5.5.4 Unknown command for HELP")
+		return
+	}
+	lines := strings.Split(text, "\n")
+	for _, l := range lines {
+		if !validArgText(l, false) {
+			log.Printf("smtpd: invalid Help text for %s %q", verb, text)
+			s.sendlinef("504 5.5.4 Unknown command for HELP")
+			return
+		}
+	}
+	if len(lines) == 1 {
+		s.sendlinef("214 2.0.0 %s", text)
+		return
+	}
+	s.sendReplyLines("214", lines)
+}
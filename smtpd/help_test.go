@@ -0,0 +1,31 @@
+package smtpd
+
+import "testing"
+
+func TestHelp(t *testing.T) {
+	srv := &Server{
+		Help: map[string]string{
+			"XFOO": "XFOO <arg>\nRuns foo",
+			"RSET": "",
+			"QUIT": "QUIT (ends the session)",
+		},
+	}
+	srv.Handle("XFOO", func(c Connection, arg string) error { return nil })
+	c := dialTest(t, testServer(t, srv))
+	c.expect("EHLO client.test", "250")
+	for _, tt := range []struct{ cmd, want string }{
+		{"HELP", "214 2.0.0 Commands: DATA EHLO HELO HELP MAIL NOOP QUIT RCPT XFOO"},
+		{"HELP mail", "214 2.0.0 MAIL FROM:<address> [parameters]"},
+		{"HELP NOOP", "214 2.0.0 NOOP [string]"},
+		{"HELP QUIT", "214 2.0.0 QUIT (ends the session)"},
+		{"HELP XFOO", "214-XFOO <arg>\n214 Runs foo"},
+		{"HELP RSET", "504 5.5.4 Unknown command for HELP"},
+		{"HELP STARTTLS", "504 5.5.4 Unknown command for HELP"}, // no TLSConfig
+		{"HELP AUTH", "504 5.5.4 Unknown command for HELP"},
+		{"HELP BOGUS", "504 5.5.4 Unknown command for HELP"},
+	} {
+		if got := c.cmd(tt.cmd); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.cmd, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,21 @@
+package smtpd
+
+import (
+	"fmt"
+	"net/mail"
+)
+
+// NetMailAddress returns a, such as an Envelope's sender or
+// recipient, parsed as a net/mail Address, for use with code built on
+// the standard library. It returns nil, and no error, for the null
+// sender "<>".
+func NetMailAddress(a MailAddress) (*mail.Address, error) {
+	if a == nil || a.Email() == "" {
+		return nil, nil
+	}
+	addr, err := mail.ParseAddress("<" + a.Email() + ">")
+	if err != nil {
+		return nil, fmt.Errorf("smtpd: parsing %q as a net/mail address: %w", a.Email(), err)
+	}
+	return addr, nil
+}
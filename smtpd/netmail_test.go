@@ -0,0 +1,31 @@
+package smtpd
+
+import "testing"
+
+func TestNetMailAddress(t *testing.T) {
+	for _, tt := range []struct {
+		addr, want string // want "" for nil
+	}{
+		{"Alice@Example.com", "Alice@Example.com"},
+		{`"john smith"@example.com`, "john smith@example.com"},
+		{"", ""},
+	} {
+		got, err := NetMailAddress(addrString(tt.addr))
+		if err != nil {
+			t.Errorf("NetMailAddress(%q): %v", tt.addr, err)
+			continue
+		}
+		switch {
+		case tt.want == "" && got != nil:
+			t.Errorf("NetMailAddress(%q) = %v, want nil", tt.addr, got)
+		case tt.want != "" && (got == nil || got.Address != tt.want):
+			t.Errorf("NetMailAddress(%q) = %v, want address %q", tt.addr, got, tt.want)
+		}
+	}
+	if got, err := NetMailAddress(nil); got != nil || err != nil {
+		t.Errorf("NetMailAddress(nil) = %v, %v", got, err)
+	}
+	if _, err := NetMailAddress(addrString("not an address")); err == nil {
+		t.Error("unparseable address: no error")
+	}
+}
@@ -0,0 +1,176 @@
+package smtpd
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// proxyV2Sig is the signature that starts a binary PROXY protocol v2
+// header.
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// readProxyHeader reads the PROXY protocol header, v1 or v2, that a
+// load balancer sends ahead of the SMTP stream, and records the client
+// address it carries. LOCAL and UNKNOWN headers leave the address of
+// the actual peer in place.
+func (s *session) readProxyHeader() error {
+	// The header is bounded like a first command: a client that
+	// connects directly waits for a banner that never comes, so it's
+	// dropped once the first-command timeout passes.
+	s.setReadTimeout(s.srv.firstCommandTimeout())
+	// Peek only as far as needed to tell the versions apart, as a
+	// short v1 header may be all the proxy sends before the banner.
+	sig, err := s.br.Peek(5)
+	if err != nil {
+		return err
+	}
+	switch {
+	case bytes.Equal(sig, proxyV2Sig[:5]):
+		if sig, err = s.br.Peek(len(proxyV2Sig)); err != nil {
+			return err
+		}
+		if bytes.Equal(sig, proxyV2Sig) {
+			return s.readProxyV2()
+		}
+	case bytes.Equal(sig, []byte("PROXY")):
+		return s.readProxyV1()
+	}
+	return errors.New("missing PROXY protocol header")
+}
+
+// readProxyV1 reads a text header such as
+// "PROXY TCP4 192.0.2.1 198.51.100.1 56324 25\r\n".
+func (s *session) readProxyV1() error {
+	sl, err := s.readLine()
+	if err != nil {
+		return err
+	}
+	// 107 bytes is the longest header allowed by the spec.
+	if len(sl) > 107 || !bytes.HasSuffix(sl, []byte("\r\n")) {
+		return errors.New("malformed PROXY v1 header")
+	}
+	f := strings.Fields(string(sl))
+	if len(f) >= 2 && f[1] == "UNKNOWN" {
+		return nil
+	}
+	if len(f) != 6 || f[1] != "TCP4" && f[1] != "TCP6" {
+		return fmt.Errorf("malformed PROXY v1 header %q", sl)
+	}
+	ip := net.ParseIP(f[2])
+	port, err := strconv.ParseUint(f[4], 10, 16)
+	if ip == nil || err != nil || (ip.To4() != nil) != (f[1] == "TCP4") {
+		return fmt.Errorf("malformed PROXY v1 header %q", sl)
+	}
+	s.proxyAddr = &net.TCPAddr{IP: ip, Port: int(port)}
+	return nil
+}
+
+// readProxyV2 reads a binary header. Of its TLVs, only PP2_TYPE_SSL is
+// used, and only from TrustedProxies; the others are skipped.
+func (s *session) readProxyV2() error {
+	var hdr [16]byte
+	if _, err := io.ReadFull(s.br, hdr[:]); err != nil {
+		return err
+	}
+	verCmd, fam := hdr[12], hdr[13]
+	n := int(binary.BigEndian.Uint16(hdr[14:]))
+	if verCmd>>4 != 2 {
+		return fmt.Errorf("unsupported PROXY protocol version %d", verCmd>>4)
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(s.br, body); err != nil {
+		return err
+	}
+	switch verCmd & 0xf {
+	case 0: // LOCAL: a health check from the proxy itself
+		return nil
+	case 1: // PROXY
+	default:
+		return fmt.Errorf("unsupported PROXY v2 command %d", verCmd&0xf)
+	}
+	var ipLen int
+	switch fam >> 4 {
+	case 1: // AF_INET
+		ipLen = net.IPv4len
+	case 2: // AF_INET6
+		ipLen = net.IPv6len
+	default: // AF_UNSPEC, AF_UNIX: no usable client address
+		return nil
+	}
+	if len(body) < 2*ipLen+4 {
+		return errors.New("short PROXY v2 address block")
+	}
+	ip := make(net.IP, ipLen)
+	copy(ip, body[:ipLen])
+	port := binary.BigEndian.Uint16(body[2*ipLen:])
+	s.proxyAddr = &net.TCPAddr{IP: ip, Port: int(port)}
+	if s.fromTrustedProxy() {
+		return s.readProxyTLVs(body[2*ipLen+4:])
+	}
+	return nil
+}
+
+// readProxyTLVs records the TLS state reported in the TLVs of a PROXY
+// v2 header, if the client connected to the proxy over TLS.
+func (s *session) readProxyTLVs(tlvs []byte) error {
+	for len(tlvs) > 0 {
+		if len(tlvs) < 3 {
+			return errors.New("short PROXY v2 TLV")
+		}
+		typ, n := tlvs[0], int(binary.BigEndian.Uint16(tlvs[1:]))
+		if len(tlvs) < 3+n {
+			return errors.New("short PROXY v2 TLV")
+		}
+		val := tlvs[3 : 3+n]
+		tlvs = tlvs[3+n:]
+		// PP2_TYPE_SSL: client flags, verify result, sub-TLVs.
+		if typ != 0x20 || len(val) < 5 || val[0]&0x01 == 0 {
+			continue
+		}
+		cs := &tls.ConnectionState{HandshakeComplete: true}
+		for sub := val[5:]; len(sub) >= 3; {
+			st, sn := sub[0], int(binary.BigEndian.Uint16(sub[1:]))
+			if len(sub) < 3+sn {
+				break
+			}
+			// PP2_SUBTYPE_SSL_VERSION, such as "TLSv1.3".
+			if st == 0x21 {
+				cs.Version = tlsVersions[string(sub[3:3+sn])]
+			}
+			sub = sub[3+sn:]
+		}
+		s.proxyTLS = cs
+	}
+	return nil
+}
+
+// tlsVersions maps the TLS version names proxies report to their
+// values.
+var tlsVersions = map[string]uint16{
+	"TLSv1":   tls.VersionTLS10,
+	"TLSv1.1": tls.VersionTLS11,
+	"TLSv1.2": tls.VersionTLS12,
+	"TLSv1.3": tls.VersionTLS13,
+}
+
+// fromTrustedProxy reports whether the session's peer, the proxy
+// itself rather than the client it reports, is in TrustedProxies.
+func (s *session) fromTrustedProxy() bool {
+	addr, ok := s.rwc.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range s.srv.TrustedProxies {
+		if n.Contains(addr.IP) {
+			return true
+		}
+	}
+	return false
+}
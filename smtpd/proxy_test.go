@@ -0,0 +1,132 @@
+package smtpd
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// proxyServer starts a ProxyProtocol server and returns its address
+// and a channel receiving each session's Connection.Addr.
+func proxyServer(t *testing.T, srv *Server) (string, chan net.Addr) {
+	addrs := make(chan net.Addr, 1)
+	srv.ProxyProtocol = true
+	srv.OnNewConnection = func(c Connection) error {
+		addrs <- c.Addr()
+		return nil
+	}
+	return testServer(t, srv), addrs
+}
+
+// dialProxy connects to addr and sends hdr ahead of the SMTP stream.
+func dialProxy(t *testing.T, addr string, hdr []byte) *testClient {
+	t.Helper()
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	tc := &testClient{t: t, c: c, br: bufio.NewReader(c)}
+	tc.send(string(hdr))
+	return tc
+}
+
+func TestProxyHeader(t *testing.T) {
+	addr, addrs := proxyServer(t, &Server{})
+	for _, tt := range []struct {
+		name string
+		hdr  []byte
+		want string
+	}{
+		{"v1 TCP4", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 25\r\n"), "192.0.2.1:56324"},
+		{"v1 TCP6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 25\r\n"), "[2001:db8::1]:56324"},
+		{"v2 IPv4", []byte("\r\n\r\n\x00\r\nQUIT\n" +
+			"\x21\x11\x00\x0c" +
+			"\xc0\x00\x02\x01" + "\xc6\x33\x64\x01" +
+			"\xdc\x04" + "\x00\x19"), "192.0.2.1:56324"},
+		{"v2 IPv6", []byte("\r\n\r\n\x00\r\nQUIT\n" +
+			"\x21\x21\x00\x24" +
+			"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01" +
+			"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02" +
+			"\xdc\x04" + "\x00\x19"), "[2001:db8::1]:56324"},
+	} {
+		c := dialProxy(t, addr, tt.hdr)
+		c.expect("", "220 ")
+		if got := (<-addrs).String(); got != tt.want {
+			t.Errorf("%s: Addr = %s, want %s", tt.name, got, tt.want)
+		}
+		c.expect("QUIT", "221")
+	}
+	c := dialProxy(t, addr, []byte("EHLO client.test\r\n"))
+	c.closed()
+}
+
+func TestProxyHeaderTimeout(t *testing.T) {
+	// No CommandTimeout: the wait for the header must still end.
+	addr, _ := proxyServer(t, &Server{FirstCommandTimeout: 50 * time.Millisecond})
+	c := dialProxy(t, addr, nil)
+	start := time.Now()
+	c.closed()
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("connection closed after %v, want about 50ms", d)
+	}
+}
+
+// proxyV2TLS is a PROXY v2 header for a client at 192.0.2.1:56324
+// that connected to the proxy over TLS 1.3.
+var proxyV2TLS = []byte("\r\n\r\n\x00\r\nQUIT\n" +
+	"\x21\x11\x00\x1e" +
+	"\xc0\x00\x02\x01" + "\xc6\x33\x64\x01" + "\xdc\x04" + "\x00\x19" +
+	// PP2_TYPE_SSL: client SSL, verified, PP2_SUBTYPE_SSL_VERSION.
+	"\x20\x00\x0f" + "\x01" + "\x00\x00\x00\x00" + "\x21\x00\x07TLSv1.3")
+
+func TestProxyTLS(t *testing.T) {
+	mustNet := func(s string) *net.IPNet {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	for _, trusted := range []bool{true, false} {
+		proxies := []*net.IPNet{mustNet("192.0.2.0/24")}
+		if trusted {
+			proxies = append(proxies, mustNet("127.0.0.0/8"))
+		}
+		states := make(chan tls.ConnectionState, 1)
+		addr := testServer(t, &Server{
+			ProxyProtocol:       true,
+			TrustedProxies:      proxies,
+			TLSConfig:           serverTLSConfig(t),
+			RequireTLSExtension: true,
+			PlainAuth:           true,
+			OnAuth:              func(c Connection, user, pass string) error { return nil },
+			OnNewMail: func(c Connection, from MailAddress) (Envelope, error) {
+				cs, _ := c.TLSState()
+				states <- cs
+				return new(BasicEnvelope), nil
+			},
+		})
+		c := dialProxy(t, addr, proxyV2TLS)
+		c.expect("", "220 ")
+		ehlo := c.expect("EHLO client.test", "250")
+		if trusted {
+			if strings.Contains(ehlo, "STARTTLS") || !strings.Contains(ehlo, "REQUIRETLS") {
+				t.Errorf("trusted proxy: EHLO reply\n%s", ehlo)
+			}
+			c.expect("AUTH PLAIN AHVzZXIAcGFzcw==", "235")
+			c.expect("MAIL FROM:<a@b.test> REQUIRETLS", "250")
+			if cs := <-states; cs.Version != tls.VersionTLS13 || !cs.HandshakeComplete {
+				t.Errorf("TLSState = version %x, complete %v; want TLS 1.3", cs.Version, cs.HandshakeComplete)
+			}
+		} else {
+			if !strings.Contains(ehlo, "STARTTLS") {
+				t.Errorf("untrusted proxy: EHLO reply\n%s", ehlo)
+			}
+			c.expect("AUTH PLAIN AHVzZXIAcGFzcw==", "538")
+		}
+	}
+}
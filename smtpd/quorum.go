@@ -0,0 +1,101 @@
+package smtpd
+
+import "strings"
+
+var errNoQuorum = SMTPError("451 4.3.0 Error: too few backends stored the message")
+
+// QuorumEnvelope is an Envelope that passes the transaction to each of
+// its Envelopes, typically independent stores, and accepts the message
+// only once at least Quorum of them have stored it. An Envelope that
+// fails is left out from then on, and rolled back if it's a
+// TxEnvelope; the transaction fails as soon as fewer than Quorum are
+// left, with the error that made it so if that's an SMTPError, else
+// with a 451.
+//
+// A recipient rejected with a permanent (5xx) SMTPError by any
+// Envelope still in the transaction is rejected, and nobody is left
+// out, since the recipient is at fault rather than the store; other
+// AddRecipient errors count as failures.
+type QuorumEnvelope struct {
+	Envelopes []Envelope
+
+	// Quorum is how many of the Envelopes must store the message. If
+	// it's zero, or more than there are Envelopes, all of them must.
+	Quorum int
+
+	fan fanout
+}
+
+// quorum returns how many Envelopes must stay in the transaction.
+func (q *QuorumEnvelope) quorum() int {
+	if q.Quorum <= 0 || q.Quorum > len(q.Envelopes) {
+		return len(q.Envelopes)
+	}
+	return q.Quorum
+}
+
+// each calls fn on each Envelope still in the transaction, leaving
+// out those it fails for, and returns the error that fails the
+// transaction, if any.
+func (q *QuorumEnvelope) each(fn func(i int, e Envelope) error) error {
+	var first error
+	left, _ := q.fan.each("QuorumEnvelope", q.Envelopes, fn, func(_ int, err error) bool {
+		if first == nil {
+			first = err
+		}
+		return true
+	})
+	if left >= q.quorum() {
+		return nil
+	}
+	if se, ok := first.(SMTPError); ok {
+		return se
+	}
+	return errNoQuorum
+}
+
+func (q *QuorumEnvelope) AddRecipient(rcpt MailAddress) error {
+	var rejected error
+	err := q.each(func(_ int, e Envelope) error {
+		err := e.AddRecipient(rcpt)
+		if se, ok := err.(SMTPError); ok && strings.HasPrefix(string(se), "5") {
+			if rejected == nil {
+				rejected = se
+			}
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return rejected
+}
+
+func (q *QuorumEnvelope) BeginData() error {
+	return q.each(func(_ int, e Envelope) error { return e.BeginData() })
+}
+
+func (q *QuorumEnvelope) Write(line []byte) error {
+	return q.each(func(_ int, e Envelope) error { return e.Write(line) })
+}
+
+// Close closes each Envelope still in the transaction. One that isn't
+// a TxEnvelope has stored the message if its Close succeeds.
+func (q *QuorumEnvelope) Close() error {
+	return q.each(func(_ int, e Envelope) error { return e.Close() })
+}
+
+// Commit commits each Envelope still in the transaction that's a
+// TxEnvelope. Those that commit stay committed even if too many others
+// fail and the client is told to retry, so the backends should
+// tolerate receiving the message again.
+func (q *QuorumEnvelope) Commit() error {
+	return q.each(q.fan.commit)
+}
+
+// Rollback rolls back each Envelope still in the transaction that
+// hasn't been committed.
+func (q *QuorumEnvelope) Rollback() {
+	q.fan.rollback(q.Envelopes)
+}
@@ -0,0 +1,112 @@
+package smtpd
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestQuorumEnvelope(t *testing.T) {
+	errDisk := errors.New("disk full")
+	errBusy := SMTPError("450 4.2.1 Mailbox busy")
+	for _, tt := range []struct {
+		name     string
+		quorum   int
+		failing  backend // how the third backend fails
+		rcptErrs []error
+		err      error
+		states   [3]string
+	}{
+		{
+			name: "write fails, 2 of 3", quorum: 2, failing: backend{failWrite: errDisk},
+			rcptErrs: []error{nil, nil},
+			states:   [3]string{"committed", "committed", "rolled back"},
+		},
+		{
+			name: "write fails, 3 of 3", quorum: 3, failing: backend{failWrite: errDisk},
+			rcptErrs: []error{nil, nil}, err: errNoQuorum,
+			states: [3]string{"rolled back", "rolled back", "rolled back"},
+		},
+		{
+			name: "recipient rejected, 3 of 3", quorum: 3,
+			failing:  backend{reject: map[string]error{"b@x.test": errNoSuchUser}},
+			rcptErrs: []error{nil, errNoSuchUser},
+			states:   [3]string{"committed", "committed", "committed"},
+		},
+		{
+			name: "recipient deferred, 2 of 3", quorum: 2,
+			failing:  backend{reject: map[string]error{"b@x.test": errBusy}},
+			rcptErrs: []error{nil, nil},
+			states:   [3]string{"committed", "committed", "rolled back"},
+		},
+		{
+			name: "recipient deferred, 3 of 3", quorum: 3,
+			failing:  backend{reject: map[string]error{"b@x.test": errBusy}},
+			rcptErrs: []error{nil, errBusy}, err: errNoQuorum,
+			states: [3]string{"rolled back", "rolled back", "rolled back"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			bs := [3]*backend{new(backend), new(backend), &tt.failing}
+			q := &QuorumEnvelope{Envelopes: []Envelope{bs[0], bs[1], bs[2]}, Quorum: tt.quorum}
+			rcptErrs, err := runTx(q, "a@x.test", "b@x.test")
+			for i, want := range tt.rcptErrs {
+				if rcptErrs[i] != want {
+					t.Errorf("recipient %d: error %v, want %v", i, rcptErrs[i], want)
+				}
+			}
+			if err != tt.err {
+				t.Errorf("transaction error %v, want %v", err, tt.err)
+			}
+			for i, b := range bs {
+				if b.state != tt.states[i] {
+					t.Errorf("backend %d %s, want %s", i, b.state, tt.states[i])
+				}
+			}
+			for i, b := range bs[:2] {
+				if got := b.rcpts(); got != "a@x.test b@x.test" {
+					t.Errorf("backend %d has recipients %q, want both", i, got)
+				}
+			}
+		})
+	}
+}
+
+func TestQuorumEnvelopeDefault(t *testing.T) {
+	// Without a Quorum, every Envelope must store the message.
+	bs := []*backend{new(backend), {failWrite: SMTPError("452 4.3.1 Insufficient system storage")}}
+	q := &QuorumEnvelope{Envelopes: []Envelope{bs[0], bs[1]}}
+	if _, err := runTx(q, "a@x.test"); err != SMTPError("452 4.3.1 Insufficient system storage") {
+		t.Errorf("got %v, want the failing Envelope's SMTPError", err)
+	}
+	if bs[0].state != "rolled back" {
+		t.Errorf("healthy backend %s, want rolled back", bs[0].state)
+	}
+}
+
+func TestQuorumEnvelopeUnknownRecipient(t *testing.T) {
+	// An unknown recipient is rejected without costing the quorum, so
+	// the rest of the transaction goes on.
+	var bs [3]*backend
+	addr := testServer(t, &Server{
+		OnNewMail: func(c Connection, from MailAddress) (Envelope, error) {
+			q := &QuorumEnvelope{Quorum: 2}
+			for i := range bs {
+				bs[i] = &backend{reject: map[string]error{"x@d.test": errNoSuchUser}}
+				q.Envelopes = append(q.Envelopes, bs[i])
+			}
+			return q, nil
+		},
+	})
+	c := dialTest(t, addr)
+	c.expect("EHLO client.test", "250")
+	c.expect("MAIL FROM:<a@b.test>", "250")
+	c.expect("RCPT TO:<x@d.test>", "550 5.1.1")
+	c.expect("RCPT TO:<c@d.test>", "250")
+	c.expect("DATA", "354")
+	c.expect("Subject: hi\r\n\r\nbody\r\n.", "250")
+	for i, b := range bs {
+		if b.state != "committed" || b.rcpts() != "c@d.test" {
+			t.Errorf("backend %d %s for %q, want committed for c@d.test", i, b.state, b.rcpts())
+		}
+	}
+}
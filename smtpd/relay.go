@@ -0,0 +1,60 @@
+package smtpd
+
+import (
+	"net"
+	"strings"
+)
+
+var errRelayDenied = SMTPError("550 5.7.1 Relay access denied")
+
+// isLocalDomain reports whether mail for domain is accepted per
+// srv.LocalDomains. Matching is case-insensitive; an entry of the form
+// "*.example.com" matches any subdomain of example.com.
+func (srv *Server) isLocalDomain(domain string) bool {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	for _, d := range srv.LocalDomains {
+		d = strings.ToLower(d)
+		if strings.HasPrefix(d, "*.") {
+			if strings.HasSuffix(domain, d[1:]) {
+				return true
+			}
+			continue
+		}
+		if domain == d {
+			return true
+		}
+	}
+	return false
+}
+
+// isTrusted reports whether the session's client is in srv.TrustedNets,
+// and so exempt from the server's policy checks.
+func (s *session) isTrusted() bool {
+	if len(s.srv.TrustedNets) == 0 {
+		return false
+	}
+	ip := net.ParseIP(s.remoteIP())
+	if ip == nil {
+		return false
+	}
+	for _, n := range s.srv.TrustedNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkRelay returns errRelayDenied if the session may not send mail
+// to rcpt. A recipient without a domain, such as "<Postmaster>", names
+// a local mailbox, so it's never relaying.
+func (s *session) checkRelay(rcpt MailAddress) error {
+	if len(s.srv.LocalDomains) == 0 && len(s.srv.TrustedNets) == 0 {
+		return nil
+	}
+	host := rcpt.Hostname()
+	if host == "" || s.authUser != "" || s.srv.isLocalDomain(host) || s.isTrusted() {
+		return nil
+	}
+	return errRelayDenied
+}
@@ -0,0 +1,146 @@
+package smtpd
+
+import (
+	"encoding/base64"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestIsLocalDomain(t *testing.T) {
+	srv := &Server{LocalDomains: []string{"Example.COM", "*.example.net"}}
+	for domain, want := range map[string]bool{
+		"example.com":      true,
+		"EXAMPLE.com.":     true,
+		"mail.example.net": true,
+		"a.b.example.net":  true,
+		"example.net":      false,
+		"badexample.net":   false,
+		"example.org":      false,
+		"":                 false,
+	} {
+		if got := srv.isLocalDomain(domain); got != want {
+			t.Errorf("isLocalDomain(%q) = %v, want %v", domain, got, want)
+		}
+	}
+}
+
+func TestLocalDomains(t *testing.T) {
+	addr := testServer(t, &Server{
+		LocalDomains: []string{"example.com", "*.example.net"},
+		PlainAuth:    true,
+		OnAuth:       func(c Connection, user, pass string) error { return nil },
+	})
+	c := dialTest(t, addr)
+	c.expect("EHLO client.test", "250")
+	c.expect("MAIL FROM:<a@elsewhere.test>", "250")
+	c.expect("RCPT TO:<b@EXAMPLE.com>", "250")
+	c.expect("RCPT TO:<b@mx.example.net>", "250")
+	c.expect("RCPT TO:<b@elsewhere.test>", "550 5.7.1 Relay access denied")
+	c.expect("RSET", "250")
+	c.expect("AUTH PLAIN "+base64.StdEncoding.EncodeToString([]byte("\x00user\x00pass")), "235")
+	c.expect("MAIL FROM:<user@example.com>", "250")
+	c.expect("RCPT TO:<b@elsewhere.test>", "250")
+}
+
+func TestRelayDefault(t *testing.T) {
+	mustNet := func(s string) *net.IPNet {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	for _, tt := range []struct {
+		name string
+		srv  *Server
+		want string
+	}{
+		{"unconfigured", &Server{}, "250"},
+		{"untrusted client", &Server{TrustedNets: []*net.IPNet{mustNet("192.0.2.0/24")}}, "550 5.7.1 Relay access denied"},
+		{"trusted client", &Server{TrustedNets: []*net.IPNet{mustNet("127.0.0.0/8")}}, "250"},
+		{"foreign domain", &Server{LocalDomains: []string{"example.com"}}, "550 5.7.1 Relay access denied"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c := dialTest(t, testServer(t, tt.srv))
+			c.expect("EHLO client.test", "250")
+			c.expect("MAIL FROM:<a@example.com>", "250")
+			c.expect("RCPT TO:<b@elsewhere.test>", tt.want)
+		})
+	}
+}
+
+func TestTrustedNets(t *testing.T) {
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	_, other, _ := net.ParseCIDR("192.0.2.0/24")
+	for _, tt := range []struct {
+		name      string
+		srv       func() *Server
+		rcpt      string
+		untrusted string // the reply an untrusted client gets
+	}{
+		{"relay", func() *Server {
+			return &Server{LocalDomains: []string{"example.com"}}
+		}, "b@elsewhere.test", "550 5.7.1 Relay access denied"},
+		{"greylist", func() *Server {
+			return &Server{
+				LocalDomains: []string{"example.com"},
+				Greylist:     &Greylister{Store: mapGreylistStore{}},
+			}
+		}, "b@example.com", "451 4.7.1 Greylisted"},
+		{"fcrdns", func() *Server {
+			return &Server{
+				LocalDomains:  []string{"example.com"},
+				RequireFcrDNS: true,
+				Resolver:      new(fakeResolver),
+			}
+		}, "b@example.com", "550 5.7.25"},
+	} {
+		for _, trusted := range []bool{true, false} {
+			srv := tt.srv()
+			srv.TrustedNets = []*net.IPNet{other}
+			want := tt.untrusted
+			if trusted {
+				srv.TrustedNets = append(srv.TrustedNets, loopback)
+				want = "250"
+			}
+			c := dialTest(t, testServer(t, srv))
+			c.expect("EHLO client.test", "250")
+			got := c.cmd("MAIL FROM:<a@example.com>")
+			if strings.HasPrefix(got, "250") {
+				got = c.cmd("RCPT TO:<" + tt.rcpt + ">")
+			}
+			if !strings.HasPrefix(got, want) {
+				t.Errorf("%s, trusted %v: got %q, want %q", tt.name, trusted, got, want)
+			}
+		}
+	}
+}
+
+func TestBareRecipients(t *testing.T) {
+	_, other, _ := net.ParseCIDR("192.0.2.0/24")
+	for _, reject := range []bool{false, true} {
+		c := dialTest(t, testServer(t, &Server{
+			LocalDomains:         []string{"example.com"},
+			TrustedNets:          []*net.IPNet{other},
+			RejectBareRecipients: reject,
+		}))
+		c.expect("EHLO client.test", "250")
+		c.expect("MAIL FROM:<a@example.net>", "250")
+		bob := "250"
+		if reject {
+			bob = "501 5.1.3 Bad recipient address"
+		}
+		for _, tt := range []struct{ rcpt, want string }{
+			{"postmaster", "250"},
+			{"Postmaster", "250"},
+			{"bob", bob},
+			{"bob@example.com", "250"},
+			{"bob@elsewhere.test", "550 5.7.1 Relay access denied"},
+		} {
+			if got := c.cmd("RCPT TO:<" + tt.rcpt + ">"); !strings.HasPrefix(got, tt.want) {
+				t.Errorf("RejectBareRecipients %v: RCPT TO:<%s>: got %q, want %q", reject, tt.rcpt, got, tt.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,4 @@
+package smtpd
+
+// soReusePort is SO_REUSEPORT, which package syscall lacks on Linux.
+const soReusePort = 0xf
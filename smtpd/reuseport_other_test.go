@@ -0,0 +1,8 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package smtpd
+
+import "syscall"
+
+// reusePort is nil where the syscall package has no SO_REUSEPORT.
+var reusePort func(network, address string, c syscall.RawConn) error
@@ -0,0 +1,18 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package smtpd
+
+import "syscall"
+
+// reusePort is a net.ListenConfig Control func setting SO_REUSEPORT,
+// so that Server.Listeners can open several listeners on one port.
+var reusePort = func(network, address string, c syscall.RawConn) error {
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
@@ -1,29 +1,34 @@
 // Package smtpd implements an SMTP server. Hooks are provided to customize
 // its behavior.
-package smtpd
-
-// TODO:
-//  -- send 421 to connected clients on graceful server shutdown (s3.8)
 //
+// Clients that greet with HELO rather than EHLO, as RFC 821 ones do,
+// are served as plain SMTP clients: the greeting gets a single-line
+// reply listing no extensions, replies carry no enhanced status codes,
+// and nothing depends on pipelining, so MAIL, RCPT and DATA sent one
+// at a time, each waiting for its reply, work as they always have.
+package smtpd
 
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"os"
 	"os/exec"
-	"regexp"
+	"runtime/debug"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 	"unicode"
-)
-
-var (
-	rcptToRE = regexp.MustCompile(`[Tt][Oo]:<(.+)>`)
-	//mailFromRE = regexp.MustCompile(`(?i)^from:\s*<(.*?)>`)
-	mailFromRE = regexp.MustCompile(`[Ff][Rr][Oo][Mm]:<(.*)>`)
+	"unicode/utf8"
 )
 
 // Server is an SMTP server.
@@ -31,22 +36,484 @@ type Server struct {
 	Addr         string        // TCP address to listen on, ":25" if empty
 	Hostname     string        // optional Hostname to announce; "" to use system hostname
 	ReadTimeout  time.Duration // optional read timeout
-	WriteTimeout time.Duration // optional write timeout
+	WriteTimeout time.Duration // optional timeout for writing each reply
+
+	// CommandTimeout and DataTimeout, if non-zero, override
+	// ReadTimeout for reading each command line and each piece of
+	// message data, respectively. A client that stalls while sending
+	// a message gets "451 4.4.2 Timeout waiting for end of data".
+	// The command timeout restarts with every command, so a client can
+	// keep an idle session open with NOOP; to act on that, such as to
+	// track live sessions, register a NOOP handler with Handle.
+	CommandTimeout time.Duration
+	DataTimeout    time.Duration
+
+	// FirstCommandTimeout, if non-zero, is how long a client has to
+	// send its first command after the greeting. It defaults to the
+	// command timeout, or 5 minutes if there is none, so a client that
+	// connects and idles can't hold a session forever. A client that
+	// times out waiting to send a command gets "421 4.4.2 Timeout".
+	// With ProxyProtocol, it also bounds the wait for the PROXY header.
+	FirstCommandTimeout time.Duration
+
+	// AuthTimeout, if non-zero, is how long a client has to answer
+	// each AUTH challenge, in place of the command timeout, so a
+	// client can't stall part way through an exchange. A client that
+	// times out gets "421 4.4.2 Timeout".
+	AuthTimeout time.Duration
+
+	// MaxMessageSize, if positive, is the maximum size of a message
+	// body in bytes. It's advertised via SIZE and enforced while
+	// reading DATA whether or not the client declared a size.
+	MaxMessageSize int64
+
+	// EffectiveSize, if non-nil, is called on a MAIL FROM with a SIZE
+	// parameter to compute the size checked against MaxMessageSize,
+	// given the declared size and BODY type ("7BIT", "8BITMIME" or
+	// "BINARYMIME"). A relay that downgrades 8BITMIME to a 7-bit
+	// transfer encoding can return the size after encoding, which may
+	// be up to a third larger for base64 or three times larger for
+	// quoted-printable. By default the declared size is used. Both are
+	// available from Connection.DeclaredSize.
+	EffectiveSize func(c Connection, declared int64, body string) int64
+
+	// MaxBodyLines, if positive, is the maximum number of lines in a
+	// message sent with DATA.
+	MaxBodyLines int
+
+	// MaxBytesPerConnection, if positive, caps the message data
+	// accepted over one connection, across all its transactions. Once
+	// it's exceeded the client gets a 421 and is disconnected.
+	MaxBytesPerConnection int64
+
+	// MaxMessagesPerConnection, if positive, caps the messages
+	// accepted over one connection. A MAIL FROM beyond it gets "421
+	// 4.7.0 Too many messages, reconnect" and the connection is
+	// closed, so a client with a long queue reconnects and takes its
+	// turn with the others rather than holding on to a session.
+	MaxMessagesPerConnection int
+
+	// MaxDrainBytes is how much more of a message rejected during DATA
+	// (for being too large, say) is read while looking for the
+	// terminating dot, so the connection stays usable. A client that
+	// sends more is disconnected. If zero, 1MB is used; if negative,
+	// the client is disconnected as soon as the message is rejected.
+	MaxDrainBytes int64
+
+	// MaxConcurrentData, if positive, limits how many sessions may
+	// be receiving a message, with DATA or BDAT, at once, to protect
+	// the store behind the Envelopes. A session over the limit waits
+	// briefly for another to finish, then gets "451 4.3.2 Too busy,
+	// try later".
+	MaxConcurrentData int
+
+	// MaxNullSenderRecipients, if positive, limits the recipients of a
+	// message from the null sender ("MAIL FROM:<>"). Real bounces have
+	// one; backscatter floods often have many.
+	MaxNullSenderRecipients int
+
+	// RejectBareRecipients, if set, rejects RCPT TO addresses with no
+	// domain, such as "<bob>", with "501 5.1.3 Bad recipient
+	// address", as suits an MX. Otherwise they're accepted, as local
+	// submission may want. "<Postmaster>" is accepted either way
+	// (RFC 5321 s4.5.1).
+	RejectBareRecipients bool
+
+	// MaxSessionsPerUser, if positive, limits how many sessions may be
+	// authenticated as the same user at once, to curb shared
+	// credentials. An AUTH beyond the limit succeeds as far as the
+	// credentials go, but the client gets "421 4.7.0 Too many
+	// concurrent sessions" and is disconnected.
+	MaxSessionsPerUser int
+
+	// MaxAuthAttempts, if positive, limits the failed AUTH commands
+	// allowed in a session, against password guessing: the one that
+	// reaches the limit gets "421 4.7.0 Too many authentication
+	// failures" and the connection is closed.
+	MaxAuthAttempts int
+
+	// AuthFailureDelay, if non-zero, is waited before replying to an
+	// AUTH command whose credentials were rejected, to slow guessing.
+	AuthFailureDelay time.Duration
+
+	// NormalizeLineEndings, if set, converts the CRLF ending each
+	// line of a message sent with DATA to a bare LF before passing it
+	// to Envelope.Write. The end of data is still detected on the
+	// CRLF.CRLF sent on the wire.
+	NormalizeLineEndings bool
+
+	// AllowBareLF, if set, accepts lines ending in a bare LF, as
+	// typed into telnet or netcat, treating them as if they ended in
+	// CRLF, in commands and in DATA, where ".\n" then ends the
+	// message. It's for poking the server by hand: a bare LF isn't a
+	// line ending in SMTP (RFC 5321 s2.3.8), and servers disagreeing
+	// about it is what SMTP smuggling exploits, so leave it unset on
+	// servers that take mail from the Internet. BDAT chunks are never
+	// changed.
+	AllowBareLF bool
+
+	// AddReceived, if set, prepends a Received trace header field to
+	// each message.
+	AddReceived bool
+
+	// GenerateMessageID, if set, adds a Message-ID header field to
+	// messages sent with DATA that don't have one, at the end of their
+	// header. The ID's domain is MessageIDDomain, or the Hostname if
+	// that's empty.
+	GenerateMessageID bool
+	MessageIDDomain   string
+
+	// GenerateID, if non-nil, returns the queue ID of each new
+	// transaction, for example to match the IDs of the queue behind
+	// the Envelopes. It's called once OnNewMail has accepted the
+	// sender. The ID appears in the Received header field, the
+	// AccessLog and the final "250 2.0.0 Ok: queued as" reply, so it
+	// must be printable ASCII without spaces; other IDs are replaced
+	// with the default, random hex digits.
+	GenerateID func(c Connection) string
+
+	// RejectEarlyData, if set, rejects a DATA command and closes the
+	// connection if message data follows it before the 354 reply has
+	// been sent. RFC 2920 requires even pipelining clients to wait for
+	// 354, so mostly spam tools and smuggling attempts trip it, but
+	// some broken clients that stream DATA and the body together do
+	// too; leave it unset if they must be served. The check only sees
+	// input already read from the network, so it can miss data still
+	// in flight.
+	RejectEarlyData bool
+
+	// TLSConfig, if non-nil, enables STARTTLS. To serve implicit TLS
+	// instead, pass Serve a listener from tls.NewListener.
+	TLSConfig *tls.Config
+
+	// PlainAuth and LoginAuth enable the PLAIN and LOGIN AUTH
+	// mechanisms, checked by OnAuth. As both send passwords in the
+	// clear, they're only offered over TLS when TLSConfig is set.
+	PlainAuth bool
+	LoginAuth bool
+
+	// CRAMMD5Secret, if non-nil, enables the CRAM-MD5 AUTH mechanism.
+	// It returns the shared secret for user, or an error to reject the
+	// authentication.
+	CRAMMD5Secret func(c Connection, user string) (secret string, err error)
+
+	Chunking   bool // advertise CHUNKING and accept BDAT (RFC 3030)
+	BinaryMIME bool // advertise BINARYMIME; requires Chunking
+
+	// SMTPUTF8 advertises SMTPUTF8 (RFC 6531). Addresses and the
+	// headers of messages sent with DATA are then checked: they must
+	// be valid UTF-8 in transactions declaring SMTPUTF8, and ASCII in
+	// others.
+	SMTPUTF8 bool
 
-	PlainAuth bool // advertise plain auth (assumes you're on SSL)
+	// RequireTLSExtension advertises REQUIRETLS (RFC 8689) on
+	// encrypted sessions, letting senders ask that their message only
+	// travel over TLS. A MAIL FROM with the REQUIRETLS parameter is
+	// rejected on an unencrypted session; otherwise
+	// Connection.RequireTLS reports it, and whatever relays the
+	// message on must then insist on TLS or bounce it.
+	RequireTLSExtension bool
+
+	// AccessLog, if non-nil, receives a record for each mail
+	// transaction, formatted per AccessLogFormat.
+	AccessLog       io.Writer
+	AccessLogFormat LogFormat
+
+	// UnrecognizedReply is the reply sent to unknown commands.
+	// If empty, "502 5.5.2 Error: command not recognized" is used.
+	UnrecognizedReply string
+
+	// RejectionBackoff, if non-nil, slows down and eventually
+	// disconnects clients whose commands keep being rejected, such as
+	// by trying many unknown recipients. Every 4xx or 5xx reply
+	// counts, including those for greylisting.
+	RejectionBackoff *Backoff
+
+	// ConnectionBurstLimit, if non-nil, slows down or refuses clients
+	// opening many connections in a short time.
+	ConnectionBurstLimit *BurstLimit
+
+	// QuitMessage, if non-empty, replaces the text of the "221 2.0.0
+	// Bye" reply to QUIT, such as "2.0.0 Thanks for stopping by".
+	// Lines separated by "\n" are sent as a multiline reply. A message
+	// with other control characters or non-ASCII text is ignored, so
+	// it can't inject replies.
+	QuitMessage string
+
+	// DisabledVerbs lists commands, such as "VRFY" or "ETRN", that
+	// are answered with "502 5.5.1 Command disabled" whatever their
+	// handler. STARTTLS, AUTH and BDAT also stop being advertised.
+	DisabledVerbs []string
+
+	// Help, if non-nil, adds to or replaces the syntax "HELP verb"
+	// gives for commands, keyed by upper-case verb, such as for those
+	// registered with Handle. An empty text removes a built-in
+	// command's help. Lines separated by "\n" are sent as a multiline
+	// reply.
+	Help map[string]string
+
+	// DebugTranscript, if non-nil, receives the commands, message data
+	// and replies exchanged with clients, a line at a time, prefixed
+	// with "C: " or "S: " respectively. AUTH responses are redacted.
+	// The PROXY header and whatever a Handle handler reads after
+	// taking over the connection with Streamer aren't included.
+	DebugTranscript io.Writer
+
+	// LocalDomains lists the recipient domains mail is accepted for.
+	// Entries like "*.example.com" match subdomains. TrustedNets lists
+	// client networks that may relay anywhere.
+	//
+	// If either is set, mail to other domains is rejected as relaying
+	// unless the client is in TrustedNets. Recipients with no domain,
+	// such as "<Postmaster>", are local and pass; see
+	// RejectBareRecipients. If neither is set, no relay check is done
+	// and every recipient is passed to the Envelope.
+	//
+	// Clients in TrustedNets, such as internal hosts relaying through
+	// the server, also skip the DNSBLs, RequireFcrDNS,
+	// VerifyRecipientDomain, Greylist, RejectionBackoff and
+	// ConnectionBurstLimit policies.
+	LocalDomains []string
+	TrustedNets  []*net.IPNet
+
+	// Greylist, if non-nil, defers recipients of first-time
+	// (client IP, sender, recipient) triplets.
+	Greylist *Greylister
+
+	// ListenConfig, if non-nil, is used by ListenAndServe to create
+	// its listeners. Listeners, if more than one, is how many listeners
+	// ListenAndServe opens on Addr, each with its own accept loop, to
+	// spread a high connection rate across cores. The extra listeners
+	// need SO_REUSEPORT, set from ListenConfig.Control:
+	//
+	//	Control: func(network, address string, c syscall.RawConn) error {
+	//		var serr error
+	//		err := c.Control(func(fd uintptr) {
+	//			serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	//		})
+	//		if err != nil {
+	//			return err
+	//		}
+	//		return serr
+	//	},
+	//
+	// The same Control lets several processes share the port. Addr
+	// must name a fixed port.
+	ListenConfig *net.ListenConfig
+	Listeners    int
+
+	// ProxyProtocol, if true, requires each connection to begin with a
+	// HAProxy PROXY protocol header, v1 (text) or v2 (binary), and
+	// reports the client address it carries from Connection.Addr.
+	// Only enable it behind a proxy: any host that can connect
+	// directly can claim any address.
+	ProxyProtocol bool
+
+	// TrustedProxies lists the proxies, by their own address, whose
+	// PROXY v2 headers are believed about TLS: when such a header says
+	// the client connected to the proxy over TLS, the session counts
+	// as encrypted, and Connection.TLSState reports the TLS version the
+	// proxy gave. This lets a frontend terminate TLS.
+	TrustedProxies []*net.IPNet
+
+	// RequireFcrDNS, if set, rejects mail from clients without
+	// forward-confirmed reverse DNS: the client's IP must have a PTR
+	// name that resolves back to it. Lookups use Resolver, or the
+	// system resolver if it's nil, and each is bounded by DNSTimeout,
+	// or 10 seconds if that's zero. A failed lookup other than a
+	// missing record gets a temporary rejection.
+	RequireFcrDNS bool
+	Resolver      Resolver
+	DNSTimeout    time.Duration
+
+	// DNSBLs lists DNS blocklist zones, such as "zen.spamhaus.org",
+	// to look each client up in on connection (RFC 5782). A listed
+	// client is rejected with "554 5.7.1 Client host blocked (listed
+	// in zone)", unless DNSBLListed decides otherwise. Lookups are
+	// made as for RequireFcrDNS, and their answers kept for a few
+	// minutes; a failed one is logged and the client let through.
+	DNSBLs []string
+
+	// DNSBLListed, if non-nil, is called when the client is listed in
+	// zone, with the addresses the zone returned, such as
+	// "127.0.0.2". It returns nil to go on with the connection or the
+	// error to reject it with.
+	DNSBLListed func(c Connection, zone string, addrs []string) error
+
+	// VerifyRecipientDomain, if set, temporarily rejects recipients
+	// whose domain has no MX or address records, or whose lookup
+	// fails, with "450 4.1.2 Domain not found". Lookups are made as
+	// for RequireFcrDNS and their results kept for the connection.
+	VerifyRecipientDomain bool
+
+	// StrictHello, if set, rejects HELO and EHLO arguments that
+	// aren't a valid domain name or address literal. Many clients
+	// send junk, such as a bare hostname with an underscore, so it's
+	// off by default; a missing argument is always rejected. Arguments
+	// with control characters or non-ASCII bytes get "501 5.5.4
+	// Invalid HELO argument"; with SMTPUTF8, UTF-8 domain names are
+	// allowed.
+	StrictHello bool
+
+	// Extensions, if non-nil, is called on each EHLO with the
+	// extensions the server would advertise, such as "PIPELINING" and
+	// "SIZE 10240000", and returns those to advertise instead. It lets
+	// the list depend on the client, for example offering AUTH only on
+	// the submission port. It only changes what's advertised: to
+	// refuse an extension's commands, use OnHello, Handle or the
+	// extension's own settings.
+	Extensions func(c Connection, extensions []string) []string
+
+	// StatusCodes, if non-nil, replaces some of the server's replies.
+	// It maps the name of a situation to the full reply to send in it,
+	// such as "554 5.7.1 Relaying denied" for "relay_denied". The
+	// names are auth_failed, bad_address_syntax, bare_recipient,
+	// client_cert_required, command_timeout, connection_burst,
+	// connection_byte_limit, declared_size_too_large, defer_all,
+	// domain_not_found, duplicate_parameter, early_data, greylisted,
+	// invalid_hello, invalid_hello_argument, invalid_utf8,
+	// message_too_large, no_recipients, non_ascii_address,
+	// non_ascii_header, relay_denied, shutting_down, too_busy,
+	// too_many_auth_failures, too_many_bounce_recipients,
+	// too_many_errors, too_many_lines, too_many_messages,
+	// too_many_sessions and user_unknown (ErrUserUnknown, which is
+	// also sent for a recipient rejected by OnRcpt or AddRecipient
+	// with an error that isn't an SMTPError).
+	// Situations not listed keep the default.
+	StatusCodes map[string]string
 
 	// OnNewConnection, if non-nil, is called on new connections.
 	// If it returns non-nil, the connection is closed.
 	OnNewConnection func(c Connection) error
 
+	// OnHello, if non-nil, is called when a HELO or EHLO line arrives.
+	// If it returns non-nil, the greeting is rejected and the client
+	// may not start a mail transaction until it greets successfully.
+	OnHello func(c Connection, greeting, host string) error
+
+	// OnAuth is called to check the credentials of an AUTH command.
+	// If it returns nil, the session is authenticated as user and may
+	// relay regardless of LocalDomains.
+	OnAuth func(c Connection, user, password string) error
+
+	// OnClientCert, if non-nil, is called after a TLS handshake, via
+	// STARTTLS or a TLS listener, in which the client presented a
+	// certificate that verified against TLSConfig's ClientCAs; set its
+	// ClientAuth to tls.VerifyClientCertIfGiven or stricter. If it
+	// returns nil, the session is authenticated, as with AUTH, as the
+	// certificate subject's common name. Otherwise the certificate is
+	// ignored. The chains are also in Connection.TLSState.
+	OnClientCert func(c Connection, chains [][]*x509.Certificate) error
+
+	// RequireClientCert, if set, rejects MAIL FROM with "535 5.7.8
+	// Error: client certificate required" unless OnClientCert has
+	// accepted the client's certificate. Trusted clients are exempt.
+	RequireClientCert bool
+
+	// ParseAddress, if non-nil, replaces the default parsing of MAIL
+	// FROM and RCPT TO addresses. It's called with the address as sent
+	// between the angle brackets, less any source route, and
+	// isn't called for the null sender "<>". An error rejects the
+	// command: an SMTPError is sent as is, anything else gets a 501.
+	// The default only checks the address's basic form: no unquoted
+	// spaces, a single "@" outside a quoted local part and a non-empty
+	// domain, which only RCPT TO may leave out, or else "501 5.1.7".
+	ParseAddress func(raw string) (MailAddress, error)
+
 	// OnNewMail must be defined and is called when a new message beings.
 	// (when a MAIL FROM line arrives)
 	OnNewMail func(c Connection, from MailAddress) (Envelope, error)
+
+	// OnRcpt, if non-nil, is called for each RCPT TO that passes the
+	// server's own checks, before Envelope.AddRecipient, to accept
+	// (nil) or reject the recipient. It's given the transaction's
+	// sender too, so a policy that depends on both can accept any
+	// sender in OnNewMail and decide here, rejecting a combination
+	// with ErrSenderNotAllowed. Other rejections are typically one of
+	// ErrUserUnknown, ErrMailboxFull and ErrMailboxUnavailable, or
+	// another SMTPError; other errors are treated as ErrUserUnknown.
+	// Only accepted recipients count towards the transaction.
+	OnRcpt func(c Connection, from, rcpt MailAddress) error
+
+	// OnMessageData, if non-nil, is called once the whole message has
+	// been received, before the Envelope's Close, with a reader over
+	// the message as it was passed to Envelope.Write. Returning an
+	// error, typically an SMTPError such as "550 5.7.1 Message
+	// rejected by content policy", rejects the message and Close isn't
+	// called. Setting it makes the server keep a copy of each message
+	// in memory, so bound MaxMessageSize.
+	OnMessageData func(c Connection, env Envelope, data io.Reader) error
+
+	// TransformMessage, if non-nil, is called once the whole message
+	// has been received, with a reader over it, and returns the
+	// message to deliver instead, for example with headers added or
+	// removed. The Envelope's Write only sees the returned message,
+	// split into lines. Returning an error rejects the message as for
+	// OnMessageData. Like OnMessageData, it makes the server keep a
+	// copy of each message in memory.
+	TransformMessage func(c Connection, in io.Reader) (io.Reader, error)
+
+	// SPFResult, if non-nil, is called on MAIL FROM to evaluate the
+	// sender's SPF policy. The result (e.g. "pass", "softfail") and
+	// optional explanation are added to the message in a Received-SPF
+	// header. If it returns an error, the sender is rejected.
+	SPFResult func(c Connection, from MailAddress) (result, explanation string, err error)
+
+	handlers map[string]func(Connection, string) error // see Handle
+
+	transcriptMu sync.Mutex   // serializes writes to DebugTranscript
+	logMu        sync.Mutex   // serializes writes to AccessLog
+	unknownCmds  atomic.Int64 // count of unrecognized commands received
+	dnsbl        dnsblCache   // answers for DNSBLs
+	bursts       burstTracker // recent connections, for ConnectionBurstLimit
+	deferAll     atomic.Bool  // see SetDeferAll
+
+	dataSemOnce sync.Once
+	dataSem     chan struct{} // see MaxConcurrentData
+
+	mu        sync.Mutex
+	closing   bool // Close or Shutdown was called
+	listeners map[net.Listener]bool
+	firstLn   net.Listener // first listener still being served, if any
+	sessions  map[*session]bool
+	userSess  map[string]int // authenticated sessions by user, for MaxSessionsPerUser
+}
+
+// SetDeferAll sets whether the server defers all messages. While on,
+// clients may still connect and start transactions, but DATA and BDAT
+// are answered with "451 4.3.2 System not accepting messages". It may
+// be called while serving.
+func (srv *Server) SetDeferAll(on bool) {
+	srv.deferAll.Store(on)
+}
+
+var errDeferAll = SMTPError("451 4.3.2 System not accepting messages")
+
+// UnknownCommands returns the number of unrecognized commands the
+// server has received.
+func (srv *Server) UnknownCommands() int64 {
+	return srv.unknownCmds.Load()
+}
+
+// unimplementedVerbs are commands we recognize but don't implement.
+// They get a 502 without being logged or counted as unknown.
+var unimplementedVerbs = map[string]bool{
+	"VRFY": true,
+	"EXPN": true,
+	"TURN": true,
+	"ETRN": true,
+
+	// RFC 821's terminal-delivery verbs. RFC 5321 removed them and
+	// nothing supports them, but probers still try them, so give
+	// them a definite answer rather than treating them as unknown.
+	"SEND": true,
+	"SOML": true,
+	"SAML": true,
 }
 
 // MailAddress is defined by
 type MailAddress interface {
-	Email() string    // email address, as provided
+	Email() string    // email address, as provided, in its original case
 	Hostname() string // canonical hostname, lowercase
 }
 
@@ -54,15 +521,103 @@ type MailAddress interface {
 // customizing their own Servers.
 type Connection interface {
 	Addr() net.Addr
+
+	// LocalAddr returns the server address the client connected to.
+	LocalAddr() net.Addr
+
+	// TLSState returns the connection's TLS state and whether it's
+	// encrypted.
+	TLSState() (tls.ConnectionState, bool)
+
+	// AuthUser returns the user the client authenticated as, or "".
+	AuthUser() string
+
+	// LastMailFromRaw and LastRcptToRaw return the last MAIL FROM and
+	// RCPT TO command lines of the session, exactly as sent but
+	// without their CRLF, whether or not they were accepted. They're
+	// "" if there was none.
+	LastMailFromRaw() string
+	LastRcptToRaw() string
+
+	// DeclaredSize returns the SIZE the client declared for the
+	// current message, and the size after Server.EffectiveSize. Both
+	// are 0 if no SIZE was given.
+	DeclaredSize() (declared, effective int64)
+
+	// MessageSize returns the size in bytes and the number of lines
+	// of the current message as received, after dot-unstuffing and
+	// without the header fields the server adds, whatever SIZE was
+	// declared. It's final once the message has been read: from the
+	// Envelope's Close until the next MAIL FROM.
+	MessageSize() (size int64, lines int)
+
+	// RequireTLS reports whether the current transaction's MAIL FROM
+	// had the REQUIRETLS parameter. See Server.RequireTLSExtension.
+	RequireTLS() bool
+
+	// AddHeader adds a header field to prepend to the current
+	// message. See HeaderEnvelope.
+	AddHeader(name, value string)
+
+	// AddAuthResults adds an Authentication-Results header field
+	// reporting results, as formatted by AuthenticationResults.
+	AddAuthResults(results ...AuthResult)
+}
+
+// Streamer is implemented by the Connection passed to handlers
+// registered with Server.Handle, for commands that carry a protocol of
+// their own over the connection.
+//
+// Stream hands the connection to the handler, for the rest of the
+// handler's run: it returns the connection and a buffered reader and
+// writer on it, which must be used instead of the connection's own
+// Read and Write, as they hold input the client pipelined and replies
+// not yet sent. The handler reads and writes what it likes, flushing
+// the writer itself; the deadlines on the connection are cleared, and
+// it may set its own. Once it has called Stream, no reply is sent for
+// the command. If the handler then returns nil, the session goes on
+// reading commands from the reader; otherwise the error is logged and
+// the connection is closed.
+type Streamer interface {
+	Stream() (net.Conn, *bufio.ReadWriter)
 }
 
+// Envelope is returned by Server.OnNewMail and receives the rest of
+// the transaction.
 type Envelope interface {
 	AddRecipient(rcpt MailAddress) error
 	BeginData() error
+
+	// Write is called with each line of the message, exactly as
+	// received, including its CRLF: headers keep their original
+	// folding and whitespace, so DKIM signatures can be verified
+	// over them. Only the SMTP dot-stuffing is undone. Lines too long
+	// to buffer arrive in several Writes. Server-generated header
+	// lines (such as Received-SPF) are written before the message,
+	// unless the Envelope is a HeaderEnvelope.
+	// For messages sent with BDAT, Write is called with arbitrary
+	// pieces of the message instead of lines.
+	// The slice is only valid for the duration of the call.
 	Write(line []byte) error
+
 	Close() error
 }
 
+// TxEnvelope is an Envelope with explicit transaction boundaries, for
+// stores that stage a message and then make it permanent or throw it
+// away. If the Envelope returned by OnNewMail implements it, Commit is
+// called once the message has been received and Close has succeeded,
+// and its error, if any, is the reply to the message. Rollback is
+// called instead if the transaction ends any other way: the client
+// resets or disconnects, the message is rejected, or Close or Commit
+// fails. Exactly one of a successful Commit and Rollback ends each
+// transaction.
+type TxEnvelope interface {
+	Envelope
+	Commit() error
+	Rollback()
+}
+
 type BasicEnvelope struct {
 	rcpts []MailAddress
 }
@@ -74,13 +629,13 @@ func (e *BasicEnvelope) AddRecipient(rcpt MailAddress) error {
 
 func (e *BasicEnvelope) BeginData() error {
 	if len(e.rcpts) == 0 {
-		return SMTPError("554 5.5.1 Error: no valid recipients")
+		return errNoRecipients
 	}
 	return nil
 }
 
 func (e *BasicEnvelope) Write(line []byte) error {
-	log.Printf("Line: %q", string(line))
+	log.Printf("Line: %q", logText(string(line)))
 	return nil
 }
 
@@ -93,32 +648,107 @@ func (srv *Server) hostname() string {
 		return srv.Hostname
 	}
 	out, err := exec.Command("hostname").Output()
-	if err != nil {
-		return ""
+	if name := strings.TrimSpace(string(out)); err == nil && name != "" {
+		return name
 	}
-	return strings.TrimSpace(string(out))
+	// The banner and EHLO reply need a name; an empty one makes
+	// them malformed.
+	if name, err := os.Hostname(); err == nil && name != "" {
+		return name
+	}
+	return "localhost"
 }
 
 // ListenAndServe listens on the TCP network address srv.Addr and then
 // calls Serve to handle requests on incoming connections.  If
-// srv.Addr is blank, ":25" is used.
+// srv.Addr is blank, ":25" is used. If srv.Listeners is more than one,
+// it opens that many listeners and serves each in its own accept loop,
+// returning once any of them fails; the rest are then closed.
 func (srv *Server) ListenAndServe() error {
+	return srv.listenAndServe("tcp")
+}
+
+// ListenAndServeDualStack is like ListenAndServe but listens on
+// srv.Addr with separate IPv4 and IPv6 listeners, for systems where
+// one socket doesn't accept both. srv.Addr should have no host, as in
+// ":25". Both listeners share the Server's sessions, so Close and
+// Shutdown stop them together.
+func (srv *Server) ListenAndServeDualStack() error {
+	return srv.listenAndServe("tcp4", "tcp6")
+}
+
+func (srv *Server) listenAndServe(networks ...string) error {
 	addr := srv.Addr
 	if addr == "" {
 		addr = ":25"
 	}
-	ln, e := net.Listen("tcp", addr)
-	if e != nil {
-		return e
+	lc := srv.ListenConfig
+	if lc == nil {
+		lc = new(net.ListenConfig)
+	}
+	n := srv.Listeners
+	if n < 1 {
+		n = 1
 	}
-	return srv.Serve(ln)
+	var lns []net.Listener
+	for _, network := range networks {
+		for i := 0; i < n; i++ {
+			ln, e := lc.Listen(context.Background(), network, addr)
+			if e != nil {
+				for _, ln := range lns {
+					ln.Close()
+				}
+				return e
+			}
+			lns = append(lns, ln)
+		}
+	}
+	return srv.ServeFromListeners(lns)
+}
+
+// ServeFromListeners serves connections on each of lns in its own
+// accept loop, such as those from SystemdListeners. It returns once any
+// of them fails; the rest are then closed.
+func (srv *Server) ServeFromListeners(lns []net.Listener) error {
+	if len(lns) == 0 {
+		return errors.New("smtpd: no listeners")
+	}
+	if len(lns) == 1 {
+		return srv.Serve(lns[0])
+	}
+	errc := make(chan error, len(lns))
+	for _, ln := range lns {
+		go func(ln net.Listener) { errc <- srv.Serve(ln) }(ln)
+	}
+	err := <-errc
+	for _, ln := range lns {
+		ln.Close()
+	}
+	for i := 1; i < len(lns); i++ {
+		<-errc
+	}
+	return err
 }
 
+// ErrServerClosed is returned by Serve and the other serving methods
+// once Close or Shutdown has been called.
+var ErrServerClosed = errors.New("smtpd: Server closed")
+
+// Serve accepts connections on ln and serves each in its own
+// goroutine. It always returns a non-nil error: ErrServerClosed after
+// Close or Shutdown, else the error that stopped it accepting.
 func (srv *Server) Serve(ln net.Listener) error {
 	defer ln.Close()
+	if !srv.trackListener(ln, true) {
+		return ErrServerClosed
+	}
+	defer srv.trackListener(ln, false)
 	for {
 		rw, e := ln.Accept()
 		if e != nil {
+			if srv.isClosing() {
+				return ErrServerClosed
+			}
 			if ne, ok := e.(net.Error); ok && ne.Temporary() {
 				log.Printf("smtpd: Accept error: %v", e)
 				continue
@@ -129,9 +759,141 @@ func (srv *Server) Serve(ln net.Listener) error {
 		if err != nil {
 			continue
 		}
+		srv.trackSession(sess, true)
 		go sess.serve()
 	}
-	panic("not reached")
+}
+
+// Close immediately closes all listeners and active connections,
+// causing Serve to return. Clients aren't told; for an orderly stop
+// that lets sessions finish, use Shutdown.
+func (srv *Server) Close() error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.closing = true
+	var err error
+	for ln := range srv.listeners {
+		if cerr := ln.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	for s := range srv.sessions {
+		s.rwc.Close()
+	}
+	return err
+}
+
+// shutdownPollInterval is how often Shutdown checks for sessions
+// that have finished.
+const shutdownPollInterval = 50 * time.Millisecond
+
+// Shutdown gracefully shuts down the server. It closes all listeners,
+// then sends 421 to and closes clients as soon as they are between
+// commands with no mail transaction in progress. If ctx is done before
+// all sessions have ended, the remaining ones are closed (with a 421
+// if they're waiting for a command) and ctx's error is returned.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	srv.mu.Lock()
+	srv.closing = true
+	var err error
+	for ln := range srv.listeners {
+		if cerr := ln.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	srv.mu.Unlock()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		srv.mu.Lock()
+		for s := range srv.sessions {
+			if s.waiting && !s.inTx {
+				s.kick()
+			}
+		}
+		n := len(srv.sessions)
+		srv.mu.Unlock()
+		if n == 0 {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			srv.mu.Lock()
+			for s := range srv.sessions {
+				if s.waiting {
+					s.kick()
+				}
+				s.rwc.Close()
+			}
+			srv.mu.Unlock()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// trackListener adds ln to or removes it from the listeners Close and
+// Shutdown close. It reports false if ln can't be added because the
+// server is closing.
+func (srv *Server) trackListener(ln net.Listener, add bool) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if add && srv.closing {
+		return false
+	}
+	if srv.listeners == nil {
+		srv.listeners = make(map[net.Listener]bool)
+	}
+	if add {
+		srv.listeners[ln] = true
+		if srv.firstLn == nil {
+			srv.firstLn = ln
+		}
+	} else {
+		delete(srv.listeners, ln)
+		if srv.firstLn == ln {
+			srv.firstLn = nil
+		}
+	}
+	return true
+}
+
+// isClosing reports whether Close or Shutdown has been called.
+func (srv *Server) isClosing() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.closing
+}
+
+// ListenerAddr returns the address the server is listening on, or nil
+// if it isn't serving. It's useful after listening on ":0" to find the
+// port the system chose. If Serve is running on several listeners,
+// the first one's address is returned.
+func (srv *Server) ListenerAddr() net.Addr {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.firstLn == nil {
+		return nil
+	}
+	return srv.firstLn.Addr()
+}
+
+func (srv *Server) trackSession(s *session, add bool) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.sessions == nil {
+		srv.sessions = make(map[*session]bool)
+	}
+	if add {
+		if srv.closing {
+			// Accepted as we stopped; don't let it outlive the server.
+			s.rwc.Close()
+		}
+		srv.sessions[s] = true
+	} else {
+		delete(srv.sessions, s)
+	}
 }
 
 type session struct {
@@ -140,10 +902,55 @@ type session struct {
 	br  *bufio.Reader
 	bw  *bufio.Writer
 
-	env Envelope // current envelope, or nil
+	env       Envelope      // current envelope, or nil
+	from      MailAddress   // sender of the current envelope
+	rcpts     int           // recipients accepted for env
+	txStart   time.Time     // when env was started
+	queueID   string        // ID of env, see GenerateID
+	msgSize   int64         // bytes of message data received for env
+	msgLines  int           // lines of message data received for env
+	connBytes int64         // bytes of message data received on the connection
+	messages  int           // messages accepted on the connection
+	declSize  int64         // SIZE declared for env, if any
+	effSize   int64         // declSize after Server.EffectiveSize
+	headers   []headerField // header fields to prepend to env's message
+	binary    bool          // env was declared BODY=BINARYMIME
+	utf8      bool          // env was declared SMTPUTF8
+	reqTLS    bool          // env was declared REQUIRETLS
+	lineBuf   []byte        // scratch space for rewriting data lines
+	lfBuf     []byte        // scratch space for readLine, for AllowBareLF
+	midCR     bool          // the last readLine piece ended in CR, for AllowBareLF
+	msgBuf    *bytes.Buffer // copy of the message for OnMessageData, if set
+	bdat      bool          // env's body is being sent with BDAT
+	dataSlot  bool          // holds a MaxConcurrentData slot
+
+	helloType     string
+	helloHost     string
+	helloRejected bool                 // OnHello rejected the last greeting
+	writeFailed   bool                 // a reply couldn't be written; the connection is closed
+	fcrdnsDone    bool                 // checkFcrDNS has run
+	fcrdnsErr     error                // result of checkFcrDNS
+	domainErrs    map[string]error     // results of checkDomain, by domain
+	authUser      string               // authenticated user, if any
+	userCounted   bool                 // authUser is counted in srv.userSess
+	certAuth      bool                 // authUser comes from an accepted client certificate
+	proxyAddr     net.Addr             // client address from the PROXY header, if any
+	proxyTLS      *tls.ConnectionState // TLS state from the PROXY header, if any
+	lastMailRaw   string               // see LastMailFromRaw
+	lastRcptRaw   string               // see LastRcptToRaw
 
-	helloType string
-	helloHost string
+	unknownLogged bool // logged an unrecognized command already
+	gotCommand    bool // the client has sent a command
+	rejected      bool // a 4xx or 5xx reply was sent to the current command
+	rejections    int  // commands rejected, for RejectionBackoff
+	authFailures  int  // AUTH commands with rejected credentials, for MaxAuthAttempts
+	quit          bool // end the session after the current command
+	streamed      bool // a Handle handler has called Stream
+
+	// Guarded by srv.mu, for Shutdown:
+	waiting bool // blocked reading a command
+	inTx    bool // while waiting, a transaction is in progress
+	kicked  bool // Shutdown sent 421 and closed the connection
 }
 
 func (srv *Server) newSession(rwc net.Conn) (s *session, err error) {
@@ -151,213 +958,1303 @@ func (srv *Server) newSession(rwc net.Conn) (s *session, err error) {
 		srv: srv,
 		rwc: rwc,
 		br:  bufio.NewReader(rwc),
-		bw:  bufio.NewWriter(rwc),
+	}
+	if srv.DebugTranscript != nil {
+		s.bw = bufio.NewWriter(transcriptWriter{s})
+	} else {
+		s.bw = bufio.NewWriter(rwc)
 	}
 	return
 }
 
+// transcript writes each line of p to the server's DebugTranscript,
+// if any, after prefix.
+func (s *session) transcript(prefix string, p []byte) {
+	w := s.srv.DebugTranscript
+	if w == nil {
+		return
+	}
+	s.srv.transcriptMu.Lock()
+	defer s.srv.transcriptMu.Unlock()
+	for len(p) > 0 {
+		line := p
+		if idx := bytes.IndexByte(p, '\n'); idx != -1 {
+			line, p = p[:idx+1], p[idx+1:]
+		} else {
+			p = nil
+		}
+		fmt.Fprintf(w, "%s%s\n", prefix, bytes.TrimRight(line, "\r\n"))
+	}
+}
+
+// transcriptWriter copies everything written to the client to the
+// session's transcript.
+type transcriptWriter struct {
+	s *session
+}
+
+func (tw transcriptWriter) Write(p []byte) (int, error) {
+	n, err := tw.s.rwc.Write(p)
+	tw.s.transcript("S: ", p[:n])
+	return n, err
+}
+
+// setReadTimeout sets the connection's read deadline d from now, or
+// from Server.ReadTimeout if d is zero. With neither, reads never time out.
+func (s *session) setReadTimeout(d time.Duration) {
+	if d == 0 {
+		d = s.srv.ReadTimeout
+	}
+	if d != 0 {
+		s.rwc.SetReadDeadline(time.Now().Add(d))
+	} else {
+		s.rwc.SetReadDeadline(time.Time{})
+	}
+}
+
+// readLine reads a line from the client, including its line ending.
+// The returned slice is only valid until the next read. Callers are
+// responsible for adding it to the transcript.
+func (s *session) readLine() ([]byte, error) {
+	sl, err := s.br.ReadSlice('\n')
+	if !s.srv.AllowBareLF {
+		return sl, err
+	}
+	// A piece of a long line may end in the CR of its CRLF.
+	midCR := s.midCR
+	s.midCR = err == bufio.ErrBufferFull && bytes.HasSuffix(sl, []byte("\r"))
+	if err == nil && !bytes.HasSuffix(sl, []byte("\r\n")) && !(midCR && len(sl) == 1) {
+		s.lfBuf = append(append(s.lfBuf[:0], sl[:len(sl)-1]...), '\r', '\n')
+		sl = s.lfBuf
+	}
+	return sl, err
+}
+
+// errorf logs an error in dealing with the client. As the error may
+// quote what the client sent, the message is passed through logSafe.
 func (s *session) errorf(format string, args ...interface{}) {
-	log.Printf("Client error: "+format, args...)
+	log.Printf("Client error: %s", logSafe(fmt.Sprintf(format, args...)))
+}
+
+// sendf sends a reply, which may be multiline. It returns the error,
+// if any, from flush.
+//
+// While the client has pipelined more commands, final replies are
+// left buffered, to go out together once its input runs dry (RFC 2920
+// s3.1) or the session ends; intermediate (3xx) replies, which the
+// client waits for, are always sent at once.
+func (s *session) sendf(format string, args ...interface{}) error {
+	reply := fmt.Sprintf(format, args...)
+	if reply != "" && (reply[0] == '4' || reply[0] == '5') {
+		s.rejected = true
+	}
+	if s.helloType != "EHLO" {
+		lines := strings.SplitAfter(reply, "\r\n")
+		for i, l := range lines {
+			lines[i] = stripEnhancedCode(l)
+		}
+		reply = strings.Join(lines, "")
+	}
+	s.setWriteTimeout()
+	s.bw.WriteString(reply)
+	if s.br.Buffered() > 0 && reply != "" && reply[0] != '3' {
+		return nil
+	}
+	return s.flush()
 }
 
-func (s *session) sendf(format string, args ...interface{}) {
+// setWriteTimeout sets the write deadline for the reply about to be
+// written, so a client that stops reading can't block the session
+// forever.
+func (s *session) setWriteTimeout() {
 	if s.srv.WriteTimeout != 0 {
 		s.rwc.SetWriteDeadline(time.Now().Add(s.srv.WriteTimeout))
 	}
-	fmt.Fprintf(s.bw, format, args...)
+}
+
+// flush sends the buffered reply. If that fails, typically because
+// the client stopped reading and the write timed out, the connection
+// is closed and the session ends after the current command.
+func (s *session) flush() error {
+	err := s.bw.Flush()
+	if err != nil {
+		if !s.writeFailed {
+			s.errorf("write error: %v", err)
+		}
+		s.writeFailed = true
+		s.quit = true
+		s.rwc.Close()
+	}
+	return err
+}
+
+// hangUp sends any replies held back by sendf and closes the
+// connection.
+func (s *session) hangUp() {
 	s.bw.Flush()
+	s.rwc.Close()
 }
 
-func (s *session) sendlinef(format string, args ...interface{}) {
-	s.sendf(format+"\r\n", args...)
+func (s *session) sendlinef(format string, args ...interface{}) error {
+	return s.sendf(format+"\r\n", args...)
 }
 
 func (s *session) sendSMTPErrorOrLinef(err error, format string, args ...interface{}) {
 	if se, ok := err.(SMTPError); ok {
-		s.sendlinef("%s", se.Error())
+		s.sendError(se)
 		return
 	}
 	s.sendlinef(format, args...)
 }
 
 func (s *session) Addr() net.Addr {
+	if s.proxyAddr != nil {
+		return s.proxyAddr
+	}
 	return s.rwc.RemoteAddr()
 }
 
-func (s *session) serve() {
-	defer s.rwc.Close()
-	if onc := s.srv.OnNewConnection; onc != nil {
-		if err := onc(s); err != nil {
-			s.sendSMTPErrorOrLinef(err, "554 connection rejected")
-			return
-		}
-	}
-	s.sendf("220 %s ESMTP gosmtpd\r\n", s.srv.hostname())
-	for {
-		if s.srv.ReadTimeout != 0 {
-			s.rwc.SetReadDeadline(time.Now().Add(s.srv.ReadTimeout))
-		}
-		sl, err := s.br.ReadSlice('\n')
-		if err != nil {
-			s.errorf("read error: %v", err)
-			return
-		}
-		line := cmdLine(string(sl))
-		if err := line.checkValid(); err != nil {
-			s.sendlinef("500 %v", err)
-			continue
-		}
+func (s *session) LocalAddr() net.Addr {
+	return s.rwc.LocalAddr()
+}
 
-		switch line.Verb() {
-		case "HELO", "EHLO":
-			s.handleHello(line.Verb(), line.Arg())
-		case "QUIT":
-			s.sendlinef("221 2.0.0 Bye")
-			return
-		case "RSET":
-			s.env = nil
-			s.sendlinef("250 2.0.0 OK")
-		case "NOOP":
-			s.sendlinef("250 2.0.0 OK")
-		case "MAIL":
-			arg := line.Arg() // "From:<foo@bar.com>"
-			m := mailFromRE.FindStringSubmatch(arg)
-			if m == nil {
-				log.Printf("invalid MAIL arg: %q", arg)
-				s.sendlinef("501 5.1.7 Bad sender address syntax")
-				continue
-			}
-			s.handleMailFrom(m[1])
-		case "RCPT":
-			s.handleRcpt(line)
-		case "DATA":
-			s.handleData()
-		default:
-			log.Printf("Client: %q, verhb: %q", line, line.Verb())
-			s.sendlinef("502 5.5.2 Error: command not recognized")
-		}
-	}
+func (s *session) AuthUser() string {
+	return s.authUser
 }
 
-func (s *session) handleHello(greeting, host string) {
-	s.helloType = greeting
-	s.helloHost = host
-	fmt.Fprintf(s.bw, "250-%s\r\n", s.srv.hostname())
-	extensions := []string{}
-	if s.srv.PlainAuth {
-		extensions = append(extensions, "250-AUTH PLAIN")
-	}
-	extensions = append(extensions, "250-PIPELINING",
-		"250-SIZE 10240000",
-		"250-ENHANCEDSTATUSCODES",
-		"250-8BITMIME",
-		"250 DSN")
-	for _, ext := range extensions {
-		fmt.Fprintf(s.bw, "%s\r\n", ext)
-	}
-	s.bw.Flush()
+func (s *session) DeclaredSize() (declared, effective int64) {
+	return s.declSize, s.effSize
 }
 
-func (s *session) handleMailFrom(email string) {
-	// TODO: 4.1.1.11.  If the server SMTP does not recognize or
-	// cannot implement one or more of the parameters associated
-	// qwith a particular MAIL FROM or RCPT TO command, it will return
-	// code 555.
+func (s *session) MessageSize() (size int64, lines int) {
+	return s.msgSize, s.msgLines
+}
 
-	if s.env != nil {
-		s.sendlinef("503 5.5.1 Error: nested MAIL command")
-		return
+func (s *session) RequireTLS() bool { return s.reqTLS }
+
+func (s *session) Stream() (net.Conn, *bufio.ReadWriter) {
+	s.flush()
+	s.rwc.SetDeadline(time.Time{})
+	s.streamed = true
+	return s.rwc, bufio.NewReadWriter(s.br, s.bw)
+}
+
+func (s *session) LastMailFromRaw() string { return s.lastMailRaw }
+func (s *session) LastRcptToRaw() string   { return s.lastRcptRaw }
+
+// remoteIP returns the client's IP address as a string.
+func (s *session) remoteIP() string {
+	addr := s.Addr().String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
 	}
-	log.Printf("mail from: %q", email)
-	cb := s.srv.OnNewMail
-	if cb == nil {
-		log.Printf("smtp: Server.OnNewMail is nil; rejecting MAIL FROM")
-		s.sendf("451 Server.OnNewMail not configured\r\n")
-		return
+	return addr
+}
+
+// beginWait is called before reading each command. It reports false,
+// after telling the client, if the server is shutting down and the
+// session should end.
+func (s *session) beginWait() bool {
+	s.srv.mu.Lock()
+	if s.srv.closing && s.env == nil {
+		s.srv.mu.Unlock()
+		s.sendError(errShuttingDown)
+		return false
 	}
-	s.env = nil
-	env, err := cb(s, addrString(email))
-	if err != nil {
-		log.Printf("rejecting MAIL FROM %q: %v", email, err)
-		s.sendf("451 denied\r\n")
+	s.waiting = true
+	s.inTx = s.env != nil
+	s.srv.mu.Unlock()
+	return true
+}
 
-		s.bw.Flush()
-		time.Sleep(100 * time.Millisecond)
-		s.rwc.Close()
+// endWait is called after reading a command. It reports whether
+// Shutdown kicked the session while it waited.
+func (s *session) endWait() (kicked bool) {
+	s.srv.mu.Lock()
+	defer s.srv.mu.Unlock()
+	s.waiting = false
+	return s.kicked
+}
+
+var errShuttingDown = SMTPError("421 4.3.2 Service shutting down")
+
+// kick sends 421 to a session blocked waiting for a command and
+// closes its connection. srv.mu must be held.
+func (s *session) kick() {
+	if s.kicked {
 		return
 	}
-	s.env = env
-	s.sendlinef("250 2.1.0 Ok")
+	s.kicked = true
+	s.rwc.SetWriteDeadline(time.Now().Add(time.Second))
+	line := []byte(string(s.srv.status(errShuttingDown)) + "\r\n")
+	s.rwc.Write(line)
+	s.transcript("S: ", line)
+	s.rwc.Close()
 }
 
-func (s *session) handleRcpt(line cmdLine) {
-	// TODO: 4.1.1.11.  If the server SMTP does not recognize or
-	// cannot implement one or more of the parameters associated
-	// qwith a particular MAIL FROM or RCPT TO command, it will return
-	// code 555.
-
+// abortTransaction abandons the mail transaction in progress, if any,
+// logging it and rolling back its Envelope (see TxEnvelope).
+func (s *session) abortTransaction() {
 	if s.env == nil {
-		s.sendlinef("503 5.5.1 Error: need MAIL command")
 		return
 	}
-	arg := line.Arg() // "To:<foo@bar.com>"
-	m := rcptToRE.FindStringSubmatch(arg)
-	if m == nil {
-		log.Printf("bad RCPT address: %q", arg)
-		s.sendlinef("501 5.1.7 Bad sender address syntax")
-		return
+	s.logTransaction(0)
+	s.dropEnv()
+	s.bdat = false
+	s.releaseData()
+	s.headers = nil
+	s.msgBuf = nil
+}
+
+var errTooBusy = SMTPError("451 4.3.2 Too busy, try later")
+
+// dataSlotWait is how long a session waits for a MaxConcurrentData
+// slot before giving up.
+const dataSlotWait = 2 * time.Second
+
+// acquireData takes a MaxConcurrentData slot for receiving the current
+// message. It reports false if none came free in time.
+func (s *session) acquireData() bool {
+	max := s.srv.MaxConcurrentData
+	if max <= 0 || s.dataSlot {
+		return true
+	}
+	s.srv.dataSemOnce.Do(func() { s.srv.dataSem = make(chan struct{}, max) })
+	t := time.NewTimer(dataSlotWait)
+	defer t.Stop()
+	select {
+	case s.srv.dataSem <- struct{}{}:
+		s.dataSlot = true
+		return true
+	case <-t.C:
+		log.Printf("no DATA slot free for %v after %v", s.Addr(), dataSlotWait)
+		return false
+	}
+}
+
+// releaseData gives back the session's MaxConcurrentData slot, if it
+// has one.
+func (s *session) releaseData() {
+	if s.dataSlot {
+		<-s.srv.dataSem
+		s.dataSlot = false
+	}
+}
+
+// aborter is implemented by the package's own Envelopes that must be
+// told when their transaction is abandoned without a Close, without
+// making that part of their API as TxEnvelope would.
+type aborter interface {
+	abort()
+}
+
+// dropEnv abandons the current transaction's Envelope.
+func (s *session) dropEnv() {
+	rollback(s.env)
+	s.env = nil
+}
+
+// rollback tells e, if it wants to know, that its transaction has
+// ended without being committed.
+func rollback(e Envelope) {
+	switch e := e.(type) {
+	case TxEnvelope:
+		e.Rollback()
+	case aborter:
+		e.abort()
+	}
+}
+
+// closeEnv ends the message at the end of DATA or BDAT, closing the
+// Envelope and committing it if it's a TxEnvelope. On failure, the
+// client is told and the transaction is rolled back.
+func (s *session) closeEnv() error {
+	err := s.env.Close()
+	if tx, ok := s.env.(TxEnvelope); ok && err == nil {
+		err = tx.Commit()
 	}
-	err := s.env.AddRecipient(addrString(m[1]))
 	if err != nil {
-		s.sendSMTPErrorOrLinef(err, "550 bad recipient")
+		s.handleError(err)
+		s.logTransaction(replyCode(err, 451))
+		s.dropEnv()
+	}
+	return err
+}
+
+// recoverPanic ends the session, rather than the process, if a
+// callback or handler panics.
+func (s *session) recoverPanic() {
+	if err := recover(); err != nil {
+		log.Printf("smtpd: panic serving %v: %v\n%s", s.Addr(), err, debug.Stack())
+		s.sendError(errInternal)
+	}
+}
+
+var errInternal = SMTPError("451 4.3.0 Internal server error")
+
+var errCommandTimeout = SMTPError("421 4.4.2 Timeout")
+
+func (srv *Server) firstCommandTimeout() time.Duration {
+	switch {
+	case srv.FirstCommandTimeout != 0:
+		return srv.FirstCommandTimeout
+	case srv.CommandTimeout != 0:
+		return srv.CommandTimeout
+	case srv.ReadTimeout != 0:
+		return srv.ReadTimeout
+	}
+	return 5 * time.Minute
+}
+
+// isTimeout reports whether err is a network timeout.
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+func (s *session) serve() {
+	defer s.srv.trackSession(s, false)
+	defer s.rwc.Close()
+	defer func() { s.bw.Flush() }() // any replies held back by sendf
+	defer s.releaseUser()
+	defer s.releaseData()
+	defer s.abortTransaction()
+	defer s.recoverPanic()
+	if s.srv.ProxyProtocol {
+		if err := s.readProxyHeader(); err != nil {
+			s.errorf("PROXY header: %v", err)
+			return
+		}
+	}
+	if !s.checkBurst() {
+		return
+	}
+	if onc := s.srv.OnNewConnection; onc != nil {
+		if err := onc(s); err != nil {
+			s.sendSMTPErrorOrLinef(err, "554 connection rejected")
+			return
+		}
+	}
+	if len(s.srv.DNSBLs) > 0 && !s.isTrusted() {
+		if err := s.checkDNSBLs(); err != nil {
+			log.Printf("rejecting connection from %v: %v", s.Addr(), err)
+			s.sendSMTPErrorOrLinef(err, "554 connection rejected")
+			return
+		}
+	}
+	if tc, ok := s.rwc.(*tls.Conn); ok && s.srv.OnClientCert != nil {
+		// Serving a TLS listener; the handshake would otherwise wait
+		// for the banner, and the certificate is needed first.
+		if !s.handshake(tc) || !s.checkClientCert() {
+			return
+		}
+	}
+	if err := s.sendf("220 %s ESMTP gosmtpd\r\n", s.srv.hostname()); err != nil {
+		return
+	}
+	for {
+		if s.br.Buffered() == 0 && s.flush() != nil {
+			return
+		}
+		if !s.beginWait() {
+			return
+		}
+		if s.gotCommand {
+			s.setReadTimeout(s.srv.CommandTimeout)
+		} else {
+			s.setReadTimeout(s.srv.firstCommandTimeout())
+		}
+		sl, err := s.readLine()
+		if s.endWait() {
+			return
+		}
+		if len(sl) > 0 {
+			s.transcript("C: ", []byte(cmdLine(sl).redacted()))
+		}
+		if err == io.EOF && len(sl) > 0 {
+			// The client sent a final command without CRLF,
+			// then closed (or half-closed) the connection.
+			// Don't run it, but don't drop it silently either.
+			log.Printf("client sent unterminated line %q before EOF", logText(cmdLine(sl).redacted()))
+			s.sendlinef("500 5.5.2 Error: line not terminated by CRLF")
+			return
+		}
+		if err != nil {
+			s.errorf("read error: %v", err)
+			if isTimeout(err) {
+				s.sendError(errCommandTimeout)
+			}
+			return
+		}
+		s.gotCommand = true
+		line := cmdLine(string(sl))
+		s.tarpit()
+		if err := line.checkValid(); err != nil {
+			s.sendlinef("500 %v", err)
+		} else {
+			s.dispatch(line)
+		}
+		if s.quit || s.countRejection() {
+			return
+		}
+	}
+}
+
+// builtinVerbs maps commands to their built-in handlers.
+var builtinVerbs = map[string]func(s *session, line cmdLine){
+	"HELO": func(s *session, line cmdLine) { s.handleHello(line.Verb(), line.Arg()) },
+	"EHLO": func(s *session, line cmdLine) { s.handleHello(line.Verb(), line.Arg()) },
+	"QUIT": func(s *session, line cmdLine) {
+		s.abortTransaction()
+		s.sendQuit()
+		s.quit = true
+	},
+	"RSET": func(s *session, line cmdLine) {
+		s.abortTransaction()
+		s.sendlinef("250 2.0.0 OK")
+	},
+	// NOOP's argument, if any, is ignored (RFC 5321 s4.1.1.9).
+	"NOOP": func(s *session, line cmdLine) { s.sendlinef("250 2.0.0 OK") },
+	"MAIL": func(s *session, line cmdLine) {
+		s.lastMailRaw = line.raw()
+		pc, err := ParseCommand(string(line)) // "MAIL From:<foo@bar.com>"
+		if err != nil {
+			if err == errBadAddrSyntax {
+				log.Printf("invalid MAIL arg: %q", logText(line.Arg()))
+			}
+			s.sendError(err)
+			return
+		}
+		s.handleMailFrom(pc.Addr, pc.Params)
+	},
+	"RCPT": (*session).handleRcpt,
+	"DATA": func(s *session, line cmdLine) { s.handleData() },
+	"HELP": func(s *session, line cmdLine) { s.handleHelp(line.Arg()) },
+	"STARTTLS": func(s *session, line cmdLine) {
+		if s.srv.TLSConfig == nil {
+			s.handleUnknown(line)
+			return
+		}
+		if line.Arg() != "" {
+			s.sendlinef("501 5.5.4 Syntax: STARTTLS")
+			return
+		}
+		s.handleStartTLS()
+	},
+	"AUTH": func(s *session, line cmdLine) {
+		if !s.srv.authEnabled() {
+			s.handleUnknown(line)
+			return
+		}
+		s.handleAuth(line.Arg())
+	},
+	"BDAT": func(s *session, line cmdLine) {
+		if !s.srv.Chunking {
+			s.handleUnknown(line)
+			return
+		}
+		s.handleBdat(line.Arg())
+	},
+}
+
+// Handle registers handler for verb, which may be a custom command or
+// override a built-in one. The handler's SMTPError, if any, is sent as
+// the reply; other errors get a 451, and nil a "250 2.0.0 OK", unless
+// the handler took over the connection with Streamer. Handle must be
+// called before the server starts serving.
+func (srv *Server) Handle(verb string, handler func(c Connection, arg string) error) {
+	if srv.handlers == nil {
+		srv.handlers = make(map[string]func(Connection, string) error)
+	}
+	srv.handlers[strings.ToUpper(verb)] = handler
+}
+
+// dispatch runs the handler for line's verb: the one registered with
+// Handle, if any, else the built-in one.
+func (s *session) dispatch(line cmdLine) {
+	verb := line.Verb()
+	if s.srv.verbDisabled(verb) {
+		s.sendError(errCommandDisabled)
+		return
+	}
+	if h, ok := s.srv.handlers[verb]; ok {
+		err := h(s, line.Arg())
+		if s.streamed {
+			s.streamed = false
+			if err != nil {
+				log.Printf("%s handler: %v; closing", verb, err)
+				s.quit = true
+			}
+			return
+		}
+		if err != nil {
+			if _, ok := err.(SMTPError); !ok {
+				log.Printf("%s handler: %v", verb, err)
+			}
+			s.sendSMTPErrorOrLinef(err, "451 4.3.0 Error: local error")
+			return
+		}
+		s.sendlinef("250 2.0.0 OK")
+		return
+	}
+	if h, ok := builtinVerbs[verb]; ok {
+		h(s, line)
+		return
+	}
+	s.handleUnknown(line)
+}
+
+var errCommandDisabled = SMTPError("502 5.5.1 Command disabled")
+
+// verbDisabled reports whether verb is in DisabledVerbs.
+func (srv *Server) verbDisabled(verb string) bool {
+	for _, v := range srv.DisabledVerbs {
+		if strings.EqualFold(v, verb) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *session) handleUnknown(line cmdLine) {
+	if unimplementedVerbs[line.Verb()] {
+		s.sendlinef("502 5.5.1 Command not implemented")
+		return
+	}
+	s.srv.unknownCmds.Add(1)
+	// Only log the first one per session; scanners send lots.
+	if !s.unknownLogged {
+		s.unknownLogged = true
+		log.Printf("Client: %q, verb: %q (further unknown commands not logged)", logText(line.redacted()), logText(line.Verb()))
+	}
+	if r := s.srv.UnrecognizedReply; r != "" {
+		s.sendlinef("%s", r)
+		return
+	}
+	s.sendlinef("502 5.5.2 Error: command not recognized")
+}
+
+func (s *session) handleHello(greeting, host string) {
+	if s.srv.StrictHello && !validArgText(host, s.srv.SMTPUTF8) {
+		log.Printf("rejecting %s %q: invalid characters", greeting, host)
+		s.sendError(errInvalidHelloArg)
+		return
+	}
+	if host == "" || s.srv.StrictHello && !validHelloHost(host) {
+		log.Printf("rejecting %s %q: invalid domain", greeting, host)
+		s.sendError(errInvalidHello)
+		return
+	}
+	if cb := s.srv.OnHello; cb != nil {
+		if err := cb(s, greeting, host); err != nil {
+			log.Printf("rejecting %s %q: %v", greeting, host, err)
+			// The reply goes out under the previous greeting, if
+			// any, so a client that had EHLO still gets the
+			// enhanced code.
+			s.sendSMTPErrorOrLinef(err, "550 5.7.1 %s rejected", greeting)
+			s.helloType, s.helloHost = "", ""
+			s.helloRejected = true
+			return
+		}
+	}
+	s.helloType = greeting
+	s.helloHost = host
+	s.helloRejected = false
+	if greeting == "HELO" {
+		// No extensions; RFC 821 clients expect a single line.
+		s.sendlinef("250 %s", s.srv.hostname())
+		return
+	}
+	extensions := s.extensions()
+	if cb := s.srv.Extensions; cb != nil {
+		extensions = cb(s, extensions)
+	}
+	s.sendReplyLines("250", append([]string{s.srv.hostname()}, extensions...))
+}
+
+// maxReplyLine is the longest reply line allowed, including its code
+// and CRLF (RFC 5321 s4.5.3.1.5).
+const maxReplyLine = 512
+
+// sendReplyLines sends a reply with code and a line for each of lines,
+// marking all but the last as continued with "-". Lines that would be
+// too long are split, at a space if possible. It's sent with sendf,
+// and returns its error.
+func (s *session) sendReplyLines(code string, lines []string) error {
+	max := maxReplyLine - len(code) - 3
+	var split []string
+	for _, l := range lines {
+		for len(l) > max {
+			i := strings.LastIndex(l[:max+1], " ")
+			if i <= 0 {
+				i = max
+			}
+			split = append(split, l[:i])
+			l = strings.TrimLeft(l[i:], " ")
+		}
+		split = append(split, l)
+	}
+	var b strings.Builder
+	for i, l := range split {
+		sep := "-"
+		if i == len(split)-1 {
+			sep = " "
+		}
+		fmt.Fprintf(&b, "%s%s%s\r\n", code, sep, l)
+	}
+	return s.sendf("%s", b.String())
+}
+
+// sendQuit sends the reply to QUIT.
+func (s *session) sendQuit() {
+	msg := s.srv.QuitMessage
+	if msg == "" {
+		s.sendlinef("221 2.0.0 Bye")
 		return
 	}
+	lines := strings.Split(msg, "\n")
+	for _, l := range lines {
+		if !validArgText(l, false) {
+			log.Printf("smtpd: invalid QuitMessage %q; using the default", msg)
+			s.sendlinef("221 2.0.0 Bye")
+			return
+		}
+	}
+	s.sendReplyLines("221", lines)
+}
+
+// extensions returns the EHLO keywords the server supports on this
+// session.
+func (s *session) extensions() []string {
+	extensions := []string{}
+	if s.srv.TLSConfig != nil && !s.tlsActive() && !s.srv.verbDisabled("STARTTLS") {
+		extensions = append(extensions, "STARTTLS")
+	}
+	if mechs := s.authMechanisms(); len(mechs) > 0 && !s.srv.verbDisabled("AUTH") {
+		extensions = append(extensions, "AUTH "+strings.Join(mechs, " "))
+	}
+	size := int64(10240000)
+	if s.srv.MaxMessageSize > 0 {
+		size = s.srv.MaxMessageSize
+	}
+	extensions = append(extensions, "PIPELINING",
+		fmt.Sprintf("SIZE %d", size),
+		"ENHANCEDSTATUSCODES",
+		"8BITMIME")
+	if s.srv.SMTPUTF8 {
+		extensions = append(extensions, "SMTPUTF8")
+	}
+	if s.srv.RequireTLSExtension && s.tlsActive() {
+		extensions = append(extensions, "REQUIRETLS")
+	}
+	if s.srv.Chunking && !s.srv.verbDisabled("BDAT") {
+		extensions = append(extensions, "CHUNKING")
+		if s.srv.BinaryMIME {
+			extensions = append(extensions, "BINARYMIME")
+		}
+	}
+	return append(extensions, "DSN")
+}
+
+var (
+	errInvalidHello    = SMTPError("501 5.5.4 Invalid domain name")
+	errInvalidHelloArg = SMTPError("501 5.5.4 Invalid HELO argument")
+)
+
+// validHelloHost reports whether host is a plausible HELO/EHLO
+// argument: a domain name or an address literal such as
+// "[192.0.2.1]" or "[IPv6:2001:db8::1]" (RFC 5321 s4.1.2). Non-ASCII
+// bytes are taken as part of a UTF-8 label (RFC 6531 s3.7.1); callers
+// reject them first with validArgText when that's not allowed.
+func validHelloHost(host string) bool {
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		lit := host[1 : len(host)-1]
+		if len(lit) > 5 && strings.EqualFold(lit[:5], "IPv6:") {
+			ip := net.ParseIP(lit[5:])
+			return ip != nil && strings.Contains(lit[5:], ":")
+		}
+		ip := net.ParseIP(lit)
+		return ip != nil && ip.To4() != nil && !strings.Contains(lit, ":")
+	}
+	if len(host) > 255 {
+		return false
+	}
+	for _, label := range strings.Split(host, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for i := 0; i < len(label); i++ {
+			c := label[i]
+			if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c >= utf8.RuneSelf) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (s *session) handleMailFrom(email string, params map[string]string) {
+	// TODO: 4.1.1.11.  If the server SMTP does not recognize or
+	// cannot implement one or more of the parameters associated
+	// qwith a particular MAIL FROM or RCPT TO command, it will return
+	// code 555.
+
+	if s.env != nil {
+		s.sendlinef("503 5.5.1 Error: nested MAIL command")
+		return
+	}
+	if s.helloRejected {
+		s.sendlinef("503 5.5.1 Error: send HELO/EHLO first")
+		return
+	}
+	if max := s.srv.MaxMessagesPerConnection; max > 0 && s.messages >= max {
+		log.Printf("client %v sent %d messages on one connection; closing", s.Addr(), s.messages)
+		s.sendError(errTooManyMessages)
+		s.quit = true
+		return
+	}
+	if s.srv.RequireClientCert && !s.certAuth && !s.isTrusted() {
+		log.Printf("rejecting MAIL FROM %q from %v: no client certificate", email, s.Addr())
+		s.sendError(errClientCertRequired)
+		return
+	}
+	if s.srv.RequireFcrDNS && !s.isTrusted() {
+		if err := s.checkFcrDNS(); err != nil {
+			log.Printf("rejecting MAIL FROM %q: FCrDNS check for %s failed: %v", email, s.remoteIP(), err)
+			s.sendError(err)
+			return
+		}
+	}
+	binary := false
+	body := "7BIT"
+	if b, ok := params["BODY"]; ok {
+		body = strings.ToUpper(b)
+		switch body {
+		case "7BIT", "8BITMIME":
+		case "BINARYMIME":
+			if !s.srv.Chunking || !s.srv.BinaryMIME {
+				s.sendlinef("555 5.5.4 Error: BODY=BINARYMIME not supported")
+				return
+			}
+			binary = true
+		default:
+			s.sendlinef("501 5.5.4 Error: unknown BODY type")
+			return
+		}
+	}
+	var declared, effective int64
+	if v, ok := params["SIZE"]; ok {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			s.sendlinef("501 5.5.4 Syntax: SIZE=<octets>")
+			return
+		}
+		declared, effective = n, n
+		if f := s.srv.EffectiveSize; f != nil {
+			effective = f(s, n, body)
+		}
+		if max := s.srv.MaxMessageSize; max > 0 && effective > max {
+			log.Printf("rejecting MAIL FROM %q: SIZE %d (effective %d) over %d", email, declared, effective, max)
+			s.sendError(errMessageSizeDeclared)
+			return
+		}
+	}
+	_, smtputf8 := params["SMTPUTF8"]
+	if smtputf8 && !s.srv.SMTPUTF8 {
+		s.sendlinef("555 5.5.4 Error: SMTPUTF8 not supported")
+		return
+	}
+	v, reqTLS := params["REQUIRETLS"]
+	switch {
+	case !reqTLS:
+	case !s.srv.RequireTLSExtension:
+		s.sendlinef("555 5.5.4 Error: REQUIRETLS not supported")
+		return
+	case v != "":
+		s.sendlinef("501 5.5.4 Syntax: REQUIRETLS takes no value")
+		return
+	case !s.tlsActive():
+		log.Printf("rejecting MAIL FROM %q: REQUIRETLS without TLS", email)
+		s.sendlinef("554 5.7.1 REQUIRETLS requires TLS")
+		return
+	}
+	s.utf8 = smtputf8
+	if err := s.checkAddrText(email); err != nil {
+		s.sendError(err)
+		return
+	}
+	log.Printf("mail from: %q", email)
+	email = stripSourceRoute(email)
+	from, err := s.parseAddress(email, false)
+	if err != nil {
+		log.Printf("rejecting MAIL FROM %q: %v", logText(email), err)
+		s.sendSMTPErrorOrLinef(err, "%s", s.srv.status(errBadAddrSyntax))
+		return
+	}
+	cb := s.srv.OnNewMail
+	if cb == nil {
+		log.Printf("smtp: Server.OnNewMail is nil; rejecting MAIL FROM")
+		s.sendf("451 Server.OnNewMail not configured\r\n")
+		return
+	}
+	s.env = nil
+	s.headers = nil
+	s.declSize, s.effSize = declared, effective
+	s.reqTLS = reqTLS
+	if spf := s.srv.SPFResult; spf != nil {
+		result, explanation, err := spf(s, from)
+		if err != nil {
+			log.Printf("rejecting MAIL FROM %q: SPF: %v", email, err)
+			s.sendSMTPErrorOrLinef(err, "451 4.4.3 Error: SPF check failed")
+			return
+		}
+		s.AddHeader("Received-SPF", s.receivedSPF(result, explanation, email))
+	}
+	env, err := cb(s, from)
+	if err != nil {
+		log.Printf("rejecting MAIL FROM %q: %v", email, err)
+		s.sendf("451 denied\r\n")
+		s.flush()
+
+		time.Sleep(100 * time.Millisecond)
+		s.rwc.Close()
+		return
+	}
+	s.env = env
+	s.from = from
+	s.binary = binary
+	s.bdat = false
+	s.rcpts = 0
+	s.txStart = time.Now()
+	s.queueID = s.newQueueID()
+	s.msgSize = 0
+	s.msgLines = 0
+	s.sendlinef("250 2.1.0 Ok")
+}
+
+// Replies for rejecting a recipient from Server.OnRcpt or
+// Envelope.AddRecipient.
+var (
+	ErrUserUnknown        = SMTPError("550 5.1.1 User unknown")
+	ErrMailboxFull        = SMTPError("452 4.2.2 Mailbox full")
+	ErrMailboxUnavailable = SMTPError("450 4.2.1 Mailbox temporarily unavailable")
+	ErrSenderNotAllowed   = SMTPError("550 5.7.1 Sender not allowed for this recipient")
+)
+
+func (s *session) handleRcpt(line cmdLine) {
+	// TODO: 4.1.1.11.  If the server SMTP does not recognize or
+	// cannot implement one or more of the parameters associated
+	// qwith a particular MAIL FROM or RCPT TO command, it will return
+	// code 555.
+
+	s.lastRcptRaw = line.raw()
+	if s.env == nil {
+		s.sendlinef("503 5.5.1 Error: need MAIL command")
+		return
+	}
+	pc, err := ParseCommand(string(line)) // "RCPT To:<foo@bar.com>"
+	if err != nil {
+		if err == errBadAddrSyntax {
+			log.Printf("bad RCPT address: %q", logText(line.Arg()))
+		}
+		s.sendError(err)
+		return
+	}
+	// As with MAIL FROM, a source route is ignored and the mail
+	// goes to the final address; LastRcptToRaw keeps the route.
+	addr, err := s.parseAddress(stripSourceRoute(pc.Addr), true)
+	if err != nil {
+		log.Printf("rejecting RCPT TO %q: %v", logText(pc.Addr), err)
+		s.sendSMTPErrorOrLinef(err, "%s", s.srv.status(errBadAddrSyntax))
+		return
+	}
+	if s.srv.RejectBareRecipients && addr.Hostname() == "" && !strings.EqualFold(addr.Email(), "postmaster") {
+		log.Printf("rejecting RCPT TO %q: no domain", logText(addr.Email()))
+		s.sendError(errBareRecipient)
+		return
+	}
+	rcpt, err := parseRcptDSN(addr, pc.Params)
+	if err != nil {
+		s.sendError(err)
+		return
+	}
+	rcpt.raw = line.raw()
+	if max := s.srv.MaxNullSenderRecipients; max > 0 && s.from.Email() == "" && s.rcpts >= max {
+		log.Printf("rejecting RCPT TO %q: bounce already has %d recipients", rcpt.Email(), s.rcpts)
+		s.sendError(errTooManyBounceRcpts)
+		return
+	}
+	if err := s.checkAddrText(rcpt.Email()); err != nil {
+		s.sendError(err)
+		return
+	}
+	if err := s.checkRelay(rcpt); err != nil {
+		log.Printf("rejecting RCPT TO %q: %v", rcpt.Email(), err)
+		s.sendError(err)
+		return
+	}
+	if s.srv.VerifyRecipientDomain && !s.isTrusted() {
+		if err := s.checkDomain(rcpt.Hostname()); err != nil {
+			log.Printf("rejecting RCPT TO %q: %v", rcpt.Email(), err)
+			s.sendError(err)
+			return
+		}
+	}
+	if g := s.srv.Greylist; g != nil && !s.isTrusted() {
+		if err := g.Check(s.remoteIP(), s.from.Email(), rcpt.Email()); err != nil {
+			s.sendSMTPErrorOrLinef(err, "451 greylisted")
+			return
+		}
+	}
+	if cb := s.srv.OnRcpt; cb != nil {
+		if err := cb(s, s.from, rcpt); err != nil {
+			log.Printf("rejecting RCPT TO %q from %q: %v", rcpt.Email(), s.from.Email(), err)
+			s.sendSMTPErrorOrLinef(err, "%s", s.srv.status(ErrUserUnknown))
+			return
+		}
+	}
+	err = s.env.AddRecipient(rcpt)
+	if err != nil {
+		s.sendSMTPErrorOrLinef(err, "%s", s.srv.status(ErrUserUnknown))
+		return
+	}
+	s.rcpts++
 	s.sendlinef("250 2.1.0 Ok")
 }
 
 func (s *session) handleData() {
 	if s.env == nil {
-		s.sendlinef("503 5.5.1 Error: need RCPT command")
+		// No transaction: none was started, or the last one ended
+		// with its DATA.
+		s.sendlinef("503 5.5.1 Error: need MAIL command")
+		return
+	}
+	if s.binary {
+		s.sendlinef("503 5.5.1 Error: BODY=BINARYMIME requires BDAT")
+		return
+	}
+	if s.bdat {
+		s.sendlinef("503 5.5.1 Error: DATA not allowed after BDAT")
+		return
+	}
+	if s.rcpts == 0 {
+		// Typically a pipelined DATA after failed RCPTs. Refuse it
+		// without reading a body: whatever the client sends next
+		// is handled as commands, per RFC 2920.
+		s.sendError(errNoRecipients)
+		return
+	}
+	if s.srv.deferAll.Load() {
+		s.sendError(errDeferAll)
 		return
 	}
+	if s.srv.RejectEarlyData && s.br.Buffered() > 0 {
+		log.Printf("client sent %d bytes after DATA before the 354 reply", s.br.Buffered())
+		s.sendError(errEarlyData)
+		s.quit = true
+		return
+	}
+	if !s.acquireData() {
+		s.sendError(errTooBusy)
+		return
+	}
+	defer s.releaseData()
 	if err := s.env.BeginData(); err != nil {
 		s.handleError(err)
 		return
 	}
+	s.beginMessageCopy()
 	s.sendlinef("354 Go ahead")
+	var (
+		size    int64 // bytes of message body read
+		lines   int   // lines of message body read
+		drained int64 // bytes read after aborting
+		abort   error // if non-nil, the transaction failed; read to the dot
+	)
+	abort = s.writeHeaders(s.writeData)
+	var hc *headerChecker // non-nil while reading headers, if checking them
+	if s.srv.SMTPUTF8 {
+		hc = &headerChecker{utf8: s.utf8}
+	}
+	needMsgID := s.srv.GenerateMessageID // no Message-ID seen yet
+	atLineStart := true
 	for {
-		sl, err := s.br.ReadSlice('\n')
-		if err != nil {
-			s.errorf("read error: %v", err)
+		s.setReadTimeout(s.srv.DataTimeout)
+		sl, err := s.readLine()
+		if len(sl) > 0 {
+			s.transcript("C: ", sl)
+		}
+		if err != nil && err != bufio.ErrBufferFull {
+			s.msgSize = size
+			s.msgLines = lines
+			s.dataReadError(err)
 			return
 		}
-		if bytes.Equal(sl, []byte(".\r\n")) {
-			break
+		// A line longer than our buffer arrives in pieces
+		// (bufio.ErrBufferFull); only the first piece can be
+		// the terminator or be dot-stuffed.
+		if atLineStart {
+			if bytes.Equal(sl, []byte(".\r\n")) {
+				break
+			}
+			if sl[0] == '.' {
+				sl = sl[1:]
+			}
 		}
-		if sl[0] == '.' {
-			sl = sl[1:]
+		headerEnd := false
+		if atLineStart {
+			lines++
+			if needMsgID {
+				headerEnd = bytes.Equal(sl, []byte("\r\n"))
+				needMsgID = !isHeader(sl, "Message-ID")
+			}
 		}
-		err = s.env.Write(sl)
-		if err != nil {
-			s.sendSMTPErrorOrLinef(err, "550 ??? failed")
+		if hc != nil && abort == nil {
+			if atLineStart && bytes.Equal(sl, []byte("\r\n")) {
+				hc = nil // end of headers
+			} else if herr := hc.check(sl, err != nil); herr != nil {
+				abort = herr
+			}
+		}
+		atLineStart = err == nil
+		size += int64(len(sl))
+		if s.countConnBytes(int64(len(sl))) {
+			s.msgSize = size
+			s.msgLines = lines
+			s.logTransaction(421)
+			s.dropEnv()
 			return
 		}
+		if abort != nil {
+			drained += int64(len(sl))
+			if drained > s.srv.maxDrainBytes() {
+				log.Printf("client won't stop sending aborted message; closing")
+				s.sendSMTPErrorOrLinef(abort, "550 ??? failed")
+				s.msgSize = size
+				s.msgLines = lines
+				s.logTransaction(replyCode(abort, 550))
+				s.dropEnv()
+				s.hangUp()
+				return
+			}
+			continue
+		}
+		if max := s.srv.MaxMessageSize; max > 0 && size > max {
+			abort = errMessageTooLarge
+			continue
+		}
+		if max := s.srv.MaxBodyLines; max > 0 && lines > max {
+			abort = errTooManyLines
+			continue
+		}
+		if headerEnd && needMsgID {
+			needMsgID = false
+			if abort = s.writeHeader(headerField{"Message-ID", s.messageID()}, s.writeData); abort != nil {
+				continue
+			}
+		}
+		if err := s.writeData(sl); err != nil {
+			abort = err
+		}
 	}
-	if err := s.env.Close(); err != nil {
-		s.handleError(err)
+	if needMsgID && abort == nil {
+		// The message was all header.
+		abort = s.writeHeader(headerField{"Message-ID", s.messageID()}, s.writeData)
+	}
+	s.msgSize = size
+	s.msgLines = lines
+	if abort != nil {
+		s.sendSMTPErrorOrLinef(abort, "550 ??? failed")
+		s.logTransaction(replyCode(abort, 550))
+		s.dropEnv()
+		s.msgBuf = nil
 		return
 	}
-	s.sendlinef("250 2.0.0 Ok: queued")
+	if err := s.checkMessageData(); err != nil {
+		s.rejectMessageData(err)
+		return
+	}
+	if err := s.closeEnv(); err != nil {
+		return
+	}
+	s.sendlinef("250 2.0.0 Ok: queued as %s", s.queueID)
+	s.logTransaction(250)
+	s.messages++
 	s.env = nil
 }
 
+// writeData writes a line of DATA to the envelope, applying
+// Server.NormalizeLineEndings.
+func (s *session) writeData(line []byte) error {
+	if s.srv.NormalizeLineEndings && bytes.HasSuffix(line, []byte("\r\n")) {
+		n := len(line)
+		s.lineBuf = append(append(s.lineBuf[:0], line[:n-2]...), '\n')
+		line = s.lineBuf
+	}
+	return s.envWrite(line)
+}
+
+// envWrite writes p to the Envelope, keeping a copy for OnMessageData.
+// With TransformMessage, the message is only kept, to be written once
+// it's been transformed.
+func (s *session) envWrite(p []byte) error {
+	if s.msgBuf != nil {
+		s.msgBuf.Write(p)
+	}
+	if s.srv.TransformMessage != nil {
+		return nil
+	}
+	return s.env.Write(p)
+}
+
+// beginMessageCopy starts keeping a copy of the message data, if
+// OnMessageData or TransformMessage needs one.
+func (s *session) beginMessageCopy() {
+	s.msgBuf = nil
+	if s.srv.OnMessageData != nil || s.srv.TransformMessage != nil {
+		s.msgBuf = new(bytes.Buffer)
+	}
+}
+
+// checkMessageData passes the complete message through
+// TransformMessage, writing the result to the Envelope, and then to
+// OnMessageData.
+func (s *session) checkMessageData() error {
+	buf := s.msgBuf
+	s.msgBuf = nil
+	if buf == nil {
+		return nil
+	}
+	data := buf.Bytes()
+	if t := s.srv.TransformMessage; t != nil {
+		r, err := t(s, bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		if data, err = io.ReadAll(r); err != nil {
+			return err
+		}
+		for rest := data; len(rest) > 0; {
+			line := rest
+			if i := bytes.IndexByte(rest, '\n'); i != -1 {
+				line = rest[:i+1]
+			}
+			rest = rest[len(line):]
+			if err := s.env.Write(line); err != nil {
+				return err
+			}
+		}
+	}
+	if s.srv.OnMessageData == nil {
+		return nil
+	}
+	return s.srv.OnMessageData(s, s.env, bytes.NewReader(data))
+}
+
+// rejectMessageData ends the transaction after OnMessageData
+// rejected its message with err.
+func (s *session) rejectMessageData(err error) {
+	log.Printf("message rejected: %v", err)
+	s.handleError(err)
+	s.logTransaction(replyCode(err, 451))
+	s.dropEnv()
+}
+
+// receivedSPF formats the value of a Received-SPF header field
+// (RFC 7208 s9.1).
+func (s *session) receivedSPF(result, explanation, from string) string {
+	var buf bytes.Buffer
+	buf.WriteString(result)
+	if explanation != "" {
+		fmt.Fprintf(&buf, " (%s)", explanation)
+	}
+	fmt.Fprintf(&buf, " receiver=%s; client-ip=%s; envelope-from=%q;", s.srv.hostname(), s.remoteIP(), from)
+	if h := s.headerHello(); h != "" {
+		fmt.Fprintf(&buf, " helo=%s;", h)
+	}
+	return buf.String()
+}
+
+var errConnByteLimit = SMTPError("421 4.7.0 Connection byte limit exceeded")
+
+var errTooManyMessages = SMTPError("421 4.7.0 Too many messages, reconnect")
+
+// countConnBytes adds n bytes of message data to the connection's
+// total. If that exceeds Server.MaxBytesPerConnection, it tells the
+// client and reports true, and the session ends after the current
+// command.
+func (s *session) countConnBytes(n int64) bool {
+	s.connBytes += n
+	max := s.srv.MaxBytesPerConnection
+	if max <= 0 || s.connBytes <= max {
+		return false
+	}
+	log.Printf("client exceeded %d bytes on one connection; closing", max)
+	s.sendError(errConnByteLimit)
+	s.quit = true
+	return true
+}
+
+var errEarlyData = SMTPError("554 5.5.0 Error: message data sent before 354 reply")
+
+var errTooManyLines = SMTPError("552 5.3.4 Too many lines")
+
+var errTooManyBounceRcpts = SMTPError("550 5.5.3 Too many recipients for bounce")
+
+var errBareRecipient = SMTPError("501 5.1.3 Bad recipient address")
+
+var errNoRecipients = SMTPError("554 5.5.1 Error: no valid recipients")
+
+var errDataTimeout = SMTPError("451 4.4.2 Timeout waiting for end of data")
+
+// dataReadError ends the session after reading message data failed
+// with err, telling the client if it was too slow.
+func (s *session) dataReadError(err error) {
+	s.errorf("read error: %v", err)
+	s.quit = true
+	if isTimeout(err) && s.env != nil {
+		s.sendError(errDataTimeout)
+		s.logTransaction(451)
+		s.dropEnv()
+	}
+	s.hangUp()
+}
+
+var errMessageSizeDeclared = SMTPError("552 5.3.4 Error: message size exceeds fixed limit")
+
+var errMessageTooLarge = SMTPError("552 5.3.4 Error: message exceeds fixed maximum message size")
+
+func (srv *Server) maxDrainBytes() int64 {
+	if srv.MaxDrainBytes != 0 {
+		return srv.MaxDrainBytes
+	}
+	return 1 << 20
+}
+
 func (s *session) handleError(err error) {
 	if se, ok := err.(SMTPError); ok {
-		s.sendlinef("%s", se)
+		s.sendError(se)
 		return
 	}
 	log.Printf("Error: %s", err)
-	s.env = nil
+	s.sendlinef("451 4.3.0 Error: local error")
+	s.dropEnv()
+}
+
+// parseAddress parses a MAIL FROM or RCPT TO address with
+// Server.ParseAddress, if set, or else checks it with validPath, which
+// allows no domain if bare is set.
+func (s *session) parseAddress(raw string, bare bool) (MailAddress, error) {
+	if raw == "" {
+		return addrString(raw), nil
+	}
+	if s.srv.ParseAddress != nil {
+		return s.srv.ParseAddress(raw)
+	}
+	if !validPath(raw, bare) {
+		return nil, errBadAddrSyntax
+	}
+	return addrString(raw), nil
 }
 
 type addrString string
@@ -366,14 +2263,32 @@ func (a addrString) Email() string {
 	return string(a)
 }
 
+// Hostname returns the lowercased domain. Only the domain is
+// case-insensitive (RFC 5321 s2.4); Email keeps the local part as
+// sent. The last "@" is used, as a quoted local part may contain one.
 func (a addrString) Hostname() string {
 	e := string(a)
-	if idx := strings.Index(e, "@"); idx != -1 {
+	if idx := strings.LastIndex(e, "@"); idx != -1 {
 		return strings.ToLower(e[idx+1:])
 	}
 	return ""
 }
 
+// stripSourceRoute removes an RFC 821 source route ("@a,@b:user@c")
+// from addr, a MAIL FROM or RCPT TO address. RFC 5321 s3.3 and s4.1.1
+// say servers should accept and ignore it.
+func stripSourceRoute(addr string) string {
+	if !strings.HasPrefix(addr, "@") {
+		return addr
+	}
+	if idx := strings.Index(addr, ":"); idx != -1 {
+		return addr[idx+1:]
+	}
+	return addr
+}
+
+// cmdLine is a raw command line, including the CRLF. See
+// ParseCommand for a structured form.
 type cmdLine string
 
 func (cl cmdLine) checkValid() error {
@@ -391,12 +2306,37 @@ func (cl cmdLine) checkValid() error {
 	return nil
 }
 
+// raw returns the line without its CRLF.
+func (cl cmdLine) raw() string {
+	return strings.TrimSuffix(string(cl), "\r\n")
+}
+
+// Verb returns the command's verb, uppercased. Only ASCII letters are
+// changed: a verb with other bytes, valid UTF-8 or not, isn't one we
+// know, and shouldn't become one (as "maıl" would with unicode case
+// mapping) or be garbled in the logs.
 func (cl cmdLine) Verb() string {
 	s := string(cl)
 	if idx := strings.Index(s, " "); idx != -1 {
-		return strings.ToUpper(s[:idx])
+		return upperASCII(s[:idx])
+	}
+	return upperASCII(s[:len(s)-2])
+}
+
+// upperASCII returns s with its ASCII lowercase letters uppercased.
+func upperASCII(s string) string {
+	for i := 0; i < len(s); i++ {
+		if 'a' <= s[i] && s[i] <= 'z' {
+			b := []byte(s)
+			for j := i; j < len(b); j++ {
+				if 'a' <= b[j] && b[j] <= 'z' {
+					b[j] -= 'a' - 'A'
+				}
+			}
+			return string(b)
+		}
 	}
-	return strings.ToUpper(s[:len(s)-2])
+	return s
 }
 
 func (cl cmdLine) Arg() string {
@@ -411,6 +2351,26 @@ func (cl cmdLine) String() string {
 	return string(cl)
 }
 
+// redacted returns the line with any AUTH credentials replaced by
+// "<redacted>", for logging.
+func (cl cmdLine) redacted() string {
+	s := string(cl)
+	if len(s) < 5 || !strings.EqualFold(s[:5], "AUTH ") {
+		return s
+	}
+	// Keep "AUTH <mechanism>"; everything after is an initial response.
+	rest := strings.TrimLeft(s[5:], " ")
+	idx := strings.IndexAny(rest, " \r\n")
+	if idx == -1 || strings.TrimSpace(rest[idx:]) == "" {
+		return s
+	}
+	end := ""
+	if strings.HasSuffix(s, "\r\n") {
+		end = "\r\n"
+	}
+	return s[:len(s)-len(rest)] + rest[:idx] + " <redacted>" + end
+}
+
 type SMTPError string
 
 func (e SMTPError) Error() string {
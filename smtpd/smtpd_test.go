@@ -0,0 +1,1002 @@
+package smtpd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testServer serves srv on a random local port until the test ends
+// and returns the address to dial.
+func testServer(t testing.TB, srv *Server) string {
+	addr, _ := serveAsync(t, srv)
+	return addr
+}
+
+// serveAsync is like testServer but also returns a channel receiving
+// Serve's result. Hostname and OnNewMail are set if they're unset.
+func serveAsync(t testing.TB, srv *Server) (string, <-chan error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if srv.Hostname == "" {
+		srv.Hostname = "mx.test"
+	}
+	if srv.OnNewMail == nil {
+		srv.OnNewMail = func(c Connection, from MailAddress) (Envelope, error) {
+			return new(BasicEnvelope), nil
+		}
+	}
+	done := make(chan error, 1)
+	go func() { done <- srv.Serve(ln) }()
+	t.Cleanup(func() { ln.Close() })
+	return ln.Addr().String(), done
+}
+
+// testClient is the client side of a test session.
+type testClient struct {
+	t  testing.TB
+	c  net.Conn
+	br *bufio.Reader
+}
+
+// dialTest connects to addr and reads the banner.
+func dialTest(t testing.TB, addr string) *testClient {
+	t.Helper()
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	tc := &testClient{t: t, c: c, br: bufio.NewReader(c)}
+	tc.expect("", "220 ")
+	return tc
+}
+
+// send writes s to the server as is.
+func (tc *testClient) send(s string) {
+	tc.c.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	tc.c.Write([]byte(s))
+}
+
+// reply reads the next reply, joining the lines of a multiline one
+// with "\n". On a read error it returns "error: " and the error.
+func (tc *testClient) reply() string {
+	tc.c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var lines []string
+	for {
+		l, err := tc.br.ReadString('\n')
+		if err != nil {
+			return "error: " + err.Error()
+		}
+		l = strings.TrimSuffix(l, "\r\n")
+		lines = append(lines, l)
+		if len(l) < 4 || l[3] != '-' {
+			return strings.Join(lines, "\n")
+		}
+	}
+}
+
+// cmd sends line, with a CRLF, and returns the reply.
+func (tc *testClient) cmd(line string) string {
+	tc.send(line + "\r\n")
+	return tc.reply()
+}
+
+// expect sends line, if non-empty, and fails the test unless the
+// reply starts with want.
+func (tc *testClient) expect(line, want string) string {
+	tc.t.Helper()
+	var got string
+	if line == "" {
+		got = tc.reply()
+	} else {
+		got = tc.cmd(line)
+	}
+	if !strings.HasPrefix(got, want) {
+		tc.t.Fatalf("after %q: got %q, want %q...", line, got, want)
+	}
+	return got
+}
+
+// closed fails the test unless the server has closed the connection.
+func (tc *testClient) closed() {
+	tc.t.Helper()
+	if r := tc.reply(); !strings.HasPrefix(r, "error: ") {
+		tc.t.Fatalf("got %q, want the connection closed", r)
+	}
+}
+
+func TestDebugTranscript(t *testing.T) {
+	var buf syncBuffer
+	addr := testServer(t, &Server{DebugTranscript: &buf, Chunking: true})
+	c := dialTest(t, addr)
+	c.expect("HELO client.test", "250")
+	c.expect("MAIL FROM:<a@example.com>", "250")
+	c.expect("RCPT TO:<b@example.net>", "250")
+	c.expect("DATA", "354")
+	c.expect("Subject: hi\r\n\r\nbody\r\n.", "250")
+	c.expect("MAIL FROM:<a@example.com>", "250")
+	c.expect("RCPT TO:<b@example.net>", "250")
+	c.send("BDAT 6 LAST\r\nchunk\n")
+	c.expect("", "250")
+	c.expect("QUIT", "221")
+	c.closed()
+	want := []string{
+		"C: HELO client.test",
+		"S: 250 mx.test",
+		"C: DATA",
+		"S: 354 Go ahead",
+		"C: Subject: hi",
+		"C: body",
+		"C: .",
+		"C: BDAT 6 LAST",
+		"C: chunk",
+		"C: QUIT",
+		"S: 221 Bye",
+	}
+	got := buf.String()
+	for _, w := range want {
+		if !strings.Contains(got, w+"\n") {
+			t.Errorf("transcript lacks %q:\n%s", w, got)
+		}
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// captureLog sends the log package's output to the returned buffer
+// until the test ends.
+func captureLog(t testing.TB) *syncBuffer {
+	b := new(syncBuffer)
+	log.SetOutput(b)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return b
+}
+
+func TestOnHelloReject(t *testing.T) {
+	addr := testServer(t, &Server{
+		OnHello: func(c Connection, greeting, host string) error {
+			if strings.EqualFold(host, "localhost") {
+				return SMTPError("550 5.7.1 Your hostname is not allowed")
+			}
+			return nil
+		},
+	})
+	c := dialTest(t, addr)
+	c.expect("EHLO localhost", "550 Your hostname is not allowed")
+	c.expect("MAIL FROM:<a@example.com>", "503")
+	c.expect("EHLO client.test", "250")
+	c.expect("MAIL FROM:<a@example.com>", "250")
+
+	// After a successful EHLO, the rejection of a second keeps its
+	// enhanced code; the replies after it don't.
+	c.expect("RSET", "250")
+	c.expect("EHLO localhost", "550 5.7.1 Your hostname is not allowed")
+	c.expect("MAIL FROM:<a@example.com>", "503 Error: send HELO/EHLO first")
+}
+
+func TestUnknownCommands(t *testing.T) {
+	logs := captureLog(t)
+	srv := &Server{UnrecognizedReply: "500 5.5.1 What?"}
+	addr := testServer(t, srv)
+	c := dialTest(t, addr)
+	c.expect("EHLO client.test", "250")
+	c.expect("XYZZY", "500 5.5.1 What?")
+	c.expect("PLUGH", "500 5.5.1 What?")
+	c.expect("VRFY bob", "502 5.5.1 Command not implemented")
+	c.expect("QUIT", "221")
+	c.closed()
+	if n := srv.UnknownCommands(); n != 2 {
+		t.Errorf("UnknownCommands = %d, want 2", n)
+	}
+	if n := strings.Count(logs.String(), "verb: "); n != 1 {
+		t.Errorf("logged %d unknown commands, want 1:\n%s", n, logs)
+	}
+}
+
+// collector returns an OnNewMail function that collects messages, and
+// a function returning the last one collected.
+func collector() (func(Connection, MailAddress) (Envelope, error), func() *CollectingEnvelope) {
+	var mu sync.Mutex
+	var last *CollectingEnvelope
+	onNewMail := CollectMail(func(e *CollectingEnvelope) error {
+		mu.Lock()
+		defer mu.Unlock()
+		last = e
+		return nil
+	})
+	return onNewMail, func() *CollectingEnvelope {
+		mu.Lock()
+		defer mu.Unlock()
+		return last
+	}
+}
+
+// sendMail sends a message with DATA on c, which has greeted, and
+// returns the final reply.
+func (tc *testClient) sendMail(from, to, msg string) string {
+	tc.t.Helper()
+	tc.expect("MAIL FROM:<"+from+">", "250")
+	tc.expect("RCPT TO:<"+to+">", "250")
+	tc.expect("DATA", "354")
+	return tc.cmd(msg + "\r\n.")
+}
+
+func TestClose(t *testing.T) {
+	srv := &Server{}
+	addr, done := serveAsync(t, srv)
+	c := dialTest(t, addr)
+	c.expect("EHLO client.test", "250")
+	if err := srv.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != ErrServerClosed {
+			t.Errorf("Serve returned %v, want ErrServerClosed", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Serve still running after Close")
+	}
+	c.closed() // without a 421
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Error("listener still accepting after Close")
+	}
+}
+
+func TestPhaseTimeouts(t *testing.T) {
+	t.Run("first command", func(t *testing.T) {
+		addr := testServer(t, &Server{CommandTimeout: time.Minute, FirstCommandTimeout: 100 * time.Millisecond})
+		c := dialTest(t, addr)
+		start := time.Now()
+		c.expect("", "421 Timeout") // no enhanced code before EHLO
+		if d := time.Since(start); d > time.Second {
+			t.Errorf("first command timeout took %v", d)
+		}
+		c.closed()
+	})
+	t.Run("first command default", func(t *testing.T) {
+		if d := new(Server).firstCommandTimeout(); d != 5*time.Minute {
+			t.Errorf("with no timeouts set, got %v; want 5m", d)
+		}
+		if d := (&Server{CommandTimeout: time.Second}).firstCommandTimeout(); d != time.Second {
+			t.Errorf("with CommandTimeout 1s, got %v", d)
+		}
+	})
+	t.Run("command", func(t *testing.T) {
+		addr := testServer(t, &Server{CommandTimeout: 100 * time.Millisecond, DataTimeout: time.Minute})
+		c := dialTest(t, addr)
+		c.expect("EHLO client.test", "250")
+		start := time.Now()
+		c.expect("", "421 4.4.2 Timeout")
+		if d := time.Since(start); d > time.Second {
+			t.Errorf("command timeout took %v", d)
+		}
+		c.closed()
+	})
+	t.Run("data", func(t *testing.T) {
+		addr := testServer(t, &Server{CommandTimeout: time.Minute, DataTimeout: 100 * time.Millisecond})
+		c := dialTest(t, addr)
+		c.expect("EHLO client.test", "250")
+		c.expect("MAIL FROM:<a@example.com>", "250")
+		c.expect("RCPT TO:<b@example.net>", "250")
+		c.expect("DATA", "354")
+		c.send("Subject: slow\r\n")
+		c.expect("", "451 4.4.2 Timeout waiting for end of data")
+		c.closed()
+	})
+	t.Run("bdat", func(t *testing.T) {
+		addr, envs := txServer(t, &Server{Chunking: true, CommandTimeout: time.Minute, DataTimeout: 100 * time.Millisecond})
+		c := dialTest(t, addr)
+		c.expect("EHLO client.test", "250")
+		c.expect("MAIL FROM:<a@example.com>", "250")
+		c.expect("RCPT TO:<b@example.net>", "250")
+		c.send("BDAT 100 LAST\r\nSubject: slow\r\n")
+		c.expect("", "451 4.4.2 Timeout waiting for end of data")
+		c.closed()
+		if committed, rolledBack := (<-envs).wait(t); committed || !rolledBack {
+			t.Errorf("timed out message committed %v, rolled back %v", committed, rolledBack)
+		}
+	})
+	for _, step := range []string{"username", "password"} {
+		t.Run("auth "+step, func(t *testing.T) {
+			addr := testServer(t, &Server{
+				LoginAuth:      true,
+				CommandTimeout: time.Minute,
+				AuthTimeout:    100 * time.Millisecond,
+				OnAuth:         func(c Connection, user, pass string) error { return nil },
+			})
+			c := dialTest(t, addr)
+			c.expect("EHLO client.test", "250")
+			c.expect("AUTH LOGIN", "334 ")
+			if step == "password" {
+				c.expect("Ym9i", "334 ")
+			}
+			start := time.Now()
+			c.expect("", "421 4.4.2 Timeout")
+			if d := time.Since(start); d > time.Second {
+				t.Errorf("auth timeout took %v", d)
+			}
+			c.closed()
+		})
+	}
+	t.Run("data longer than command", func(t *testing.T) {
+		addr := testServer(t, &Server{CommandTimeout: 100 * time.Millisecond, DataTimeout: time.Minute})
+		c := dialTest(t, addr)
+		c.expect("EHLO client.test", "250")
+		c.expect("MAIL FROM:<a@example.com>", "250")
+		c.expect("RCPT TO:<b@example.net>", "250")
+		c.expect("DATA", "354")
+		c.send("Subject: slow\r\n")
+		time.Sleep(300 * time.Millisecond)
+		c.expect("\r\nbody\r\n.", "250")
+	})
+}
+
+func TestNoop(t *testing.T) {
+	const timeout = 200 * time.Millisecond
+	c := dialTest(t, testServer(t, &Server{CommandTimeout: timeout}))
+	c.expect("EHLO client.test", "250")
+	// NOOP's argument is ignored, and each NOOP restarts the idle
+	// timeout, so these outlast it several times over.
+	start := time.Now()
+	for time.Since(start) < 4*timeout {
+		c.expect("NOOP are you there?", "250 2.0.0 OK")
+		time.Sleep(timeout / 2)
+	}
+	c.expect("NOOP", "250 2.0.0 OK")
+	c.expect("", "421 4.4.2 Timeout")
+	c.closed()
+}
+
+func TestUnterminatedLineAtEOF(t *testing.T) {
+	logs := captureLog(t)
+	addr := testServer(t, &Server{})
+	c := dialTest(t, addr)
+	c.expect("EHLO client.test", "250")
+	c.send("NOOP")
+	c.c.(*net.TCPConn).CloseWrite()
+	c.expect("", "500 5.5.2 Error: line not terminated by CRLF")
+	c.closed()
+	if !strings.Contains(logs.String(), `unterminated line "NOOP"`) {
+		t.Errorf("unterminated command not logged:\n%s", logs)
+	}
+}
+
+func TestObsoleteVerbs(t *testing.T) {
+	srv := &Server{}
+	addr := testServer(t, srv)
+	c := dialTest(t, addr)
+	c.expect("EHLO client.test", "250")
+	for _, verb := range []string{"SEND", "SOML", "SAML", "send"} {
+		c.expect(verb+" FROM:<a@example.com>", "502 5.5.1 Command not implemented")
+	}
+	if n := srv.UnknownCommands(); n != 0 {
+		t.Errorf("UnknownCommands = %d, want 0", n)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	t.Run("fast", func(t *testing.T) {
+		srv := &Server{}
+		addr, done := serveAsync(t, srv)
+		idle := dialTest(t, addr)
+		idle.expect("EHLO client.test", "250")
+		busy := dialTest(t, addr)
+		busy.expect("EHLO client.test", "250")
+		busy.expect("MAIL FROM:<a@example.com>", "250")
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shut := make(chan error, 1)
+		go func() { shut <- srv.Shutdown(ctx) }()
+
+		idle.expect("", "421 4.3.2 Service shutting down")
+		idle.closed()
+		// The transaction in progress may finish.
+		busy.expect("RCPT TO:<b@example.net>", "250")
+		busy.expect("DATA", "354")
+		busy.expect("Subject: hi\r\n\r\nbody\r\n.", "250")
+		busy.expect("", "421 4.3.2 Service shutting down")
+		busy.closed()
+		if err := <-shut; err != nil {
+			t.Errorf("Shutdown = %v, want nil", err)
+		}
+		if err := <-done; err != ErrServerClosed {
+			t.Errorf("Serve = %v, want ErrServerClosed", err)
+		}
+	})
+	t.Run("stuck", func(t *testing.T) {
+		srv := &Server{}
+		addr, _ := serveAsync(t, srv)
+		stuck := dialTest(t, addr)
+		stuck.expect("EHLO client.test", "250")
+		stuck.expect("MAIL FROM:<a@example.com>", "250")
+
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		if err := srv.Shutdown(ctx); err != context.DeadlineExceeded {
+			t.Errorf("Shutdown = %v, want DeadlineExceeded", err)
+		}
+		if d := time.Since(start); d > 2*time.Second {
+			t.Errorf("Shutdown took %v", d)
+		}
+		stuck.expect("", "421 4.3.2 Service shutting down")
+		stuck.closed()
+	})
+}
+
+// waitListening waits for srv to be listening and returns its address.
+func waitListening(t testing.TB, srv *Server) net.Addr {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if a := srv.ListenerAddr(); a != nil {
+			return a
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("server never started listening")
+	return nil
+}
+
+func TestListenerAddr(t *testing.T) {
+	srv := &Server{Addr: "127.0.0.1:0", Hostname: "mx.test"}
+	if a := srv.ListenerAddr(); a != nil {
+		t.Fatalf("ListenerAddr before serving = %v, want nil", a)
+	}
+	done := make(chan error, 1)
+	go func() { done <- srv.ListenAndServe() }()
+	a := waitListening(t, srv)
+	if port := a.(*net.TCPAddr).Port; port == 0 {
+		t.Fatalf("ListenerAddr = %v, want a concrete port", a)
+	}
+	dialTest(t, a.String()).expect("QUIT", "221")
+	srv.Close()
+	if err := <-done; err != ErrServerClosed {
+		t.Errorf("ListenAndServe = %v, want ErrServerClosed", err)
+	}
+	if a := srv.ListenerAddr(); a != nil {
+		t.Errorf("ListenerAddr after Close = %v, want nil", a)
+	}
+}
+
+func TestHandle(t *testing.T) {
+	srv := &Server{}
+	var gotArg string
+	srv.Handle("xdebug", func(c Connection, arg string) error {
+		gotArg = arg
+		if arg == "fail" {
+			return SMTPError("550 5.7.0 No debugging")
+		}
+		return nil
+	})
+	srv.Handle("NOOP", func(c Connection, arg string) error {
+		return SMTPError("250 2.0.0 Custom NOOP")
+	})
+	addr := testServer(t, srv)
+	c := dialTest(t, addr)
+	c.expect("EHLO client.test", "250")
+	c.expect("XDEBUG level 3", "250 2.0.0 OK")
+	if gotArg != "level 3" {
+		t.Errorf("handler got arg %q, want %q", gotArg, "level 3")
+	}
+	c.expect("xdebug fail", "550 5.7.0 No debugging")
+	c.expect("NOOP", "250 2.0.0 Custom NOOP")
+	c.expect("RSET", "250 2.0.0 OK") // built-in
+}
+
+func TestStream(t *testing.T) {
+	srv := &Server{}
+	srv.Handle("XECHO", func(c Connection, arg string) error {
+		_, rw := c.(Streamer).Stream()
+		rw.WriteString("354 Send a line\r\n")
+		rw.Flush()
+		line, err := rw.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if strings.TrimSpace(line) == "bye" {
+			return errors.New("client left the echo")
+		}
+		rw.WriteString("250 " + line)
+		return rw.Flush()
+	})
+	addr := testServer(t, srv)
+	c := dialTest(t, addr)
+	c.expect("EHLO client.test", "250")
+	c.expect("XECHO", "354 Send a line")
+	c.expect("hello there", "250 hello there")
+	c.expect("NOOP", "250") // back to SMTP
+
+	// The line sent along with the command reaches the handler.
+	c.send("XECHO\r\npipelined\r\n")
+	c.expect("", "354")
+	c.expect("", "250 pipelined")
+	c.expect("NOOP", "250")
+
+	c.expect("XECHO", "354")
+	c.send("bye\r\n")
+	c.closed()
+}
+
+// reusePortConfig returns a ListenConfig setting SO_REUSEPORT and a
+// free loopback address to open several listeners on with it, or
+// skips the test where SO_REUSEPORT is unavailable.
+func reusePortConfig(t testing.TB) (*net.ListenConfig, string) {
+	if reusePort == nil {
+		t.Skip("no SO_REUSEPORT on this system")
+	}
+	lc := &net.ListenConfig{Control: reusePort}
+	ln, err := lc.Listen(context.Background(), "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("SO_REUSEPORT unavailable: %v", err)
+	}
+	defer ln.Close()
+	return lc, ln.Addr().String()
+}
+
+func TestListeners(t *testing.T) {
+	lc, addr := reusePortConfig(t)
+	srv := &Server{Addr: addr, Hostname: "mx.test", ListenConfig: lc, Listeners: 3}
+	done := make(chan error, 1)
+	go func() { done <- srv.ListenAndServe() }()
+	waitListening(t, srv)
+	for i := 0; i < 10; i++ {
+		dialTest(t, addr).expect("QUIT", "221")
+	}
+	srv.Close()
+	if err := <-done; err != ErrServerClosed {
+		t.Errorf("ListenAndServe = %v, want ErrServerClosed", err)
+	}
+	// Every listener is closed, not just the one that returned first;
+	// a dial would otherwise land on a leftover one now and then.
+	for i := 0; i < 10; i++ {
+		if c, err := net.Dial("tcp", addr); err == nil {
+			c.Close()
+			t.Fatal("still accepting after Close")
+		}
+	}
+}
+
+func TestListenersWithoutReusePort(t *testing.T) {
+	// Without SO_REUSEPORT the second listener can't bind, so
+	// ListenAndServe fails and closes the first.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	srv := &Server{Addr: addr, Hostname: "mx.test", Listeners: 2}
+	if err := srv.ListenAndServe(); err == nil || err == ErrServerClosed {
+		t.Fatalf("ListenAndServe = %v, want a listen error", err)
+	}
+	ln, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("port still in use after the failed ListenAndServe: %v", err)
+	}
+	ln.Close()
+}
+
+func TestValidHelloHost(t *testing.T) {
+	for host, want := range map[string]bool{
+		"client.test":           true,
+		"localhost":             true,
+		"a-b.example":           true,
+		"[192.0.2.1]":           true,
+		"[IPv6:2001:db8::1]":    true,
+		"":                      false,
+		"under_score.test":      false,
+		"-lead.test":            false,
+		"double..dot":           false,
+		"[192.0.2]":             false,
+		"[2001:db8::1]":         false,
+		"[IPv6:192.0.2.1]":      false,
+		strings.Repeat("a", 64): false,
+	} {
+		if got := validHelloHost(host); got != want {
+			t.Errorf("validHelloHost(%q) = %v, want %v", host, got, want)
+		}
+	}
+}
+
+func TestStrictHello(t *testing.T) {
+	lax := dialTest(t, testServer(t, &Server{}))
+	strict := dialTest(t, testServer(t, &Server{StrictHello: true}))
+	for _, c := range []*testClient{lax, strict} {
+		// No enhanced codes until a greeting succeeds.
+		c.expect("EHLO", "501 Invalid domain name")
+		c.expect("HELO", "501 Invalid domain name")
+		c.expect("EHLO client.test", "250")
+		c.expect("EHLO [192.0.2.1]", "250")
+		c.expect("EHLO [IPv6:2001:db8::1]", "250")
+	}
+	lax.expect("EHLO under_score", "250")
+	strict.expect("EHLO under_score", "501 5.5.4 Invalid domain name")
+	strict.expect("EHLO bad\x01host", "501 5.5.4 Invalid HELO argument")
+}
+
+func TestExtensionsByClient(t *testing.T) {
+	addr := testServer(t, &Server{
+		Extensions: func(c Connection, exts []string) []string {
+			if c.Addr().(*net.TCPAddr).IP.Equal(net.IPv4(127, 0, 0, 2)) {
+				exts = append(exts, "XSUBMIT")
+			}
+			return exts
+		},
+	})
+	from := func(ip string) *testClient {
+		d := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(ip)}}
+		conn, err := d.Dial("tcp", addr)
+		if err != nil {
+			t.Skipf("can't dial from %s: %v", ip, err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		c := &testClient{t: t, c: conn, br: bufio.NewReader(conn)}
+		c.expect("", "220 ")
+		return c
+	}
+	if r := from("127.0.0.1").expect("EHLO client.test", "250"); strings.Contains(r, "XSUBMIT") {
+		t.Errorf("127.0.0.1 was offered XSUBMIT:\n%s", r)
+	}
+	if r := from("127.0.0.2").expect("EHLO client.test", "250"); !strings.Contains(r, "250 XSUBMIT") {
+		t.Errorf("127.0.0.2 wasn't offered XSUBMIT:\n%s", r)
+	}
+}
+
+func TestHostnameFallback(t *testing.T) {
+	t.Setenv("PATH", "") // no hostname command
+	srv := &Server{}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(ln)
+	t.Cleanup(func() { ln.Close() })
+	name := srv.hostname()
+	if name == "" || strings.ContainsAny(name, " \t\r\n") {
+		t.Fatalf("hostname() = %q, want a non-empty name", name)
+	}
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	tc := &testClient{t: t, c: conn, br: bufio.NewReader(conn)}
+	if got, want := tc.reply(), "220 "+name+" ESMTP gosmtpd"; got != want {
+		t.Errorf("banner %q, want %q", got, want)
+	}
+	if got := tc.cmd("EHLO client.test"); !strings.HasPrefix(got, "250-"+name+"\n") {
+		t.Errorf("EHLO reply starts %q, want 250-%s", got, name)
+	}
+}
+
+func TestListenAndServeDualStack(t *testing.T) {
+	ln6, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	}
+	port := ln6.Addr().(*net.TCPAddr).Port
+	ln6.Close()
+	srv := &Server{Addr: net.JoinHostPort("", strconv.Itoa(port)), Hostname: "mx.test"}
+	done := make(chan error, 1)
+	go func() { done <- srv.ListenAndServeDualStack() }()
+	waitListening(t, srv)
+	var clients []*testClient
+	for _, host := range []string{"127.0.0.1", "::1"} {
+		c := dialTest(t, net.JoinHostPort(host, strconv.Itoa(port)))
+		c.expect("EHLO client.test", "250")
+		clients = append(clients, c)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown = %v", err)
+	}
+	for _, c := range clients {
+		c.expect("", "421 4.3.2 Service shutting down")
+		c.closed()
+	}
+	if err := <-done; err != ErrServerClosed {
+		t.Errorf("ListenAndServeDualStack = %v, want ErrServerClosed", err)
+	}
+	for _, host := range []string{"127.0.0.1", "::1"} {
+		if c, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(port))); err == nil {
+			c.Close()
+			t.Errorf("%s still accepting after Shutdown", host)
+		}
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	logs := captureLog(t)
+	// A banner too big for the socket buffers of a client that never
+	// reads.
+	addr := testServer(t, &Server{
+		Hostname:     strings.Repeat("a", 16<<20),
+		WriteTimeout: 100 * time.Millisecond,
+	})
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(logs.String(), "write error") {
+		if time.Now().After(deadline) {
+			t.Fatalf("server still writing; log:\n%s", logs)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !strings.Contains(logs.String(), "i/o timeout") {
+		t.Errorf("logged %q, want a write timeout", logs)
+	}
+}
+
+func TestCallbackPanic(t *testing.T) {
+	logs := captureLog(t)
+	addr := testServer(t, &Server{
+		OnNewMail: func(c Connection, from MailAddress) (Envelope, error) {
+			if from.Email() == "panic@b.test" {
+				panic("boom")
+			}
+			return new(BasicEnvelope), nil
+		},
+	})
+	c := dialTest(t, addr)
+	c.expect("EHLO client.test", "250")
+	c.expect("MAIL FROM:<panic@b.test>", "451 4.3.0 Internal server error")
+	c.closed()
+	if !strings.Contains(logs.String(), "panic serving") || !strings.Contains(logs.String(), "boom") {
+		t.Errorf("panic not logged:\n%s", logs)
+	}
+	// Other sessions carry on.
+	c = dialTest(t, addr)
+	c.expect("EHLO client.test", "250")
+	c.expect("MAIL FROM:<a@b.test>", "250")
+}
+
+func TestDisabledVerbs(t *testing.T) {
+	srv := &Server{
+		DisabledVerbs: []string{"vrfy", "AUTH"},
+		PlainAuth:     true,
+		OnAuth:        func(c Connection, user, pass string) error { return nil },
+	}
+	verify := func(c Connection, arg string) error {
+		return SMTPError("252 2.5.0 Cannot verify, but will accept")
+	}
+	srv.Handle("VRFY", verify)
+	srv.Handle("EXPN", verify)
+	c := dialTest(t, testServer(t, srv))
+	if r := c.expect("EHLO client.test", "250"); strings.Contains(r, "AUTH") {
+		t.Errorf("disabled AUTH still advertised:\n%s", r)
+	}
+	c.expect("VRFY bob", "502 5.5.1 Command disabled")
+	c.expect("AUTH PLAIN AHVzZXIAcGFzcw==", "502 5.5.1 Command disabled")
+	c.expect("EXPN staff", "252 2.5.0") // not disabled
+	c.expect("RSET", "250")
+}
+
+func TestBannerWriteFails(t *testing.T) {
+	logs := captureLog(t)
+	gone := make(chan struct{})
+	addr := testServer(t, &Server{
+		OnNewConnection: func(c Connection) error {
+			<-gone
+			time.Sleep(50 * time.Millisecond) // let the RST arrive
+			return nil
+		},
+	})
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.(*net.TCPConn).SetLinger(0) // reset rather than close
+	c.Close()
+	close(gone)
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(logs.String(), "write error") {
+		if time.Now().After(deadline) {
+			t.Fatalf("banner write didn't fail; log:\n%s", logs)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// A failed write closes the connection, so a read after it would
+	// log this rather than EOF.
+	time.Sleep(50 * time.Millisecond)
+	if strings.Contains(logs.String(), "use of closed network connection") {
+		t.Errorf("session went on to read after the banner failed:\n%s", logs)
+	}
+}
+
+func TestLongReplyLines(t *testing.T) {
+	words := strings.Repeat("word ", 300)
+	addr := testServer(t, &Server{
+		Extensions: func(c Connection, exts []string) []string {
+			return append(exts, "XWORDS "+words, "XSOLID "+strings.Repeat("x", 1200), "XLAST")
+		},
+	})
+	c := dialTest(t, addr)
+	c.send("EHLO client.test\r\n")
+	c.c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var text []string
+	for {
+		l, err := c.br.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(l) > maxReplyLine || !strings.HasSuffix(l, "\r\n") {
+			t.Errorf("reply line of %d bytes: %.40q...", len(l), l)
+		}
+		if !strings.HasPrefix(l, "250-") && !strings.HasPrefix(l, "250 ") {
+			t.Fatalf("bad continuation marker: %.40q", l)
+		}
+		text = append(text, strings.TrimSuffix(l[4:], "\r\n"))
+		if l[3] == ' ' {
+			break
+		}
+	}
+	if text[len(text)-1] != "XLAST" {
+		t.Errorf("last line %q, want XLAST", text[len(text)-1])
+	}
+	all := strings.Join(text, " ")
+	if !strings.Contains(all, "XWORDS "+strings.TrimSpace(words)) {
+		t.Error("words split other than at spaces")
+	}
+	if !strings.Contains(strings.Join(text, ""), strings.Repeat("x", 1200)) {
+		t.Error("unbroken text lost in splitting")
+	}
+	c.expect("NOOP", "250")
+}
+
+func TestOnRcpt(t *testing.T) {
+	onNewMail, last := collector()
+	addr := testServer(t, &Server{
+		OnNewMail: onNewMail,
+		OnRcpt: func(c Connection, from, rcpt MailAddress) error {
+			switch rcpt.Email() {
+			case "unknown@d.test":
+				return ErrUserUnknown
+			case "full@d.test":
+				return ErrMailboxFull
+			case "busy@d.test":
+				return ErrMailboxUnavailable
+			case "broken@d.test":
+				return errors.New("directory lookup failed")
+			}
+			return nil
+		},
+		StatusCodes: map[string]string{"user_unknown": "550 5.1.1 No such user here"},
+	})
+	// ErrUserUnknown is replaced through StatusCodes, and stands in
+	// for errors that aren't SMTPErrors.
+	c := dialTest(t, addr)
+	c.expect("EHLO client.test", "250")
+	c.expect("MAIL FROM:<a@b.test>", "250")
+	for _, tt := range []struct{ rcpt, want string }{
+		{"unknown@d.test", "550 5.1.1 No such user here"},
+		{"full@d.test", "452 4.2.2 Mailbox full"},
+		{"busy@d.test", "450 4.2.1 Mailbox temporarily unavailable"},
+		{"broken@d.test", "550 5.1.1 No such user here"},
+		{"ok@d.test", "250 2.1.0 Ok"},
+	} {
+		if got := c.cmd("RCPT TO:<" + tt.rcpt + ">"); got != tt.want {
+			t.Errorf("RCPT TO:<%s>: got %q, want %q", tt.rcpt, got, tt.want)
+		}
+	}
+	c.expect("DATA", "354")
+	c.expect("body\r\n.", "250")
+	if rcpts := last().Rcpts; len(rcpts) != 1 || rcpts[0].Email() != "ok@d.test" {
+		t.Errorf("delivered to %v, want only the accepted recipient", rcpts)
+	}
+}
+
+func TestOnRcptSender(t *testing.T) {
+	addr := testServer(t, &Server{
+		// Any sender is accepted at MAIL FROM; the policy only lets
+		// interns mail the team address.
+		OnRcpt: func(c Connection, from, rcpt MailAddress) error {
+			if strings.HasPrefix(from.Email(), "intern@") && rcpt.Email() != "team@corp.test" {
+				return ErrSenderNotAllowed
+			}
+			return nil
+		},
+	})
+	c := dialTest(t, addr)
+	c.expect("EHLO client.test", "250")
+	c.expect("MAIL FROM:<intern@corp.test>", "250")
+	c.expect("RCPT TO:<team@corp.test>", "250")
+	c.expect("RCPT TO:<all@corp.test>", "550 5.7.1 Sender not allowed for this recipient")
+	c.expect("RSET", "250")
+	c.expect("MAIL FROM:<boss@corp.test>", "250")
+	c.expect("RCPT TO:<all@corp.test>", "250")
+}
+
+func TestQuitMessage(t *testing.T) {
+	for _, tt := range []struct {
+		msg, want string
+	}{
+		{"", "221 2.0.0 Bye"},
+		{"2.0.0 Thanks for stopping by", "221 2.0.0 Thanks for stopping by"},
+		{"2.0.0 Goodbye\nUse is subject to our terms", "221-2.0.0 Goodbye\n221 Use is subject to our terms"},
+		{"2.0.0 Bye\r\n250 Injected", "221 2.0.0 Bye"},
+	} {
+		c := dialTest(t, testServer(t, &Server{QuitMessage: tt.msg}))
+		c.expect("EHLO client.test", "250")
+		if got := c.cmd("QUIT"); got != tt.want {
+			t.Errorf("QuitMessage %q: got %q, want %q", tt.msg, got, tt.want)
+		}
+		c.closed()
+	}
+}
+
+// failingListener is a net.Listener whose Accept fails with err.
+type failingListener struct {
+	net.Listener
+	err error
+}
+
+func (l failingListener) Accept() (net.Conn, error) { return nil, l.err }
+
+func TestServeErrors(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	broken := errors.New("listener broken")
+	srv := &Server{Hostname: "mx.test"}
+	if err := srv.Serve(failingListener{ln, broken}); err != broken {
+		t.Errorf("Serve on a failing listener = %v, want its error", err)
+	}
+
+	srv = &Server{Hostname: "mx.test"}
+	_, done := serveAsync(t, srv)
+	waitListening(t, srv)
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != ErrServerClosed {
+		t.Errorf("Serve after Shutdown = %v, want ErrServerClosed", err)
+	}
+	// Once shut down, a Server serves nothing more.
+	ln2, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Serve(ln2); err != ErrServerClosed {
+		t.Errorf("Serve on a shut down Server = %v, want ErrServerClosed", err)
+	}
+	srv.Addr = "127.0.0.1:0"
+	if err := srv.ListenAndServe(); err != ErrServerClosed {
+		t.Errorf("ListenAndServe on a shut down Server = %v, want ErrServerClosed", err)
+	}
+}
@@ -0,0 +1,120 @@
+// Package smtptest provides utilities for end-to-end testing of
+// smtpd Servers over real connections.
+package smtptest
+
+import (
+	"bufio"
+	"net"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/go-smtpd/smtpd"
+)
+
+// Step is one step of a script run by Run.
+type Step struct {
+	Send   string // sent to the server followed by CRLF, if non-empty
+	Expect string // regexp the next (possibly multiline) reply must match, if non-empty
+}
+
+// Server is an smtpd.Server listening on a random local port.
+type Server struct {
+	*smtpd.Server
+	Addr string // address to dial, "127.0.0.1:port"
+}
+
+// NewServer starts srv on a random local port. The caller should call
+// Close when done.
+func NewServer(srv *smtpd.Server) *Server {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic("smtptest: failed to listen: " + err.Error())
+	}
+	go srv.Serve(ln)
+	return &Server{Server: srv, Addr: ln.Addr().String()}
+}
+
+// Timeout bounds how long Run waits for each reply.
+var Timeout = 5 * time.Second
+
+// Run dials addr and runs script, failing t at the first reply that
+// doesn't match. Multiline replies are matched as their lines joined
+// by "\n", without CRLFs. Scripts usually start with a step expecting
+// the "220" banner.
+func Run(t testing.TB, addr string, script []Step) {
+	t.Helper()
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("smtptest: dial %s: %v", addr, err)
+	}
+	defer c.Close()
+	br := bufio.NewReader(c)
+	for i, step := range script {
+		if step.Send != "" {
+			c.SetWriteDeadline(time.Now().Add(Timeout))
+			if _, err := c.Write([]byte(step.Send + "\r\n")); err != nil {
+				t.Fatalf("smtptest: step %d: sending %q: %v", i, step.Send, err)
+			}
+		}
+		if step.Expect == "" {
+			continue
+		}
+		re, err := regexp.Compile(step.Expect)
+		if err != nil {
+			t.Fatalf("smtptest: step %d: bad Expect regexp: %v", i, err)
+		}
+		c.SetReadDeadline(time.Now().Add(Timeout))
+		got, err := readReply(br)
+		if err != nil {
+			t.Fatalf("smtptest: step %d: after sending %q: reading reply: %v", i, step.Send, err)
+		}
+		if !re.MatchString(got) {
+			t.Fatalf("smtptest: step %d: after sending %q:\n got: %q\nwant: /%s/", i, step.Send, got, step.Expect)
+		}
+	}
+}
+
+// readReply reads one reply, joining its lines with "\n".
+func readReply(br *bufio.Reader) (string, error) {
+	var lines []string
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return strings.Join(lines, "\n"), err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		lines = append(lines, line)
+		if len(line) < 4 || line[3] != '-' {
+			return strings.Join(lines, "\n"), nil
+		}
+	}
+}
+
+// BasicDelivery returns a script that delivers a short message from
+// from to to, expecting every step to succeed.
+func BasicDelivery(from, to string) []Step {
+	return []Step{
+		{Expect: `^220 `},
+		{Send: "EHLO client.example.com", Expect: `^250[ -]`},
+		{Send: "MAIL FROM:<" + from + ">", Expect: `^250 `},
+		{Send: "RCPT TO:<" + to + ">", Expect: `^250 `},
+		{Send: "DATA", Expect: `^354 `},
+		{Send: "Subject: test\r\n\r\nHello.\r\n.", Expect: `^250 `},
+		{Send: "QUIT", Expect: `^221 `},
+	}
+}
+
+// RejectedRecipient returns a script that expects RCPT TO rcpt to be
+// permanently rejected and then DATA to be refused.
+func RejectedRecipient(from, rcpt string) []Step {
+	return []Step{
+		{Expect: `^220 `},
+		{Send: "EHLO client.example.com", Expect: `^250[ -]`},
+		{Send: "MAIL FROM:<" + from + ">", Expect: `^250 `},
+		{Send: "RCPT TO:<" + rcpt + ">", Expect: `^5\d\d `},
+		{Send: "DATA", Expect: `^5\d\d `},
+		{Send: "QUIT", Expect: `^221 `},
+	}
+}
@@ -0,0 +1,96 @@
+package smtptest
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/bradfitz/go-smtpd/smtpd"
+)
+
+func newTestServer(t *testing.T, srv *smtpd.Server) *Server {
+	srv.Hostname = "mx.test"
+	srv.OnNewMail = func(c smtpd.Connection, from smtpd.MailAddress) (smtpd.Envelope, error) {
+		return new(smtpd.BasicEnvelope), nil
+	}
+	s := NewServer(srv)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestBasicDelivery(t *testing.T) {
+	s := newTestServer(t, &smtpd.Server{})
+	Run(t, s.Addr, BasicDelivery("a@example.com", "b@example.net"))
+}
+
+func TestRejectedRecipient(t *testing.T) {
+	s := newTestServer(t, &smtpd.Server{
+		OnRcpt: func(c smtpd.Connection, from, rcpt smtpd.MailAddress) error {
+			return smtpd.ErrUserUnknown
+		},
+	})
+	Run(t, s.Addr, RejectedRecipient("a@example.com", "nobody@example.net"))
+}
+
+// recorder is a testing.TB that records the failure Run reports.
+type recorder struct {
+	testing.TB
+	failure string
+}
+
+func (r *recorder) Helper() {}
+
+func (r *recorder) Fatalf(format string, args ...interface{}) {
+	r.failure = fmt.Sprintf(format, args...)
+	runtime.Goexit()
+}
+
+func TestRunMismatch(t *testing.T) {
+	s := newTestServer(t, &smtpd.Server{})
+	r := &recorder{TB: t}
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		Run(r, s.Addr, []Step{
+			{Expect: `^220 `},
+			{Send: "EHLO client.example.com", Expect: `^250[ -]`},
+			{Send: "MAIL FROM:<a@example.com>", Expect: `^451 `},
+		})
+	}()
+	<-done
+	if !strings.Contains(r.failure, "step 2") || !strings.Contains(r.failure, "250 2.1.0 Ok") {
+		t.Errorf("failure = %q, want step 2 with the reply", r.failure)
+	}
+}
+
+// TestHELOClient runs an RFC 821-era session: HELO, then each command
+// waiting for its reply, and no reply may carry an enhanced status
+// code, including multiline and customized ones.
+func TestHELOClient(t *testing.T) {
+	s := newTestServer(t, &smtpd.Server{
+		QuitMessage: "2.0.0 Thanks\nCome again",
+		Help:        map[string]string{"XFOO": "2.0.0 XFOO <arg>\nRuns foo"},
+		OnRcpt: func(c smtpd.Connection, from, rcpt smtpd.MailAddress) error {
+			if rcpt.Email() == "nobody@example.net" {
+				return smtpd.ErrUserUnknown
+			}
+			return nil
+		},
+	})
+	Run(t, s.Addr, []Step{
+		{Expect: `^220 `},
+		{Send: "HELO client.example.com", Expect: `^250 mx\.test$`},
+		{Send: "HELP", Expect: `^214 Commands: `},
+		{Send: "HELP XFOO", Expect: `^214-XFOO <arg>\n214 Runs foo$`},
+		{Send: "MAIL FROM:<a@example.com>", Expect: `^250 Ok$`},
+		{Send: "RCPT TO:<nobody@example.net>", Expect: `^550 User unknown$`},
+		{Send: "RCPT TO:<b@example.net>", Expect: `^250 Ok$`},
+		{Send: "DATA", Expect: `^354 `},
+		{Send: "Subject: test\r\n\r\nHello.\r\n.", Expect: `^250 Ok: queued as `},
+		{Send: "BDAT 10 LAST", Expect: `^5\d\d [^0-9]`},
+		{Send: "NOOP", Expect: `^250 OK$`},
+		{Send: "RSET", Expect: `^250 OK$`},
+		{Send: "QUIT", Expect: `^221-Thanks\n221 Come again$`},
+	})
+}
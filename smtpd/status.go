@@ -0,0 +1,82 @@
+package smtpd
+
+import "strings"
+
+// statusNames names the server's own replies that can be replaced
+// through Server.StatusCodes.
+var statusNames = map[SMTPError]string{
+	errAuthFailed:          "auth_failed",
+	errBadAddrSyntax:       "bad_address_syntax",
+	errBareRecipient:       "bare_recipient",
+	errClientCertRequired:  "client_cert_required",
+	errCommandTimeout:      "command_timeout",
+	errConnBurst:           "connection_burst",
+	errConnByteLimit:       "connection_byte_limit",
+	errDeferAll:            "defer_all",
+	errDomainNotFound:      "domain_not_found",
+	errDuplicateParam:      "duplicate_parameter",
+	errEarlyData:           "early_data",
+	errGreylisted:          "greylisted",
+	errInvalidHello:        "invalid_hello",
+	errInvalidHelloArg:     "invalid_hello_argument",
+	errInvalidUTF8:         "invalid_utf8",
+	errMessageSizeDeclared: "declared_size_too_large",
+	errMessageTooLarge:     "message_too_large",
+	errNoRecipients:        "no_recipients",
+	errNonASCIIAddress:     "non_ascii_address",
+	errNonASCIIHeader:      "non_ascii_header",
+	errRelayDenied:         "relay_denied",
+	errShuttingDown:        "shutting_down",
+	errTooBusy:             "too_busy",
+	errTooManyAuthFailures: "too_many_auth_failures",
+	errTooManyBounceRcpts:  "too_many_bounce_recipients",
+	errTooManyErrors:       "too_many_errors",
+	errTooManyLines:        "too_many_lines",
+	errTooManyMessages:     "too_many_messages",
+	errTooManySessions:     "too_many_sessions",
+	ErrUserUnknown:         "user_unknown",
+}
+
+// status returns the reply to send for se: its replacement from
+// StatusCodes, if it names one of the server's replies that has one,
+// else se itself.
+func (srv *Server) status(se SMTPError) SMTPError {
+	if name, ok := statusNames[se]; ok {
+		if code, ok := srv.StatusCodes[name]; ok {
+			return SMTPError(code)
+		}
+	}
+	return se
+}
+
+// stripEnhancedCode returns reply, a reply line, without the enhanced
+// status code after its reply code, if it has one, for clients that
+// didn't greet with EHLO and so may not expect them (RFC 2034 s3).
+func stripEnhancedCode(reply string) string {
+	if len(reply) < 4 || reply[3] != ' ' && reply[3] != '-' {
+		return reply
+	}
+	rest := reply[4:]
+	i := strings.IndexByte(rest, ' ')
+	if i < 0 {
+		return reply
+	}
+	parts := strings.Split(rest[:i], ".")
+	if len(parts) != 3 || len(parts[0]) != 1 || !strings.Contains("245", parts[0]) {
+		return reply
+	}
+	for _, p := range parts {
+		if p == "" || len(p) > 3 || strings.Trim(p, "0123456789") != "" {
+			return reply
+		}
+	}
+	return reply[:4] + rest[i+1:]
+}
+
+// sendError sends err, an SMTPError, to the client.
+func (s *session) sendError(err error) {
+	if se, ok := err.(SMTPError); ok {
+		err = s.srv.status(se)
+	}
+	s.sendlinef("%s", err)
+}
@@ -0,0 +1,42 @@
+package smtpd
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestStatusCodes(t *testing.T) {
+	addr := testServer(t, &Server{
+		LocalDomains: []string{"example.com"},
+		PlainAuth:    true,
+		OnAuth: func(c Connection, user, pass string) error {
+			return errors.New("bad password")
+		},
+		StatusCodes: map[string]string{
+			"relay_denied": "554 5.7.1 Relaying denied",
+			"auth_failed":  "535 5.7.8 Bad credentials",
+		},
+	})
+	c := dialTest(t, addr)
+	c.expect("EHLO client.test", "250")
+	c.expect("AUTH PLAIN AHVzZXIAcGFzcw==", "535 5.7.8 Bad credentials")
+	c.expect("MAIL FROM:<a@elsewhere.test>", "250")
+	c.expect("RCPT TO:<b@elsewhere.test>", "554 5.7.1 Relaying denied")
+	// Situations not in the map keep their default reply.
+	c.expect("RCPT TO:<>", "501 5.1.7 Bad sender address syntax")
+	c.expect("RCPT TO:<b@example.com>", "250")
+}
+
+func TestStripEnhancedCode(t *testing.T) {
+	for in, want := range map[string]string{
+		"250 2.1.0 Ok":        "250 Ok",
+		"250-2.0.0 SIZE 1000": "250-SIZE 1000",
+		"220 mx.test ESMTP":   "220 mx.test ESMTP",
+		"550 5.7.1":           "550 5.7.1",
+		"221 Bye":             "221 Bye",
+	} {
+		if got := stripEnhancedCode(in); got != want {
+			t.Errorf("stripEnhancedCode(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
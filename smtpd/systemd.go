@@ -0,0 +1,54 @@
+package smtpd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd.
+const listenFDsStart = 3
+
+// SystemdListeners returns the listening sockets passed to the process
+// by systemd socket activation, as described in sd_listen_fds(3). It
+// returns nil if there are none, as when the process wasn't socket
+// activated. The LISTEN_ environment variables are unset so child
+// processes don't also try to use the sockets.
+//
+// With a socket unit listening on port 25, a server can be restarted
+// without refusing connections:
+//
+//	lns, err := smtpd.SystemdListeners()
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	log.Fatal(srv.ServeFromListeners(lns))
+func SystemdListeners() ([]net.Listener, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+	lns := make([]net.Listener, 0, n)
+	for fd := listenFDsStart; fd < listenFDsStart+n; fd++ {
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, ln := range lns {
+				ln.Close()
+			}
+			return nil, fmt.Errorf("smtpd: systemd fd %d: %v", fd, err)
+		}
+		lns = append(lns, ln)
+	}
+	return lns, nil
+}
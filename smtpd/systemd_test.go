@@ -0,0 +1,61 @@
+package smtpd
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"testing"
+)
+
+// TestSystemdListeners runs the test binary again as if socket
+// activated, with a listener as fd 3, and talks to it there.
+func TestSystemdListeners(t *testing.T) {
+	if os.Getenv("SMTPD_TEST_SYSTEMD_CHILD") != "" {
+		systemdChild()
+		return
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	f, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestSystemdListeners$")
+	cmd.Env = append(os.Environ(), "SMTPD_TEST_SYSTEMD_CHILD=1", "LISTEN_FDS=1")
+	cmd.ExtraFiles = []*os.File{f}
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer cmd.Wait()
+	defer cmd.Process.Kill()
+
+	c := dialTest(t, ln.Addr().String())
+	c.expect("EHLO client.test", "250-activated.test")
+	c.expect("QUIT", "221")
+}
+
+// systemdChild serves on the listeners from SystemdListeners.
+func systemdChild() {
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	lns, err := SystemdListeners()
+	if err != nil || len(lns) != 1 || os.Getenv("LISTEN_FDS") != "" {
+		os.Exit(1)
+	}
+	srv := &Server{Hostname: "activated.test"}
+	srv.ServeFromListeners(lns)
+	os.Exit(1)
+}
+
+func TestSystemdListenersNotActivated(t *testing.T) {
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	t.Setenv("LISTEN_FDS", "1")
+	if lns, err := SystemdListeners(); lns != nil || err != nil {
+		t.Errorf("SystemdListeners for another process = %v, %v; want nil, nil", lns, err)
+	}
+}
@@ -0,0 +1,153 @@
+package smtpd
+
+import "log"
+
+// TeeEnvelope is an Envelope that passes the transaction to each of
+// its Envelopes, for example to store a message and hand it to an
+// analysis system at the same time. Each Envelope sees the same
+// recipients and message, in order. Header lines added by the server
+// are written to all of them as part of the message.
+type TeeEnvelope struct {
+	Envelopes []Envelope
+
+	// TolerateErrors, if set, lets the transaction go on when an
+	// Envelope other than the first fails: the error is logged and
+	// that Envelope is left out from then on. Otherwise, an error from
+	// any of them fails the transaction. Either way, the first
+	// Envelope's errors always do. An Envelope left out is rolled
+	// back if it's a TxEnvelope.
+	//
+	// Only the first Envelope decides which recipients are accepted;
+	// the others are given just those. One that rejects a recipient
+	// the first accepted is left out if TolerateErrors is set.
+	// Otherwise it goes on without that recipient if it rejected it
+	// with an SMTPError, and fails the transaction at BeginData if it
+	// failed some other way.
+	TolerateErrors bool
+
+	fan fanout
+	err error // an AddRecipient failure to report at BeginData
+}
+
+// fanout tracks a transaction passed to several Envelopes, for
+// TeeEnvelope and QuorumEnvelope.
+type fanout struct {
+	failed    []bool // envs[i] has been left out
+	committed []bool // envs[i] has been committed
+}
+
+// each calls fn on each of envs still in the transaction. One that fn
+// fails for is left out from then on, and rolled back, if drop
+// reports true for it. each returns how many of envs fn succeeded for
+// and the first error it didn't leave an Envelope out for.
+func (f *fanout) each(name string, envs []Envelope, fn func(i int, e Envelope) error, drop func(i int, err error) bool) (ok int, err error) {
+	if f.failed == nil {
+		f.failed = make([]bool, len(envs))
+		f.committed = make([]bool, len(envs))
+	}
+	for i, e := range envs {
+		if f.failed[i] {
+			continue
+		}
+		ferr := fn(i, e)
+		switch {
+		case ferr == nil:
+			ok++
+		case drop(i, ferr):
+			f.failed[i] = true
+			log.Printf("%s: leaving out envelope %d: %v", name, i, ferr)
+			rollback(e)
+		case err == nil:
+			err = ferr
+		}
+	}
+	return ok, err
+}
+
+// commit commits e, Envelope i, if it's a TxEnvelope; it's for each.
+func (f *fanout) commit(i int, e Envelope) error {
+	tx, ok := e.(TxEnvelope)
+	if !ok {
+		return nil
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	f.committed[i] = true
+	return nil
+}
+
+// rollback rolls back each of envs still in the transaction that
+// hasn't been committed.
+func (f *fanout) rollback(envs []Envelope) {
+	for i, e := range envs {
+		if f.failed == nil || !f.failed[i] && !f.committed[i] {
+			rollback(e)
+		}
+	}
+}
+
+// each calls fn on each Envelope still in the transaction and returns
+// the error that fails it, if any.
+func (t *TeeEnvelope) each(fn func(i int, e Envelope) error) error {
+	_, err := t.fan.each("TeeEnvelope", t.Envelopes, fn, func(i int, _ error) bool {
+		return t.TolerateErrors && i > 0
+	})
+	return err
+}
+
+func (t *TeeEnvelope) AddRecipient(rcpt MailAddress) error {
+	var rejected bool
+	return t.each(func(i int, e Envelope) error {
+		if rejected {
+			return nil
+		}
+		err := e.AddRecipient(rcpt)
+		switch {
+		case err == nil:
+		case i == 0:
+			rejected = true
+		case t.TolerateErrors:
+			// each leaves this Envelope out.
+		default:
+			// The first Envelope has the recipient, so failing this
+			// one would leave them out of step.
+			log.Printf("TeeEnvelope: envelope %d rejected recipient %q: %v", i, rcpt.Email(), err)
+			if _, ok := err.(SMTPError); !ok && t.err == nil {
+				t.err = err
+			}
+			return nil
+		}
+		return err
+	})
+}
+
+func (t *TeeEnvelope) BeginData() error {
+	if t.err != nil {
+		return t.err
+	}
+	return t.each(func(_ int, e Envelope) error { return e.BeginData() })
+}
+
+func (t *TeeEnvelope) Write(line []byte) error {
+	return t.each(func(_ int, e Envelope) error { return e.Write(line) })
+}
+
+// Close closes each Envelope still in the transaction, even after one
+// of them fails, so none is left open.
+func (t *TeeEnvelope) Close() error {
+	return t.each(func(_ int, e Envelope) error { return e.Close() })
+}
+
+// Commit commits each Envelope still in the transaction that's a
+// TxEnvelope. The Envelopes can't be committed atomically: if one
+// fails, those committed before it stay committed.
+func (t *TeeEnvelope) Commit() error {
+	return t.each(t.fan.commit)
+}
+
+// Rollback rolls back each Envelope still in the transaction that
+// hasn't been committed.
+func (t *TeeEnvelope) Rollback() {
+	t.fan.rollback(t.Envelopes)
+}
@@ -0,0 +1,144 @@
+package smtpd
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// backend is a TxEnvelope for testing Envelopes that fan out to
+// several: it collects the transaction, rejecting the recipients in
+// reject and failing from the first Write if failWrite is set.
+type backend struct {
+	CollectingEnvelope
+	reject    map[string]error
+	failWrite error
+	state     string // "committed" or "rolled back" once ended
+}
+
+func (b *backend) AddRecipient(rcpt MailAddress) error {
+	if err := b.reject[rcpt.Email()]; err != nil {
+		return err
+	}
+	return b.CollectingEnvelope.AddRecipient(rcpt)
+}
+
+func (b *backend) Write(line []byte) error {
+	if b.failWrite != nil {
+		return b.failWrite
+	}
+	return b.CollectingEnvelope.Write(line)
+}
+
+func (b *backend) Commit() error { b.state = "committed"; return nil }
+func (b *backend) Rollback()     { b.state = "rolled back" }
+
+// rcpts returns b's recipients, space-separated.
+func (b *backend) rcpts() string {
+	var s []string
+	for _, r := range b.Rcpts {
+		s = append(s, r.Email())
+	}
+	return strings.Join(s, " ")
+}
+
+// runTx runs a transaction with the given recipients through e, as the
+// server would, and returns the recipients' replies and the error that
+// ended the transaction, if any.
+func runTx(e TxEnvelope, rcpts ...string) (rcptErrs []error, err error) {
+	for _, r := range rcpts {
+		rcptErrs = append(rcptErrs, e.AddRecipient(addrString(r)))
+	}
+	if err = e.BeginData(); err == nil {
+		if err = e.Write([]byte("Subject: hi\r\n")); err == nil {
+			if err = e.Close(); err == nil {
+				err = e.Commit()
+			}
+		}
+	}
+	if err != nil {
+		e.Rollback()
+	}
+	return rcptErrs, err
+}
+
+var errNoSuchUser = SMTPError("550 5.1.1 No such user")
+
+func TestTeeEnvelope(t *testing.T) {
+	onNewMail, last := collector()
+	second := new(CollectingEnvelope)
+	addr := testServer(t, &Server{
+		OnNewMail: func(c Connection, from MailAddress) (Envelope, error) {
+			first, _ := onNewMail(c, from)
+			*second = CollectingEnvelope{From: from}
+			return &TeeEnvelope{Envelopes: []Envelope{first, second}}, nil
+		},
+	})
+	c := dialTest(t, addr)
+	c.expect("EHLO client.test", "250")
+	if r := c.sendMail("a@b.test", "c@d.test", "Subject: hi\r\n\r\nbody"); !strings.HasPrefix(r, "250") {
+		t.Fatal(r)
+	}
+	want := "Subject: hi\r\n\r\nbody\r\n"
+	if got := last().Data.String(); got != want {
+		t.Errorf("first envelope got %q, want %q", got, want)
+	}
+	if got := second.Data.String(); got != want || len(second.Rcpts) != 1 {
+		t.Errorf("second envelope got %q for %v, want %q for c@d.test", got, second.Rcpts, want)
+	}
+}
+
+func TestTeeEnvelopeRecipients(t *testing.T) {
+	for _, tolerate := range []bool{false, true} {
+		first := &backend{reject: map[string]error{"x@test": errNoSuchUser}}
+		second := &backend{reject: map[string]error{"y@test": errNoSuchUser, "z@test": errors.New("disk full")}}
+		tee := &TeeEnvelope{Envelopes: []Envelope{first, second}, TolerateErrors: tolerate}
+		rcptErrs, err := runTx(tee, "a@test", "x@test", "y@test")
+		if rcptErrs[0] != nil || rcptErrs[1] != errNoSuchUser || rcptErrs[2] != nil {
+			t.Errorf("tolerate=%v: recipient replies %v, want the first envelope's", tolerate, rcptErrs)
+		}
+		if err != nil {
+			t.Errorf("tolerate=%v: transaction failed: %v", tolerate, err)
+		}
+		if got := first.rcpts(); got != "a@test y@test" {
+			t.Errorf("tolerate=%v: first envelope has %q", tolerate, got)
+		}
+		if got := second.rcpts(); got != "a@test" {
+			t.Errorf("tolerate=%v: second envelope has %q", tolerate, got)
+		}
+		want := "committed"
+		if tolerate {
+			want = "rolled back" // left out over y@test
+		}
+		if first.state != "committed" || second.state != want {
+			t.Errorf("tolerate=%v: envelopes %s and %s, want committed and %s", tolerate, first.state, second.state, want)
+		}
+	}
+
+	// Without TolerateErrors, a second envelope that fails rather
+	// than rejects fails the transaction.
+	first, second := new(backend), &backend{reject: map[string]error{"z@test": errors.New("disk full")}}
+	tee := &TeeEnvelope{Envelopes: []Envelope{first, second}}
+	rcptErrs, err := runTx(tee, "a@test", "z@test")
+	if rcptErrs[1] != nil || err == nil || err.Error() != "disk full" {
+		t.Errorf("got recipient reply %v and transaction error %v, want nil and disk full", rcptErrs[1], err)
+	}
+	if first.state != "rolled back" || second.state != "rolled back" {
+		t.Errorf("envelopes %s and %s, want both rolled back", first.state, second.state)
+	}
+}
+
+func TestTeeEnvelopeWriteError(t *testing.T) {
+	for _, tolerate := range []bool{false, true} {
+		first, second := new(backend), &backend{failWrite: errors.New("analysis down")}
+		tee := &TeeEnvelope{Envelopes: []Envelope{first, second}, TolerateErrors: tolerate}
+		_, err := runTx(tee, "a@test")
+		if tolerate {
+			if err != nil || first.state != "committed" || second.state != "rolled back" {
+				t.Errorf("tolerated: error %v, envelopes %s and %s", err, first.state, second.state)
+			}
+		} else if err == nil || first.state != "rolled back" {
+			t.Errorf("not tolerated: error %v, first envelope %s", err, first.state)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package smtpd
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"log"
+	"time"
+)
+
+// tlsHandshakeTimeout bounds the TLS handshake.
+const tlsHandshakeTimeout = 30 * time.Second
+
+var errClientCertRequired = SMTPError("535 5.7.8 Error: client certificate required")
+
+// TLSState returns the state of the connection's TLS session, and
+// whether it has one. It's encrypted either by STARTTLS or because the
+// Server is serving a TLS listener.
+func (s *session) TLSState() (tls.ConnectionState, bool) {
+	if tc, ok := s.rwc.(*tls.Conn); ok {
+		return tc.ConnectionState(), true
+	}
+	if s.proxyTLS != nil {
+		return *s.proxyTLS, true
+	}
+	return tls.ConnectionState{}, false
+}
+
+func (s *session) tlsActive() bool {
+	_, ok := s.TLSState()
+	return ok
+}
+
+func (s *session) handleStartTLS() {
+	if s.tlsActive() {
+		s.sendlinef("503 5.5.1 Error: TLS already active")
+		return
+	}
+	s.sendlinef("220 2.0.0 Ready to start TLS")
+	s.flush() // even if more was pipelined; it's dropped below
+	// Anything the client pipelined after STARTTLS was sent in the
+	// clear and must not be treated as coming over TLS (CVE-2011-0411),
+	// so it's dropped with the old bufio.Reader.
+	if n := s.br.Buffered(); n > 0 {
+		log.Printf("discarding %d bytes pipelined after STARTTLS", n)
+	}
+	tc := tls.Server(s.rwc, s.srv.TLSConfig)
+	if !s.handshake(tc) {
+		s.quit = true
+		return
+	}
+
+	s.srv.mu.Lock()
+	s.rwc = tc
+	s.srv.mu.Unlock()
+	s.br = bufio.NewReader(tc)
+	if s.srv.DebugTranscript != nil {
+		s.bw = bufio.NewWriter(transcriptWriter{s})
+	} else {
+		s.bw = bufio.NewWriter(tc)
+	}
+	// Forget everything learned from the client (RFC 3207 s4.2).
+	s.abortTransaction()
+	s.helloType, s.helloHost = "", ""
+	s.releaseUser()
+	s.authUser = ""
+	s.certAuth = false
+	if !s.checkClientCert() {
+		s.quit = true
+	}
+}
+
+// handshake runs the TLS handshake on tc, reporting whether it
+// succeeded.
+func (s *session) handshake(tc *tls.Conn) bool {
+	tc.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	if err := tc.Handshake(); err != nil {
+		s.errorf("TLS handshake error: %v", err)
+		return false
+	}
+	tc.SetDeadline(time.Time{})
+	return true
+}
+
+// checkClientCert passes the certificate chains the client presented
+// in the TLS handshake, if any verified, to Server.OnClientCert and, if
+// it accepts them, authenticates the session as the certificate's
+// subject. It reports false if the session must end.
+func (s *session) checkClientCert() bool {
+	cb := s.srv.OnClientCert
+	if cb == nil {
+		return true
+	}
+	cs, ok := s.TLSState()
+	if !ok || len(cs.VerifiedChains) == 0 {
+		return true
+	}
+	user := certUser(cs.VerifiedChains[0][0])
+	if err := cb(s, cs.VerifiedChains); err != nil {
+		log.Printf("client certificate %q from %v not accepted: %v", user, s.Addr(), err)
+		return true
+	}
+	if !s.authenticated(user) {
+		return false
+	}
+	s.certAuth = true
+	return true
+}
+
+// certUser returns the user a client certificate authenticates: its
+// subject's common name, or the whole subject if it has none.
+func certUser(cert *x509.Certificate) string {
+	if cn := cert.Subject.CommonName; cn != "" {
+		return cn
+	}
+	return cert.Subject.String()
+}
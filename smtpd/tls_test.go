@@ -0,0 +1,217 @@
+package smtpd
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCA is a certificate authority for test certificates.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t testing.TB) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert, key, pool}
+}
+
+// issue returns a certificate for cn signed by the CA, for a server
+// or, if client is set, a client.
+func (ca *testCA) issue(t testing.TB, cn string, client bool) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{cn},
+	}
+	if client {
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+		tmpl.DNSNames = nil
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// serverTLSConfig returns a TLS config for a server named mx.test.
+func serverTLSConfig(t testing.TB) *tls.Config {
+	ca := newTestCA(t)
+	return &tls.Config{Certificates: []tls.Certificate{ca.issue(t, "mx.test", false)}}
+}
+
+// startTLS runs STARTTLS and a TLS handshake with cfg, or an insecure
+// config if cfg is nil.
+func (tc *testClient) startTLS(cfg *tls.Config) {
+	tc.t.Helper()
+	tc.expect("STARTTLS", "220")
+	if cfg == nil {
+		cfg = &tls.Config{InsecureSkipVerify: true}
+	}
+	conn := tls.Client(tc.c, cfg)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.Handshake(); err != nil {
+		tc.t.Fatalf("TLS handshake: %v", err)
+	}
+	tc.c = conn
+	tc.br = bufio.NewReader(conn)
+}
+
+// authLine returns the mechanisms advertised in an EHLO reply.
+func authLine(ehlo string) string {
+	for _, l := range strings.Split(ehlo, "\n") {
+		if strings.HasPrefix(l[4:], "AUTH") {
+			return l[4:]
+		}
+	}
+	return ""
+}
+
+func TestAuthRequiresTLS(t *testing.T) {
+	addr := testServer(t, &Server{
+		TLSConfig:     serverTLSConfig(t),
+		PlainAuth:     true,
+		LoginAuth:     true,
+		CRAMMD5Secret: func(c Connection, user string) (string, error) { return "secret", nil },
+		OnAuth:        func(c Connection, user, pass string) error { return nil },
+	})
+	c := dialTest(t, addr)
+	if got := authLine(c.expect("EHLO client.test", "250")); got != "AUTH CRAM-MD5" {
+		t.Errorf("before STARTTLS: %q, want AUTH CRAM-MD5", got)
+	}
+	c.expect("AUTH PLAIN AHVzZXIAcGFzcw==", "538 5.7.11 Encryption required for requested authentication mechanism")
+	c.expect("AUTH LOGIN", "538 5.7.11")
+	c.startTLS(nil)
+	if got := authLine(c.expect("EHLO client.test", "250")); got != "AUTH CRAM-MD5 PLAIN LOGIN" {
+		t.Errorf("after STARTTLS: %q, want AUTH CRAM-MD5 PLAIN LOGIN", got)
+	}
+	c.expect("AUTH PLAIN AHVzZXIAcGFzcw==", "235")
+}
+
+func TestClientCert(t *testing.T) {
+	ca := newTestCA(t)
+	users := make(chan string, 3)
+	addr := testServer(t, &Server{
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{ca.issue(t, "mx.test", false)},
+			ClientAuth:   tls.VerifyClientCertIfGiven,
+			ClientCAs:    ca.pool,
+		},
+		RequireClientCert: true,
+		OnClientCert: func(c Connection, chains [][]*x509.Certificate) error {
+			if cs, _ := c.TLSState(); len(cs.VerifiedChains) != len(chains) {
+				t.Error("chains differ from TLSState's")
+			}
+			if chains[0][0].Subject.CommonName != "relay-client" {
+				return errors.New("unknown client")
+			}
+			return nil
+		},
+		OnNewMail: func(c Connection, from MailAddress) (Envelope, error) {
+			users <- c.AuthUser()
+			return new(BasicEnvelope), nil
+		},
+	})
+	for _, tt := range []struct {
+		cert string // "" for none
+		want string
+	}{
+		{"", "535 5.7.8 Error: client certificate required"},
+		{"relay-client", "250"},
+		{"stranger", "535 5.7.8"},
+	} {
+		cfg := &tls.Config{RootCAs: ca.pool, ServerName: "mx.test"}
+		if tt.cert != "" {
+			cfg.Certificates = []tls.Certificate{ca.issue(t, tt.cert, true)}
+		}
+		c := dialTest(t, addr)
+		c.expect("EHLO client.test", "250")
+		c.startTLS(cfg)
+		c.expect("EHLO client.test", "250")
+		if got := c.cmd("MAIL FROM:<a@b.test>"); !strings.HasPrefix(got, tt.want) {
+			t.Errorf("certificate %q: got %q, want %q", tt.cert, got, tt.want)
+		}
+	}
+	if got := <-users; got != "relay-client" {
+		t.Errorf("AuthUser() = %q, want the certificate's common name", got)
+	}
+}
+
+func TestRequireTLS(t *testing.T) {
+	flags := make(chan bool, 2)
+	addr := testServer(t, &Server{
+		TLSConfig:           serverTLSConfig(t),
+		RequireTLSExtension: true,
+		OnNewMail: func(c Connection, from MailAddress) (Envelope, error) {
+			flags <- c.RequireTLS()
+			return new(BasicEnvelope), nil
+		},
+	})
+	c := dialTest(t, addr)
+	if ehlo := c.expect("EHLO client.test", "250"); strings.Contains(ehlo, "REQUIRETLS") {
+		t.Errorf("REQUIRETLS advertised without TLS:\n%s", ehlo)
+	}
+	c.expect("MAIL FROM:<a@b.test> REQUIRETLS", "554 5.7.1 REQUIRETLS requires TLS")
+	c.startTLS(nil)
+	if ehlo := c.expect("EHLO client.test", "250"); !strings.Contains(ehlo, "\n250-REQUIRETLS\n") &&
+		!strings.HasSuffix(ehlo, "\n250 REQUIRETLS") {
+		t.Errorf("REQUIRETLS not advertised over TLS:\n%s", ehlo)
+	}
+	c.expect("MAIL FROM:<a@b.test> REQUIRETLS=yes", "501 5.5.4")
+	c.expect("MAIL FROM:<a@b.test> REQUIRETLS", "250")
+	if !<-flags {
+		t.Error("RequireTLS() = false after MAIL FROM with REQUIRETLS")
+	}
+	c.expect("RSET", "250")
+	c.expect("MAIL FROM:<a@b.test>", "250")
+	if <-flags {
+		t.Error("RequireTLS() = true after MAIL FROM without REQUIRETLS")
+	}
+
+	c = dialTest(t, testServer(t, &Server{TLSConfig: serverTLSConfig(t)}))
+	c.startTLS(nil)
+	c.expect("EHLO client.test", "250")
+	c.expect("MAIL FROM:<a@b.test> REQUIRETLS", "555 5.5.4 Error: REQUIRETLS not supported")
+}
@@ -0,0 +1,131 @@
+package smtpd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+var (
+	errInvalidUTF8     = SMTPError("500 5.6.7 Invalid UTF-8")
+	errNonASCIIAddress = SMTPError("553 5.6.7 Error: non-ASCII address requires SMTPUTF8")
+	errNonASCIIHeader  = SMTPError("554 5.6.7 Error: non-ASCII header requires SMTPUTF8")
+)
+
+// validArgText reports whether the command argument arg is free of
+// control characters and, unless utf8OK, of non-ASCII bytes. With
+// utf8OK, arg must be valid UTF-8.
+func validArgText(arg string, utf8OK bool) bool {
+	for i := 0; i < len(arg); i++ {
+		c := arg[i]
+		if c < ' ' || c == 0x7f {
+			return false
+		}
+		if c >= utf8.RuneSelf && !utf8OK {
+			return false
+		}
+	}
+	return !utf8OK || utf8.ValidString(arg)
+}
+
+// maxLogText bounds the client text quoted in a log message.
+const maxLogText = 256
+
+// logText returns s, client text for a log message, clipped to
+// maxLogText bytes without splitting a UTF-8 sequence. It's meant for
+// %q, which escapes any control characters and invalid UTF-8.
+func logText(s string) string {
+	if len(s) <= maxLogText {
+		return s
+	}
+	n := maxLogText
+	for i := 0; i < utf8.UTFMax-1 && !utf8.RuneStart(s[n]); i++ {
+		n--
+	}
+	return s[:n] + "..."
+}
+
+// logSafe returns s clipped by logText, with control characters and
+// invalid UTF-8 escaped as %q would, for log messages that embed
+// client text without quoting it.
+func logSafe(s string) string {
+	s = logText(s)
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case r == utf8.RuneError && size == 1:
+			fmt.Fprintf(&b, `\x%02x`, s[i])
+		case !unicode.IsPrint(r):
+			q := strconv.QuoteRune(r)
+			b.WriteString(q[1 : len(q)-1])
+		default:
+			b.WriteString(s[i : i+size])
+		}
+		i += size
+	}
+	return b.String()
+}
+
+// checkAddrText checks the characters of a MAIL FROM or RCPT TO
+// address when the server supports SMTPUTF8: addresses must be valid
+// UTF-8 in SMTPUTF8 transactions, and ASCII otherwise.
+func (s *session) checkAddrText(addr string) error {
+	if !s.srv.SMTPUTF8 {
+		return nil
+	}
+	if s.utf8 {
+		if !utf8.ValidString(addr) {
+			return errInvalidUTF8
+		}
+		return nil
+	}
+	for i := 0; i < len(addr); i++ {
+		if addr[i] >= utf8.RuneSelf {
+			return errNonASCIIAddress
+		}
+	}
+	return nil
+}
+
+// headerChecker checks the message header lines of a transaction,
+// which may arrive in several pieces when long.
+type headerChecker struct {
+	utf8  bool   // SMTPUTF8 transaction: headers must be valid UTF-8
+	carry []byte // incomplete UTF-8 sequence ending the last piece
+}
+
+// check returns an error if p, a header line or part of one, isn't
+// acceptable. partial is whether more of the line follows.
+func (hc *headerChecker) check(p []byte, partial bool) error {
+	if !hc.utf8 {
+		for _, b := range p {
+			if b >= utf8.RuneSelf {
+				return errNonASCIIHeader
+			}
+		}
+		return nil
+	}
+	if len(hc.carry) > 0 {
+		p = append(hc.carry, p...)
+		hc.carry = nil
+	}
+	if partial {
+		// Hold back a sequence split across pieces.
+		for i := 1; i < utf8.UTFMax && i <= len(p); i++ {
+			if utf8.RuneStart(p[len(p)-i]) {
+				if !utf8.FullRune(p[len(p)-i:]) {
+					hc.carry = append([]byte(nil), p[len(p)-i:]...)
+					p = p[:len(p)-i]
+				}
+				break
+			}
+		}
+	}
+	if !utf8.Valid(p) {
+		return errInvalidUTF8
+	}
+	return nil
+}
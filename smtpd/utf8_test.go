@@ -0,0 +1,123 @@
+package smtpd
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSMTPUTF8Addresses(t *testing.T) {
+	addr := testServer(t, &Server{SMTPUTF8: true})
+	c := dialTest(t, addr)
+	if r := c.expect("EHLO client.test", "250"); !strings.Contains(r, "SMTPUTF8") {
+		t.Fatalf("SMTPUTF8 not advertised:\n%s", r)
+	}
+	c.expect("MAIL FROM:<j\xc3\xb6ran@example.com> SMTPUTF8", "250")
+	c.expect("RCPT TO:<\xe7\x94\xa8\xe6\x88\xb7@example.net>", "250")
+	c.expect("RCPT TO:<bad\xff@example.net>", "500 5.6.7 Invalid UTF-8")
+	c.expect("RCPT TO:<cut\xe7\x94@example.net>", "500 5.6.7 Invalid UTF-8")
+	c.expect("RSET", "250")
+	c.expect("MAIL FROM:<j\xc3\xb6ran@example.com>", "553 5.6.7")
+}
+
+func TestSMTPUTF8Headers(t *testing.T) {
+	addr := testServer(t, &Server{SMTPUTF8: true})
+	c := dialTest(t, addr)
+	c.expect("EHLO client.test", "250")
+	for _, tt := range []struct {
+		utf8   bool
+		header string
+		want   string
+	}{
+		{true, "Subject: Gr\xc3\xbc\xc3\x9fe", "250"},
+		{true, "Subject: \xe2\x82\xac" + strings.Repeat("x", 5000) + "\xe2\x82\xac", "250"},
+		{true, "Subject: bad \xff", "500 5.6.7 Invalid UTF-8"},
+		{true, "Subject: truncated \xe2\x82", "500 5.6.7 Invalid UTF-8"},
+		{false, "Subject: Gr\xc3\xbc\xc3\x9fe", "554 5.6.7"},
+		{false, "Subject: plain", "250"},
+	} {
+		param := ""
+		if tt.utf8 {
+			param = " SMTPUTF8"
+		}
+		c.expect("MAIL FROM:<a@example.com>"+param, "250")
+		c.expect("RCPT TO:<b@example.net>", "250")
+		c.expect("DATA", "354")
+		// Non-ASCII in the body doesn't matter either way.
+		c.expect(tt.header+"\r\n\r\nbody \xff\r\n.", tt.want)
+	}
+}
+
+func TestHeaderCheckerSplitSequence(t *testing.T) {
+	hc := &headerChecker{utf8: true}
+	// "€" split across three pieces of a long line.
+	for i, p := range []string{"Subject: \xe2", "\x82", "\xac\r\n"} {
+		if err := hc.check([]byte(p), i < 2); err != nil {
+			t.Fatalf("piece %d: %v", i, err)
+		}
+	}
+	if err := (&headerChecker{utf8: true}).check([]byte("Subject: \xe2\r\n"), false); err != errInvalidUTF8 {
+		t.Fatalf("truncated sequence: got %v, want errInvalidUTF8", err)
+	}
+}
+
+func TestHelloNonASCII(t *testing.T) {
+	strict := dialTest(t, testServer(t, &Server{StrictHello: true}))
+	strict.expect("EHLO client.test", "250")
+	strict.expect("EHLO h\xe9llo.test", "501 5.5.4 Invalid HELO argument")
+	strict.expect("EHLO bad\x7fhost", "501 5.5.4 Invalid HELO argument")
+	strict.expect("HELO \xff\xfe", "501 5.5.4 Invalid HELO argument")
+
+	utf8 := dialTest(t, testServer(t, &Server{StrictHello: true, SMTPUTF8: true}))
+	utf8.expect("EHLO bücher.test", "250")
+	utf8.expect("EHLO b\xfccher.test", "501 5.5.4 Invalid HELO argument") // Latin-1, not UTF-8
+
+	lax := dialTest(t, testServer(t, &Server{}))
+	lax.expect("EHLO h\xe9llo.test", "250")
+}
+
+func TestLogSafe(t *testing.T) {
+	for in, want := range map[string]string{
+		"plain text":           "plain text",
+		"caf\xc3\xa9":          "café",
+		"bad \xff\xfe bytes":   `bad \xff\xfe bytes`,
+		"split \xe2\x82":       `split \xe2\x82`,
+		"esc \x1b[31m red\r\n": `esc \x1b[31m red\r\n`,
+	} {
+		if got := logSafe(in); got != want {
+			t.Errorf("logSafe(%q) = %q, want %q", in, got, want)
+		}
+	}
+	// Clipping doesn't split a sequence: 255 bytes then a 3-byte €.
+	long := strings.Repeat("a", maxLogText-1) + "€€"
+	if got := logText(long); got != strings.Repeat("a", maxLogText-1)+"..." {
+		t.Errorf("logText split a sequence: ...%q", got[len(got)-8:])
+	}
+}
+
+func TestLogInvalidUTF8(t *testing.T) {
+	logs := captureLog(t)
+	c := dialTest(t, testServer(t, &Server{}))
+	c.expect("EHLO client.test", "250")
+	c.expect("MAIL FROM:<\xff\xe2\x82@b.test>", "")
+	c.expect("XBAD \xe2\x82\x1b[2J"+strings.Repeat("\xc3", 1000), "502")
+	c.expect("QUIT", "221")
+	c.closed()
+	out := logs.String()
+	if !utf8.ValidString(out) {
+		t.Errorf("log isn't valid UTF-8:\n%q", out)
+	}
+	if strings.Contains(out, "\x1b") {
+		t.Errorf("log contains a raw escape:\n%q", out)
+	}
+	for _, want := range []string{`\xff\xe2\x82@b.test`, `XBAD \xe2\x82\x1b[2J`} {
+		if !strings.Contains(out, want) {
+			t.Errorf("log lacks %s:\n%s", want, out)
+		}
+	}
+	for _, l := range strings.Split(out, "\n") {
+		if len(l) > 2*len(`\xc3`)*maxLogText {
+			t.Errorf("log line of %d bytes: %.80q...", len(l), l)
+		}
+	}
+}